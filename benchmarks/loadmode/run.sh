@@ -0,0 +1,45 @@
+#!/bin/bash
+# compare the loader modes on the same data against the mysql container of dbenv (docker-compose up -d)
+# usage: ./run.sh <data_path> [extra args of ./run]
+set -e
+DATA_PATH=$(realpath "$1")
+shift
+CONTAINER=tdsqlcomp-testenv
+PASSWORD=root-0h-mai-g0d-conta1neraizeision-yis-gr8t
+MODES=("prepared:" "interpolated:-interpolate" "loaddata:-loader loaddata")
+
+cd "$(dirname "$0")/../.."
+g++ -O2 ./presort/sortmerge.cpp -o ./presort/sortmerge
+go build -o run .
+
+mysql_exec() {
+    docker exec $CONTAINER mysql -uroot -p$PASSWORD -e "$1" 2>/dev/null
+}
+
+reset_target() {
+    ./cleanmigration.sh
+    for db in $(ls "$DATA_PATH/src_a"); do
+        mysql_exec "DROP DATABASE IF EXISTS \`$db\`;"
+    done
+}
+
+mysql_exec "SET GLOBAL local_infile = 1;"
+
+# keeps the password out of the process list
+export TDSQL_MIGRATE_DST_PASSWORD="$PASSWORD"
+
+# the first run presorts the data, the timed runs below reuse it
+echo "==== warm-up (presort) ===="
+reset_target
+./run -data_path "$DATA_PATH" -dst_ip 127.0.0.1 -dst_port 33330 -dst_user root -suppress_log -adaptive=false "$@" > /dev/null 2>&1
+
+for entry in "${MODES[@]}"; do
+    name=${entry%%:*}
+    args=${entry#*:}
+    reset_target
+    echo "==== $name ===="
+    /usr/bin/time -f "elapsed=%e s RSS=%MKB cpu.sys=%S user=%U" \
+        ./run -data_path "$DATA_PATH" -dst_ip 127.0.0.1 -dst_port 33330 -dst_user root -suppress_log -adaptive=false $args "$@" 2>&1 \
+        | grep -E "migration summary|elapsed=" || true
+done
+reset_target
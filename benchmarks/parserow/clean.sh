@@ -0,0 +1 @@
+rm -f ./parserow
\ No newline at end of file
@@ -0,0 +1 @@
+go build parserow.go
\ No newline at end of file
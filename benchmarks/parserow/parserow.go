@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Emanatry/tdsql-migrate-go/csvrow"
+)
+
+const BATCH_SIZE = 2000
+
+var kinds = []csvrow.Kind{csvrow.KindUint, csvrow.KindFloat, csvrow.KindBytes, csvrow.KindDatetime}
+
+// the lines of a csv file, or generated ones in the format of the data set
+func loadLines() [][]byte {
+	var lines [][]byte
+	if len(os.Args) > 1 {
+		f, err := os.Open(os.Args[1])
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() && len(lines) < 100*BATCH_SIZE {
+			lines = append(lines, append([]byte{}, scanner.Bytes()...))
+		}
+		return lines
+	}
+	for i := 0; i < 100*BATCH_SIZE; i++ {
+		line := fmt.Sprintf("%d,%.2f,%032x,2021-%02d-%02d %02d:%02d:%02d\n", i, rand.Float64()*2000-1000, rand.Int63(),
+			rand.Intn(12)+1, rand.Intn(28)+1, rand.Intn(24), rand.Intn(60), rand.Intn(60))
+		lines = append(lines, []byte(line))
+	}
+	return lines
+}
+
+// the conversion of the loader before csvrow
+func parseSplit(lines [][]byte) []interface{} {
+	var batchData []interface{}
+	for _, line := range lines {
+		data := strings.Split(strings.TrimSpace(string(line)), ",")
+		for i := 0; i < len(kinds); i++ {
+			var converted interface{}
+			var err error
+			switch i {
+			case 0:
+				converted, err = strconv.ParseUint(data[i], 10, 64)
+			case 1:
+				converted, err = strconv.ParseFloat(data[i], 64)
+			case 2:
+				converted, err = data[i], nil
+			case 3:
+				converted, err = time.ParseInLocation("2006-01-02 15:04:05", data[i], time.Local)
+			}
+			if err != nil {
+				panic(err)
+			}
+			batchData = append(batchData, converted)
+		}
+	}
+	return batchData
+}
+
+func parseCsvrow(batch *csvrow.Batch, lines [][]byte) []interface{} {
+	batch.Reset()
+	for _, line := range lines {
+		if err := batch.AppendLine(line); err != nil {
+			panic(err)
+		}
+	}
+	return batch.Args()
+}
+
+// parseCsvrow followed by what an Exec does to the arguments: database/sql hands every one of them
+// to the driver's converter, which dereferences the pointer and boxes the value
+func convertArgs(args []interface{}, values []driver.Value) {
+	for i, arg := range args {
+		v, err := driver.DefaultParameterConverter.ConvertValue(arg)
+		if err != nil {
+			panic(err)
+		}
+		values[i] = v
+	}
+}
+
+func run(name string, lines [][]byte, parse func(lines [][]byte) []interface{}) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	res := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			start := i % (len(lines) / BATCH_SIZE) * BATCH_SIZE
+			parse(lines[start : start+BATCH_SIZE])
+		}
+	})
+	runtime.ReadMemStats(&after)
+	fmt.Printf("%-12s %8d batches %12d ns/batch %8d ns/row %10d B/batch %8d allocs/batch %6d GCs %8.2f ms GC pause\n",
+		name, res.N, res.NsPerOp(), res.NsPerOp()/BATCH_SIZE, res.AllocedBytesPerOp(), res.AllocsPerOp(),
+		after.NumGC-before.NumGC, float64(after.PauseTotalNs-before.PauseTotalNs)/1e6)
+}
+
+func main() {
+	lines := loadLines()
+	if len(lines) < BATCH_SIZE {
+		fmt.Printf("need at least %d lines\n", BATCH_SIZE)
+		os.Exit(1)
+	}
+	fmt.Printf("%d lines, batches of %d rows\n", len(lines), BATCH_SIZE)
+	run("split", lines, parseSplit)
+	batch := csvrow.NewBatch(kinds, time.Local)
+	run("csvrow", lines, func(lines [][]byte) []interface{} {
+		return parseCsvrow(batch, lines)
+	})
+	values := make([]driver.Value, BATCH_SIZE*len(kinds))
+	run("csvrow+args", lines, func(lines [][]byte) []interface{} {
+		args := parseCsvrow(batch, lines)
+		convertArgs(args, values)
+		return args
+	})
+}
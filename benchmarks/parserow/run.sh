@@ -0,0 +1 @@
+./parserow $@
\ No newline at end of file
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"github.com/Emanatry/tdsql-migrate-go/config"
+	"github.com/Emanatry/tdsql-migrate-go/migrator"
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+)
+
+// problems printed per file before migrating, the lint command prints all of them
+const LINT_SHOWN_PER_FILE = 10
+
+func runLint(args []string) int {
+	flags := newCommandFlags("lint", "check every line of the source csv files against the schema of their table, the way they would be loaded\n"+
+		"(and presorted, unless -dedup server), and print every problem with its file, line and column.", true)
+	cfg, code, err := flags.parse(args)
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return code
+	}
+	srca, srcb, err := openSources(cfg, flags.selectedTables())
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	problems, err := lintSources(ctx, cfg, srca, srcb, -1)
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		if ctx.Err() != nil {
+			return EXIT_INTERRUPTED
+		}
+		return EXIT_FAILED
+	}
+	if problems > 0 {
+		return EXIT_FAILED
+	}
+	return EXIT_OK
+}
+
+// lint both sources, printing the problems (at most maxShown per file, all if negative) and a summary.
+// returns the number of problems, the error is for a cancelled ctx or sources that don't match.
+func lintSources(ctx context.Context, cfg *config.Config, srca *srcreader.Source, srcb *srcreader.Source, maxShown int) (int, error) {
+	shown := map[string]int{}
+	presort := cfg.Dedup == migrator.DEDUP_LOCAL
+	summaries, err := srcreader.LintSources(ctx, srca, srcb, presort, cfg.Location(), runtime.NumCPU(), func(p srcreader.LintProblem) {
+		if maxShown >= 0 && shown[p.Path] >= maxShown {
+			return
+		}
+		shown[p.Path]++
+		fmt.Println(p.String())
+	})
+	if err != nil {
+		return 0, err
+	}
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+
+	var lines int64
+	problems, bad := 0, 0
+	for _, s := range summaries {
+		lines += s.Lines
+		if s.Err != nil {
+			problems++
+			bad++
+			fmt.Printf(" - %s %s.%s: %s\n", s.Source, s.Database, s.Table, s.Err.Error())
+			continue
+		}
+		if s.Problems == 0 {
+			continue
+		}
+		problems += s.Problems
+		bad++
+		hidden := ""
+		if n := s.Problems - shown[s.Path]; n > 0 {
+			hidden = fmt.Sprintf(", %d not shown", n)
+		}
+		fmt.Printf(" - %s %s.%s: %d problem(s) in %d line(s)%s\n", s.Source, s.Database, s.Table, s.Problems, s.Lines, hidden)
+	}
+	fmt.Printf("=== lint summary: %d file(s), %d line(s), %d problem(s) in %d file(s)\n", len(summaries), lines, problems, bad)
+	return problems, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Emanatry/tdsql-migrate-go/config"
+	"github.com/Emanatry/tdsql-migrate-go/migrator"
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+	"github.com/Emanatry/tdsql-migrate-go/stats"
+)
+
+func runMigrate(args []string) int {
+	flags := newCommandFlags("migrate", "presort and merge the two sources, and load the merged rows into the target.\n"+
+		"checkpoints are written as the rows are committed, rerun with the same flags to resume.\n"+
+		"with -dedup server the sources are loaded one after the other without presorting, the target keeps the row with the latest updated_at.",
+		true)
+	cfg, code, err := flags.parse(args)
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return code
+	}
+	log := logger()
+	// for distinguishing between different builds and logs
+	if label, err := ioutil.ReadFile(config.LabelFile()); err == nil {
+		log.Infof("label of this build: %s", strings.TrimSpace(string(label)))
+	}
+	log.Infof("effective config:\n%s", cfg)
+
+	var srcdirs []string
+	dir, err := ioutil.ReadDir(cfg.DataPath)
+	if err != nil {
+		// do nothing
+	} else {
+		for _, v := range dir {
+			srcdirs = append(srcdirs, v.Name())
+		}
+	}
+
+	log.Infof("directories in data_path: %v", srcdirs)
+
+	srca, srcb, err := openSources(cfg, flags.selectedTables())
+	if err != nil {
+		log.Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+
+	log.Infof("source a databases: %v", srca.Databases)
+	log.Infof("source b databases: %v", srcb.Databases)
+
+	// graceful shutdown: the first signal stops scheduling new work and lets in-flight batches
+	// commit and checkpoint, the second one exits right away.
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	// a line that doesn't load fails its table, better to know before hours of loading
+	if cfg.Lint != config.LINT_OFF {
+		log.Infof("linting the sources")
+		problems, err := lintSources(ctx, cfg, srca, srcb, LINT_SHOWN_PER_FILE)
+		if err != nil && ctx.Err() != nil {
+			log.Errorf("interrupted while linting the sources")
+			return EXIT_INTERRUPTED
+		}
+		if err != nil {
+			log.Errorf("%s", err.Error())
+			return EXIT_FAILED
+		}
+		if problems > 0 && cfg.Lint == config.LINT_FAIL {
+			log.Errorf("the sources have lines that wouldn't load, fix them (see the lint command) or rerun with -lint warn")
+			return EXIT_FAILED
+		}
+	}
+
+	db, err := openTarget(cfg)
+	if err != nil {
+		log.Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+
+	log.Infof("connection to database succesfully established")
+
+	// test database connection
+	rows, err := db.Query("SHOW DATABASES;")
+	if err != nil {
+		log.Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+
+	var remote []string
+	for rows.Next() {
+		var dbname string
+		rows.Scan(&dbname)
+		remote = append(remote, dbname)
+	}
+
+	rows.Close()
+
+	log.Infof("remote databases: %v", remote)
+	log.Debugf("database stats: %+v", db.Stats())
+
+	var doExit *bool = stats.StartStatsReportingGoroutine(db)
+
+	log.Infof("migrating")
+
+	resume := false
+	// workaround for a judge env bug where not all tables from a previous migration attempt is dropped
+	if _, err := os.Stat(cfg.InProgressFile()); errors.Is(err, os.ErrNotExist) {
+		f, err := os.Create(cfg.InProgressFile())
+		if err != nil {
+			log.Errorf("failed creating migration_inprogress.txt: %s", err.Error())
+			return EXIT_FAILED
+		}
+		f.Write([]byte(time.Now().String()))
+		f.Close()
+	} else {
+		log.Infof("migration_inprogress.txt exists, resuming")
+		resume = true
+	}
+
+	m, err := newMigrator(cfg, srca, srcb, db, resume)
+	if err != nil {
+		log.Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+	if !resume {
+		if err = m.DropMetaMigration(); err != nil {
+			log.Warnf("failed dropping meta_migration: %s", err.Error())
+		}
+	}
+
+	if cfg.Dedup == migrator.DEDUP_LOCAL {
+		log.Infof("starting background presort & merge")
+		srcreader.StartBackgoundPresortMerge(ctx, srca, srcb)
+	}
+
+	result, err := m.Run(ctx)
+	if result != nil {
+		printSummary(result)
+	}
+	if err != nil {
+		db.Close()
+		*doExit = true
+		log.Errorf("%s", err.Error())
+		if errors.Is(err, migrator.ErrInterrupted) {
+			log.Warnf("migration interrupted, checkpoints saved. rerun with the same arguments to resume.")
+			return EXIT_INTERRUPTED
+		}
+		log.Errorf("migration failed, fix the errors above and rerun with the same arguments to resume.")
+		return EXIT_FAILED
+	}
+
+	if err := m.DropMetaMigration(); err != nil {
+		log.Warnf("failed dropping meta migration: %s", err.Error())
+	}
+
+	db.Close()
+	*doExit = true
+
+	log.Infof("all done, exiting")
+	os.Remove(cfg.InProgressFile())
+	return EXIT_OK
+}
+
+func printSummary(result *migrator.Result) {
+	fmt.Printf("=== migration summary: %d table(s) finished, %d failed, %d stopped before finishing\n",
+		result.Count(migrator.StateFinished), result.Count(migrator.StateFailed), result.Count(migrator.StateLoading)+result.Count(migrator.StatePending))
+	for _, t := range result.Tables {
+		if t.Err != nil {
+			fmt.Printf(" - %s %s.%s [%s]\n", t.Source, t.Database, t.Table, t.Err.Phase)
+		}
+	}
+	rejected := int64(0)
+	for _, t := range result.Tables {
+		rejected += t.DeadLetters
+	}
+	if rejected == 0 {
+		return
+	}
+	fmt.Printf("=== %d row(s) rejected by the target, not migrated:\n", rejected)
+	for _, t := range result.Tables {
+		if t.DeadLetters > 0 {
+			fmt.Printf(" - %s %s.%s: %d in %s\n", t.Source, t.Database, t.Table, t.DeadLetters, t.DeadLetterFile)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+func runPlan(args []string) int {
+	flags := newCommandFlags("plan", "show what migrate would do with every table, with the current settings.\n"+
+		"only reads the sources, the target isn't contacted.", true)
+	cfg, code, err := flags.parse(args)
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return code
+	}
+	srca, srcb, err := openSources(cfg, flags.selectedTables())
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+	m, err := newMigrator(cfg, srca, srcb, nil, false)
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+	plans, err := m.Plan(context.Background())
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+
+	fmt.Printf("dedup: %s, workers: %d (adaptive: %v)\n", cfg.Dedup, cfg.ConcurrentWorkers, cfg.Adaptive)
+	fmt.Printf("%-24s %10s %7s %6s %6s %7s %-8s %-8s %s\n", "table", "size(MB)", "merged", "ranges", "batch", "commit", "loader", "conflict", "deferred indexes")
+	var total int64
+	for _, p := range plans {
+		total += p.Size
+		fmt.Printf("%-24s %10.1f %7v %6d %6d %7d %-8s %-8s %s\n", p.Database+"."+p.Table, float64(p.Size)/1024/1024, p.Merged,
+			p.Ranges, p.BatchSize, p.CommitInterval, p.Loader, p.OnConflict, strings.Join(p.DeferredIndexes, ", "))
+	}
+	fmt.Printf("%d table(s), %.1f MB of csv\n", len(plans), float64(total)/1024/1024)
+	return EXIT_OK
+}
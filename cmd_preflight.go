@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/Emanatry/tdsql-migrate-go/config"
+	"github.com/Emanatry/tdsql-migrate-go/migrator"
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+	"github.com/Emanatry/tdsql-migrate-go/stats"
+)
+
+// results of the preflight checks, a failure makes the command fail
+type checklist struct {
+	failed int
+}
+
+func (c *checklist) ok(format string, args ...interface{}) {
+	fmt.Printf("[ OK ] %s\n", fmt.Sprintf(format, args...))
+}
+
+func (c *checklist) warn(format string, args ...interface{}) {
+	fmt.Printf("[WARN] %s\n", fmt.Sprintf(format, args...))
+}
+
+func (c *checklist) fail(format string, args ...interface{}) {
+	fmt.Printf("[FAIL] %s\n", fmt.Sprintf(format, args...))
+	c.failed++
+}
+
+func runPreflight(args []string) int {
+	flags := newCommandFlags("preflight", "check the sources, the local environment and the target with the current settings,\n"+
+		"without changing anything. fails if something would stop the migration.", true)
+	cfg, code, err := flags.parse(args)
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return code
+	}
+	c := &checklist{}
+	c.ok("config is valid")
+
+	srca, srcb, err := openSources(cfg, flags.selectedTables())
+	if err != nil {
+		c.fail("%s", err.Error())
+		return EXIT_FAILED
+	}
+	size := checkSources(c, srca, srcb)
+
+	if cfg.Dedup == migrator.DEDUP_LOCAL {
+		checkPresort(c, cfg, size)
+	}
+	checkTarget(c, cfg, srca)
+
+	if c.failed > 0 {
+		fmt.Printf("%d check(s) failed\n", c.failed)
+		return EXIT_FAILED
+	}
+	fmt.Println("preflight passed")
+	return EXIT_OK
+}
+
+// the sources are matched database by database and table by table, returns the bytes of csv
+func checkSources(c *checklist, srca *srcreader.Source, srcb *srcreader.Source) int64 {
+	if len(srca.Databases) != len(srcb.Databases) {
+		c.fail("src_a has %d database(s), src_b has %d", len(srca.Databases), len(srcb.Databases))
+		return 0
+	}
+	var size int64
+	tables := 0
+	for i, dba := range srca.Databases {
+		dbb := srcb.Databases[i]
+		if dba.Name != dbb.Name || strings.Join(dba.Tables, ",") != strings.Join(dbb.Tables, ",") {
+			c.fail("src_a %s %v doesn't match src_b %s %v", dba.Name, dba.Tables, dbb.Name, dbb.Tables)
+			continue
+		}
+		for _, table := range dba.Tables {
+			tables++
+			size += dba.TableDataSize(table) + dbb.TableDataSize(table)
+			for _, srcdb := range []*srcreader.SrcDatabase{dba, dbb} {
+				if _, err := os.Stat(srcdb.TableDataFilePath(table)); err != nil {
+					c.fail("%s %s.%s: %s", srcdb.SrcName, srcdb.Name, table, err.Error())
+				}
+			}
+		}
+	}
+	c.ok("sources: %d database(s), %d table(s), %.1f MB of csv", len(srca.Databases), tables, float64(size)/1024/1024)
+	return size
+}
+
+func checkPresort(c *checklist, cfg *config.Config, size int64) {
+	info, err := os.Stat(cfg.SortMergerProgram)
+	if err != nil {
+		c.fail("sortmerger_program %s: %s (build it with make.sh)", cfg.SortMergerProgram, err.Error())
+	} else if info.Mode()&0111 == 0 {
+		c.fail("sortmerger_program %s is not executable", cfg.SortMergerProgram)
+	} else {
+		c.ok("sortmerger_program %s", cfg.SortMergerProgram)
+	}
+
+	if err := os.MkdirAll(cfg.PresortPath, 0755); err != nil {
+		c.fail("presort_path %s: %s", cfg.PresortPath, err.Error())
+		return
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(cfg.PresortPath, &fs); err != nil {
+		c.warn("can't read the free space of presort_path %s: %s", cfg.PresortPath, err.Error())
+	} else if free := int64(fs.Bavail) * int64(fs.Bsize); free < size {
+		// the merged csv is at most the size of both sources
+		c.fail("presort_path %s has %.1f MB free, the merged csv may take up to %.1f MB", cfg.PresortPath, float64(free)/1024/1024, float64(size)/1024/1024)
+	} else {
+		c.ok("presort_path %s has %.1f MB free", cfg.PresortPath, float64(free)/1024/1024)
+	}
+
+	if mem := stats.AvailableMemory(); mem < 0 {
+		c.warn("can't detect the available memory, the presort budget falls back to %d MB", srcreader.PRESORT_DEFAULT_BUDGET_MB)
+	} else {
+		c.ok("%.0f MB of memory available", float64(mem)/1024/1024)
+	}
+}
+
+func checkTarget(c *checklist, cfg *config.Config, srca *srcreader.Source) {
+	db, err := openTarget(cfg)
+	if err != nil {
+		c.fail("%s", err.Error())
+		return
+	}
+	defer db.Close()
+
+	var version, sqlMode string
+	var packet, localInfile int64
+	err = db.QueryRow("SELECT @@version, @@max_allowed_packet, @@local_infile, @@sql_mode;").Scan(&version, &packet, &localInfile, &sqlMode)
+	if err != nil {
+		c.fail("failed reading the target's variables: %s", err.Error())
+		return
+	}
+	c.ok("target %s:%d, version %s", cfg.DstIP, cfg.DstPort, version)
+	if packet < 1024*1024 {
+		c.warn("max_allowed_packet is only %d bytes, batches will be small", packet)
+	} else {
+		c.ok("max_allowed_packet %d bytes", packet)
+	}
+
+	loaddata := cfg.Loader == migrator.LOADER_LOAD_DATA
+	for _, o := range cfg.Tables {
+		loaddata = loaddata || o.Loader == migrator.LOADER_LOAD_DATA
+	}
+	if loaddata && localInfile == 0 {
+		c.fail("the loaddata loader is used but local_infile is OFF on the target")
+	}
+
+	// a fresh migrate creates every table, which fails for the tables left by an earlier attempt.
+	// a resumed one (migration_inprogress.txt) only creates the missing ones.
+	if _, err := os.Stat(cfg.InProgressFile()); os.IsNotExist(err) {
+		for _, srcdb := range srca.Databases {
+			for _, table := range srcdb.Tables {
+				var exists int64
+				err := db.QueryRow("SELECT COUNT(*) FROM information_schema.`TABLES` WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?;", srcdb.Name, table).Scan(&exists)
+				if err == nil && exists > 0 {
+					c.warn("%s.%s already exists in the target, a fresh migrate will fail creating it", srcdb.Name, table)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Emanatry/tdsql-migrate-go/migrator"
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+)
+
+func runPresort(args []string) int {
+	flags := newCommandFlags("presort", "presort and merge the two sources without loading them, so that a later migrate starts loading right away.\n"+
+		"tables already merged are skipped.", true)
+	cfg, code, err := flags.parse(args)
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return code
+	}
+	if cfg.Dedup == migrator.DEDUP_SERVER {
+		fmt.Println("nothing to presort with -dedup server")
+		return EXIT_OK
+	}
+	srca, srcb, err := openSources(cfg, flags.selectedTables())
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	if err := srcreader.PresortAndMergeSource(ctx, srca, srcb); err != nil {
+		logger().Errorf("%s", err.Error())
+		if ctx.Err() != nil {
+			return EXIT_INTERRUPTED
+		}
+		return EXIT_FAILED
+	}
+	n := 0
+	for _, db := range srca.Databases {
+		n += len(db.Tables)
+	}
+	fmt.Printf("%d table(s) presorted and merged into %s\n", n, cfg.PresortPath)
+	return EXIT_OK
+}
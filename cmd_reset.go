@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+)
+
+func runReset(args []string) int {
+	flags := newCommandFlags("reset", "remove the checkpoints and dead letter files so that the next migrate starts over (like cleanmigration.sh).\n"+
+		"-presort also removes the presorted and merged data, -target drops the migrated databases (or tables with -table) in the target.", true)
+	presort := flags.fs.Bool("presort", false, "also remove the presorted and merged data")
+	target := flags.fs.Bool("target", false, "also drop the migrated databases and meta_migration in the target, or only the tables with -table")
+	yes := flags.fs.Bool("yes", false, "confirm -target")
+	cfg, code, err := flags.parse(args)
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return code
+	}
+	if *target && !*yes {
+		logger().Errorf("-target drops data in the target, add -yes to confirm")
+		return EXIT_USAGE
+	}
+	tables := flags.selectedTables()
+	srca, srcb, err := openSources(cfg, tables)
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+
+	var db *sql.DB
+	if *target {
+		db, err = openTarget(cfg)
+		if err != nil {
+			logger().Errorf("%s", err.Error())
+			return EXIT_FAILED
+		}
+		defer db.Close()
+	}
+	m, err := newMigrator(cfg, srca, srcb, db, false)
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+
+	if *target {
+		for _, srcdb := range srca.Databases {
+			if len(tables) == 0 {
+				fmt.Printf("dropping database %s\n", srcdb.Name)
+				_, err = db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS `%s`;", srcdb.Name))
+			} else {
+				for _, table := range srcdb.Tables {
+					fmt.Printf("dropping table %s.%s\n", srcdb.Name, table)
+					if _, err = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS `%s`.`%s`;", srcdb.Name, table)); err != nil {
+						break
+					}
+				}
+			}
+			if err != nil {
+				logger().Errorf("failed dropping: %s", err.Error())
+				return EXIT_FAILED
+			}
+		}
+		if len(tables) == 0 {
+			if err := m.DropMetaMigration(); err != nil {
+				logger().Warnf("failed dropping meta_migration: %s", err.Error())
+			}
+		}
+	}
+
+	if len(tables) == 0 {
+		err = os.RemoveAll(cfg.CheckpointPath())
+		if err == nil {
+			err = os.RemoveAll(cfg.DeadLetterPath())
+		}
+		if err == nil {
+			err = os.RemoveAll(cfg.InProgressFile())
+		}
+		if err == nil && *presort {
+			err = os.RemoveAll(cfg.PresortPath)
+		}
+	} else {
+		err = m.ResetCheckpoints()
+		for i, dba := range srca.Databases {
+			for _, table := range dba.Tables {
+				if err == nil && *presort {
+					err = srcreader.RemoveMergedTable(dba, srcb.Databases[i], table)
+				}
+			}
+		}
+	}
+	if err != nil {
+		logger().Errorf("failed resetting: %s", err.Error())
+		return EXIT_FAILED
+	}
+	fmt.Println("reset done")
+	return EXIT_OK
+}
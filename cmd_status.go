@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Emanatry/tdsql-migrate-go/migrator"
+)
+
+func runStatus(args []string) int {
+	flags := newCommandFlags("status", "show the progress of every table, read from the checkpoints in <work_dir>/migration_log.\n"+
+		"the target isn't contacted.", true)
+	cfg, code, err := flags.parse(args)
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return code
+	}
+	srca, srcb, err := openSources(cfg, flags.selectedTables())
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+	m, err := newMigrator(cfg, srca, srcb, nil, false)
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+	progress, err := m.Status()
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+
+	if _, err := os.Stat(cfg.InProgressFile()); err == nil {
+		fmt.Println("a migration is in progress (migration_inprogress.txt exists)")
+	}
+	counts := map[string]int{}
+	fmt.Printf("%-6s %-24s %-9s %6s %9s\n", "source", "table", "state", "ranges", "loaded")
+	for _, p := range progress {
+		counts[p.State]++
+		loaded := "-"
+		if p.State == migrator.StateFinished {
+			loaded = "100.0%"
+		} else if p.Total > 0 {
+			loaded = fmt.Sprintf("%.1f%%", float64(p.Loaded)*100/float64(p.Total))
+		}
+		fmt.Printf("%-6s %-24s %-9s %6d %9s\n", p.Source, p.Database+"."+p.Table, p.State, p.Ranges, loaded)
+	}
+	fmt.Printf("%d finished, %d loading, %d pending\n", counts[migrator.StateFinished], counts[migrator.StateLoading], counts[migrator.StatePending])
+	return EXIT_OK
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/Emanatry/tdsql-migrate-go/migrator"
+)
+
+func runVerify(args []string) int {
+	flags := newCommandFlags("verify", "compare every table in the target with its merged csv: the row counts, and the checksums of\n"+
+		"chunks of -chunk_rows rows cut at changes of the first column. mismatched chunks are listed with their key range.\n"+
+		"tables that haven't been merged (or with -dedup server) are only counted, and reported as \"count only\".\n"+
+		"with -diff or -repair_sql, the rows of the mismatched chunks are compared one by one.", true)
+	countOnly := flags.fs.Bool("count_only", false, "only compare the row counts")
+	chunkRows := flags.fs.Int("chunk_rows", 10000, "rows of the merged csv per checksum chunk")
+	diffPath := flags.fs.String("diff", "", "write the missing, extra and changed rows of the mismatched chunks to this file")
+	repairPath := flags.fs.String("repair_sql", "", "write the statements that make the mismatched rows of the target match the merged csv to this file")
+	cfg, code, err := flags.parse(args)
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return code
+	}
+	srca, srcb, err := openSources(cfg, flags.selectedTables())
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+	db, err := openTarget(cfg)
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+	defer db.Close()
+
+	m, err := newMigrator(cfg, srca, srcb, db, false)
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	if *countOnly {
+		return verifyCounts(m.CountRows(ctx))
+	}
+	checksums, err := m.VerifyChecksums(ctx, *chunkRows)
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+	mismatches, counted := 0, 0
+	fmt.Printf("%-24s %12s %12s %8s %s\n", "table", "expected", "actual", "chunks", "")
+	for _, c := range checksums {
+		expected, chunks, result := "?", "", "count only"
+		if c.Checked {
+			expected, chunks, result = fmt.Sprint(c.Rows), fmt.Sprint(c.Chunks), "ok"
+		} else if c.Err == nil {
+			counted++
+		}
+		if !c.OK() {
+			result = "MISMATCH"
+			mismatches++
+		}
+		if c.Err != nil {
+			result = "ERROR: " + c.Err.Error()
+		}
+		fmt.Printf("%-24s %12s %12d %8s %s\n", c.Database+"."+c.Table, expected, c.TargetRows, chunks, result)
+		for _, chunk := range c.Mismatches {
+			after, upto := "-inf", "+inf"
+			if chunk.After != "" {
+				after = chunk.After
+			}
+			if chunk.Upto != "" {
+				upto = chunk.Upto
+			}
+			fmt.Printf("    chunk %d, %s in (%s, %s]: %d rows, %d in the target, checksum %d, %d in the target\n",
+				chunk.Index, c.KeyColumn, after, upto, chunk.Rows, chunk.TargetRows, chunk.Sum, chunk.TargetSum)
+		}
+	}
+	if mismatches > 0 {
+		fmt.Printf("%d table(s) don't match\n", mismatches)
+		if *diffPath != "" || *repairPath != "" {
+			if err := diffMismatches(ctx, m, checksums, *diffPath, *repairPath); err != nil {
+				logger().Errorf("%s", err.Error())
+			}
+		}
+		return EXIT_FAILED
+	}
+	if counted > 0 {
+		fmt.Printf("all checksummed tables match, %d table(s) were only counted and not verified\n", counted)
+		return EXIT_OK
+	}
+	fmt.Println("all checked tables match")
+	return EXIT_OK
+}
+
+// compare the rows of every mismatched chunk, writing the report and the repair script
+func diffMismatches(ctx context.Context, m *migrator.Migrator, checksums []migrator.TableChecksum, diffPath string, repairPath string) (err error) {
+	var files []*os.File
+	var buffers []*bufio.Writer
+	// flushed and closed explicitly, a failed write of a buffered file only shows there
+	defer func() {
+		for i, w := range buffers {
+			if ferr := w.Flush(); ferr != nil && err == nil {
+				err = fmt.Errorf("failed writing %s: %w", files[i].Name(), ferr)
+			}
+			if cerr := files[i].Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}()
+	create := func(path string) (io.Writer, error) {
+		if path == "" {
+			return ioutil.Discard, nil
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		w := bufio.NewWriter(f)
+		files, buffers = append(files, f), append(buffers, w)
+		return w, nil
+	}
+	report, err := create(diffPath)
+	if err != nil {
+		return err
+	}
+	repair, err := create(repairPath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(repair, "-- makes the target match the merged csv, generated by verify\n")
+	if repairPath != "" {
+		session, err := m.RepairSession(ctx)
+		if err != nil {
+			return err
+		}
+		for _, stmt := range session {
+			fmt.Fprintln(repair, stmt)
+		}
+	}
+	for _, c := range checksums {
+		if c.Err != nil || len(c.Mismatches) == 0 {
+			continue
+		}
+		counts := map[string]int{}
+		for _, chunk := range c.Mismatches {
+			fmt.Fprintf(report, "=== %s.%s chunk %d: %d rows, %d in the target\n", c.Database, c.Table, chunk.Index, chunk.Rows, chunk.TargetRows)
+			err := m.DiffChunk(ctx, c, chunk, func(d migrator.RowDiff) error {
+				counts[d.Kind]++
+				fmt.Fprintln(report, d.String())
+				fmt.Fprintf(repair, "-- %s\n%s\n", d.String(), d.RepairSQL)
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed comparing the rows of %s.%s chunk %d: %w", c.Database, c.Table, chunk.Index, err)
+			}
+		}
+		fmt.Printf("%s.%s: %d missing, %d extra, %d changed row(s)\n", c.Database, c.Table, counts[migrator.DIFF_MISSING], counts[migrator.DIFF_EXTRA], counts[migrator.DIFF_CHANGED])
+	}
+	return nil
+}
+
+func verifyCounts(counts []migrator.TableCount, err error) int {
+	if err != nil {
+		logger().Errorf("%s", err.Error())
+		return EXIT_FAILED
+	}
+	mismatches := 0
+	fmt.Printf("%-24s %12s %12s %s\n", "table", "expected", "actual", "")
+	for _, c := range counts {
+		expected, result := "?", "unchecked"
+		if c.Expected >= 0 {
+			expected, result = fmt.Sprint(c.Expected), "ok"
+		}
+		if !c.OK() {
+			result = "MISMATCH"
+			mismatches++
+		}
+		fmt.Printf("%-24s %12s %12d %s\n", c.Database+"."+c.Table, expected, c.Actual, result)
+	}
+	if mismatches > 0 {
+		fmt.Printf("%d table(s) don't match\n", mismatches)
+		return EXIT_FAILED
+	}
+	fmt.Println("all checked tables match")
+	return EXIT_OK
+}
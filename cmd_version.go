@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+
+	"github.com/Emanatry/tdsql-migrate-go/config"
+)
+
+// set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+func runVersion(args []string) int {
+	fs := flag.NewFlagSet("version", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s version\n\nprint the version of this build and its label.txt\n", os.Args[0])
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return EXIT_OK
+		}
+		return EXIT_USAGE
+	}
+	fmt.Printf("tdsql-migrate-go %s (%s %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	if label, err := ioutil.ReadFile(config.LabelFile()); err == nil {
+		fmt.Printf("label: %s", label)
+	}
+	return EXIT_OK
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/Emanatry/tdsql-migrate-go/config"
+	"github.com/Emanatry/tdsql-migrate-go/logging"
+	"github.com/Emanatry/tdsql-migrate-go/migrator"
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// the flags of a command: its own ones, the settings of the config package shared by every command,
+// and -table for the commands working on a selection of tables
+type commandFlags struct {
+	fs       *flag.FlagSet
+	settings *config.Flags
+	tables   *string
+}
+
+func newCommandFlags(name string, description string, withTables bool) *commandFlags {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s [flags]\n\n%s\n\nflags:\n", os.Args[0], name, description)
+		fs.PrintDefaults()
+	}
+	f := &commandFlags{fs: fs, settings: config.RegisterFlags(fs)}
+	if withTables {
+		f.tables = fs.String("table", "", "only these tables, comma separated \"db.table\" or \"db\" for a whole database")
+	}
+	return f
+}
+
+// the logger of the process, writing to stderr until the log_* settings are loaded by commandFlags.parse
+func logger() *logging.Logger {
+	return logging.Default()
+}
+
+// parse the arguments and load the effective settings, applied to the packages and to the logger.
+// the exit code is only meaningful when err is not nil.
+func (f *commandFlags) parse(args []string) (*config.Config, int, error) {
+	if err := f.fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil, EXIT_OK, err
+		}
+		return nil, EXIT_USAGE, err
+	}
+	if f.fs.NArg() > 0 {
+		return nil, EXIT_USAGE, fmt.Errorf("unexpected arguments: %v", f.fs.Args())
+	}
+	cfg, err := f.settings.Load()
+	if err != nil {
+		return nil, EXIT_USAGE, err
+	}
+	cfg.Apply()
+	log, err := cfg.OpenLogger()
+	if err != nil {
+		return nil, EXIT_USAGE, err
+	}
+	logging.SetDefault(log)
+	return cfg, EXIT_OK, nil
+}
+
+// the tables selected with -table, nil for all
+func (f *commandFlags) selectedTables() []string {
+	if f.tables == nil {
+		return nil
+	}
+	var tables []string
+	for _, t := range strings.Split(*f.tables, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+// open both sources under data_path, restricted to the selected tables
+func openSources(cfg *config.Config, tables []string) (srca *srcreader.Source, srcb *srcreader.Source, err error) {
+	srca, err = srcreader.Open(cfg.DataPath+"src_a", "src_a")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed opening source a: %w", err)
+	}
+	srcb, err = srcreader.Open(cfg.DataPath+"src_b", "src_b")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed opening source b: %w", err)
+	}
+	if len(tables) > 0 {
+		if srca, err = srca.Filter(tables); err != nil {
+			return nil, nil, err
+		}
+		if srcb, err = srcb.Filter(tables); err != nil {
+			return nil, nil, err
+		}
+	}
+	return srca, srcb, nil
+}
+
+// a migrator of the sources with the settings, logging to the logger of the process.
+// db is nil for the commands that don't touch the target.
+func newMigrator(cfg *config.Config, srca *srcreader.Source, srcb *srcreader.Source, db *sql.DB, resume bool) (*migrator.Migrator, error) {
+	return migrator.New(migrator.Options{
+		DB:       db,
+		SourceA:  srca,
+		SourceB:  srcb,
+		Settings: cfg.MigratorSettings(),
+		Logger:   logger(),
+		Resume:   resume,
+	})
+}
+
+// open the connection pool of the target and check that it's reachable
+func openTarget(cfg *config.Config) (*sql.DB, error) {
+	logger().Infof("DSN: %s", cfg.RedactedDSN())
+
+	connector, err := cfg.Connector()
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+
+	db.SetConnMaxIdleTime(-1)
+	db.SetConnMaxLifetime(-1)
+	db.SetMaxOpenConns(100)
+	db.SetMaxIdleConns(100)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed connecting to the target: %w", err)
+	}
+	return db, nil
+}
+
+// cancelled by the first SIGINT/SIGTERM, the second one exits right away
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		logger().Warnf("received %s, finishing in-flight batches and writing checkpoints (send again to exit immediately)", sig)
+		cancel()
+		sig = <-sigs
+		logger().Errorf("received %s again, exiting immediately", sig)
+		os.Exit(EXIT_INTERRUPTED)
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,468 @@
+// settings of a migration, read from a json file with environment and command line overrides.
+// every setting has a json key, an environment variable TDSQL_MIGRATE_<KEY> (upper case) and a flag
+// -<key>. they are applied in this order, the last one wins:
+//
+//	defaults < config file (-config) < environment < flags
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Emanatry/tdsql-migrate-go/logging"
+	"github.com/Emanatry/tdsql-migrate-go/migrator"
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+)
+
+const ENV_PREFIX = "TDSQL_MIGRATE_"
+
+// what migrate does with the lines of the sources that wouldn't load, see srcreader.LintSources
+const (
+	LINT_FAIL = "fail" // list them and stop before loading anything
+	LINT_WARN = "warn" // list them and migrate anyway, their tables fail when they get to them
+	LINT_OFF  = "off"  // don't check the sources
+)
+
+type Config struct {
+	DataPath    string `json:"data_path" help:"dir path of source data"`
+	DstIP       string `json:"dst_ip" help:"ip of dst database address"`
+	DstPort     int    `json:"dst_port" help:"port of dst database address"`
+	DstUser     string `json:"dst_user" help:"user name of dst database"`
+	DstPassword string `json:"dst_password" help:"password of dst database, prefer TDSQL_MIGRATE_DST_PASSWORD or dst_password_file"`
+
+	DstPasswordFile string `json:"dst_password_file" help:"file holding the password of dst database"`
+	DstDefaultsFile string `json:"dst_defaults_file" help:"mysql option file whose [client] user, password, host and port are used when not set otherwise"`
+
+	DstTLSMode string `json:"dst_tls_mode" help:"tls of the dst connection: disabled, preferred, required, verify-ca or verify-identity"`
+	DstTLSCA   string `json:"dst_tls_ca" help:"pem CA bundle the dst server certificate is verified against, the system roots if empty"`
+	DstTLSCert string `json:"dst_tls_cert" help:"pem client certificate presented to dst"`
+	DstTLSKey  string `json:"dst_tls_key" help:"pem private key of dst_tls_cert"`
+
+	tlsConfigName string // the DSN's tls parameter, set by setupTLS
+
+	WorkDir string `json:"work_dir" help:"dir of the checkpoints, presorted data and other state of this migration"`
+
+	LogLevel    string `json:"log_level" help:"lowest level logged: debug (every batch), info, warn or error"`
+	LogFormat   string `json:"log_format" help:"format of the log lines: text or json (one object per line)"`
+	LogFile     string `json:"log_file" help:"file the log is appended to, stderr if empty"`
+	SuppressLog bool   `json:"suppress_log" help:"don't log the batch lines even at log_level debug"`
+	FailFast    bool   `json:"fail_fast" help:"stop all other tables as soon as one table fails"`
+
+	DeadLetterLimit int `json:"dead_letter_limit" help:"rows of a table the target may reject (too long, out of range...) before the table fails, written to <work_dir>/dead_letter/, insert loader only. 0 (off) fails on the first one"`
+
+	Lint string `json:"lint" help:"check every source csv against its schema before migrating: fail (stop on a line that wouldn't load), warn or off"`
+
+	// concurrency
+	Adaptive                    bool           `json:"adaptive" help:"adjust the number of workers to the live throughput"`
+	ConcurrentWorkers           int            `json:"concurrent_workers" help:"tables (or ranges of tables) loaded at the same time, the starting point with -adaptive"`
+	ConcurrentTablesPerDatabase int            `json:"concurrent_tables_per_database" help:"max workers on the same database, 0 for no limit"`
+	DatabaseConcurrencyCaps     map[string]int `json:"database_concurrency_caps"` // per database concurrent_tables_per_database
+	RangesPerTable              int            `json:"ranges_per_table" help:"max byte ranges a large table is split into, loaded concurrently"`
+	MinRangeSize                int64          `json:"min_range_size" help:"min bytes of merged csv per range"`
+
+	// loading, batch_size to defer_indexes can be overridden per database or table with "tables"
+	Dedup          string                            `json:"dedup" help:"where the two sources are deduplicated: local (presort and merge) or server (load both, the target keeps the latest updated_at)"`
+	BatchSize      int                               `json:"batch_size" help:"rows per insert batch to start from, adapted to the latency"`
+	CommitInterval int                               `json:"commit_interval" help:"batches per transaction"`
+	Loader         string                            `json:"loader" help:"how rows are loaded: insert (multi-row prepared INSERT) or loaddata (LOAD DATA LOCAL INFILE, needs local_infile=ON)"`
+	OnConflict     string                            `json:"on_conflict" help:"rows whose key already exists in the target: ignore, replace, or newer to keep the latest updated_at"`
+	DeferIndexes   bool                              `json:"defer_indexes" help:"create the secondary indexes after loading the rows"`
+	Interpolate    bool                              `json:"interpolate" help:"send insert batches as literal SQL instead of server-side prepared statements"`
+	Tables         map[string]migrator.TableOverride `json:"tables"` // keyed by "db" or "db.table"
+
+	// session of the loading connections
+	DisableUniqueChecks     bool   `json:"disable_unique_checks" help:"set unique_checks=0 on the loading sessions"`
+	DisableForeignKeyChecks bool   `json:"disable_foreign_key_checks" help:"set foreign_key_checks=0 on the loading sessions"`
+	DisableBinlog           bool   `json:"disable_binlog" help:"set sql_log_bin=0 on the loading sessions (needs SUPER)"`
+	TimeZone                string `json:"time_zone" help:"time_zone of the loading sessions, empty to keep the server's"`
+	LockWaitTimeout         int    `json:"lock_wait_timeout" help:"innodb_lock_wait_timeout of the loading sessions in seconds, 0 to keep the server's"`
+
+	// presort
+	PresortPath       string `json:"presort_path" help:"dir of the presorted and merged csv files, <work_dir>/presort/data/ if empty"`
+	SortMergerProgram string `json:"sortmerger_program" help:"path of the sortmerge program, looked up next to this executable if empty"`
+	PresortMemMB      int    `json:"presort_mem_mb" help:"memory budget of the presort jobs in MB, 0 for a share of the available memory"`
+	MaxPresortJobs    int    `json:"max_presort_jobs" help:"max sortmerge processes at the same time"`
+}
+
+// the settings used when nothing else is given, the defaults of the packages
+func Default() *Config {
+	m := migrator.DefaultSettings()
+	return &Config{
+		DataPath:   "/tmp/data/",
+		DstTLSMode: TLS_PREFERRED,
+		WorkDir:    ".",
+
+		LogLevel:    logging.LEVEL_INFO.String(),
+		LogFormat:   logging.FORMAT_TEXT,
+		SuppressLog: !m.LogBatches,
+		FailFast:    m.FailFast,
+		Lint:        LINT_FAIL,
+
+		DeadLetterLimit: m.DeadLetterLimit,
+
+		Adaptive:                    m.Adaptive,
+		ConcurrentWorkers:           m.ConcurrentWorkers,
+		ConcurrentTablesPerDatabase: m.ConcurrentTablesPerDatabase,
+		DatabaseConcurrencyCaps:     m.DatabaseConcurrencyCaps,
+		RangesPerTable:              m.RangesPerTable,
+		MinRangeSize:                m.MinRangeSize,
+
+		Dedup:          m.Dedup,
+		BatchSize:      m.BatchSize,
+		CommitInterval: m.CommitInterval,
+		Loader:         m.Loader,
+		OnConflict:     m.OnConflict,
+		DeferIndexes:   m.DeferIndexes,
+		Interpolate:    m.Interpolate,
+		Tables:         m.Tables,
+
+		DisableUniqueChecks:     m.Session.DisableUniqueChecks,
+		DisableForeignKeyChecks: m.Session.DisableForeignKeyChecks,
+		DisableBinlog:           m.Session.DisableBinlog,
+		TimeZone:                m.Session.TimeZone,
+		LockWaitTimeout:         m.Session.LockWaitTimeout,
+
+		PresortMemMB:   srcreader.PresortMemoryBudgetMB,
+		MaxPresortJobs: srcreader.MaxPresortJobs,
+	}
+}
+
+// merge a json config file into c, keys missing from the file are left as they are
+func (c *Config) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed reading config file: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("failed parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// a scalar setting, by its json key
+type field struct {
+	key   string
+	help  string
+	value reflect.Value
+}
+
+func (c *Config) fields() []field {
+	var fields []field
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" { // unexported
+			continue
+		}
+		switch t.Field(i).Type.Kind() {
+		case reflect.String, reflect.Int, reflect.Int64, reflect.Bool:
+			key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			fields = append(fields, field{key, t.Field(i).Tag.Get("help"), v.Field(i)})
+		}
+	}
+	return fields
+}
+
+func setField(f field, s string) error {
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", s)
+		}
+		f.value.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", s)
+		}
+		f.value.SetBool(b)
+	}
+	return nil
+}
+
+// override the settings with the TDSQL_MIGRATE_<KEY> environment variables that are set
+func (c *Config) LoadEnv() error {
+	var errs []string
+	for _, f := range c.fields() {
+		if s, ok := os.LookupEnv(ENV_PREFIX + strings.ToUpper(f.key)); ok {
+			if err := setField(f, s); err != nil {
+				errs = append(errs, ENV_PREFIX+strings.ToUpper(f.key)+": "+err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New("invalid environment:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// a flag that only records its value, applied on top of the file and the environment by Flags.Load
+type flagValue struct {
+	kind  reflect.Kind
+	value string
+}
+
+func (v *flagValue) String() string {
+	return v.value
+}
+
+func (v *flagValue) Set(s string) error {
+	switch v.kind {
+	case reflect.Int, reflect.Int64:
+		if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+			return errors.New("not an integer")
+		}
+	case reflect.Bool:
+		if _, err := strconv.ParseBool(s); err != nil {
+			return errors.New("not a boolean")
+		}
+	}
+	v.value = s
+	return nil
+}
+
+func (v *flagValue) IsBoolFlag() bool {
+	return v.kind == reflect.Bool
+}
+
+// the command line flags of the settings
+type Flags struct {
+	fs          *flag.FlagSet
+	configPath  *string
+	tableLoader *string
+	values      map[string]*flagValue
+}
+
+// register -config and a flag for every scalar setting on fs, with the defaults as default values
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{fs: fs, values: map[string]*flagValue{}}
+	f.configPath = fs.String("config", "", "json config file, see config.example.json")
+	for _, field := range Default().fields() {
+		v := &flagValue{kind: field.value.Kind(), value: fmt.Sprint(field.value.Interface())}
+		f.values[field.key] = v
+		fs.Var(v, field.key, field.help)
+	}
+	f.tableLoader = fs.String("table_loader", "", "per table loader overrides, e.g. db1.4=loaddata,db2.1=insert")
+	return f
+}
+
+// the effective settings after fs has been parsed, validated
+func (f *Flags) Load() (*Config, error) {
+	c := Default()
+	if *f.configPath != "" {
+		if err := c.LoadFile(*f.configPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.LoadEnv(); err != nil {
+		return nil, err
+	}
+	fields := map[string]field{}
+	for _, field := range c.fields() {
+		fields[field.key] = field
+	}
+	f.fs.Visit(func(fl *flag.Flag) {
+		if field, ok := fields[fl.Name]; ok {
+			setField(field, f.values[fl.Name].value) // already checked by Set
+		}
+	})
+	if err := c.setTableLoaders(*f.tableLoader); err != nil {
+		return nil, err
+	}
+	if err := c.resolveCredentials(); err != nil {
+		return nil, err
+	}
+	if err := c.resolvePaths(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if err := c.setupTLS(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// "db1.4=loaddata,db2.1=insert" into the table overrides
+func (c *Config) setTableLoaders(s string) error {
+	if c.Tables == nil {
+		c.Tables = map[string]migrator.TableOverride{}
+	}
+	for _, item := range strings.Split(s, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) != 2 || !strings.Contains(kv[0], ".") {
+			return fmt.Errorf("invalid -table_loader entry %q, expected db.table=insert|loaddata", item)
+		}
+		o := c.Tables[kv[0]]
+		o.Loader = kv[1]
+		c.Tables[kv[0]] = o
+	}
+	return nil
+}
+
+func validLoader(s string) bool {
+	return s == migrator.LOADER_INSERT || s == migrator.LOADER_LOAD_DATA
+}
+
+func validConflict(s string) bool {
+	return s == migrator.CONFLICT_IGNORE || s == migrator.CONFLICT_REPLACE || s == migrator.CONFLICT_NEWER
+}
+
+// check every setting, all the problems found are reported at once
+func (c *Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.DataPath != "", "data_path: must not be empty")
+	check(c.DstPort >= 0 && c.DstPort <= 65535, "dst_port: %d is not a valid port", c.DstPort)
+	check(validTLSMode(c.DstTLSMode), "dst_tls_mode: unknown mode %q, expected disabled, preferred, required, verify-ca or verify-identity", c.DstTLSMode)
+	check(c.DstTLSMode != TLS_VERIFY_CA || c.DstTLSCA != "", "dst_tls_ca: required with dst_tls_mode verify-ca")
+	check((c.DstTLSCert == "") == (c.DstTLSKey == ""), "dst_tls_cert, dst_tls_key: must be set together")
+	check(c.DstTLSCert == "" || c.DstTLSMode != TLS_DISABLED, "dst_tls_cert: a client certificate needs a dst_tls_mode other than disabled")
+	check(c.ConcurrentWorkers >= 1, "concurrent_workers: must be at least 1, got %d", c.ConcurrentWorkers)
+	check(!c.Adaptive || c.ConcurrentWorkers <= migrator.ADAPTIVE_MAX_WORKERS,
+		"concurrent_workers: must be at most %d with adaptive, got %d", migrator.ADAPTIVE_MAX_WORKERS, c.ConcurrentWorkers)
+	check(c.ConcurrentTablesPerDatabase >= 0, "concurrent_tables_per_database: must not be negative, got %d", c.ConcurrentTablesPerDatabase)
+	for db, n := range c.DatabaseConcurrencyCaps {
+		check(n >= 0, "database_concurrency_caps.%s: must not be negative, got %d", db, n)
+	}
+	check(c.RangesPerTable >= 1, "ranges_per_table: must be at least 1, got %d", c.RangesPerTable)
+	check(c.MinRangeSize >= 1, "min_range_size: must be at least 1, got %d", c.MinRangeSize)
+	check(c.BatchSize >= migrator.MIN_BATCH_SIZE && c.BatchSize <= migrator.MAX_BATCH_SIZE,
+		"batch_size: must be between %d and %d, got %d", migrator.MIN_BATCH_SIZE, migrator.MAX_BATCH_SIZE, c.BatchSize)
+	check(c.CommitInterval >= 1, "commit_interval: must be at least 1, got %d", c.CommitInterval)
+	check(c.Dedup == migrator.DEDUP_LOCAL || c.Dedup == migrator.DEDUP_SERVER, "dedup: unknown mode %q, expected local or server", c.Dedup)
+	check(validLoader(c.Loader), "loader: unknown loader %q, expected insert or loaddata", c.Loader)
+	check(validConflict(c.OnConflict), "on_conflict: unknown policy %q, expected ignore, replace or newer", c.OnConflict)
+	check(c.Dedup != migrator.DEDUP_SERVER || c.Loader == migrator.LOADER_INSERT, "loader: dedup server needs the insert loader")
+	check(c.Loader != migrator.LOADER_LOAD_DATA || c.OnConflict != migrator.CONFLICT_NEWER, "on_conflict: newer needs the insert loader")
+	check(c.Loader != migrator.LOADER_LOAD_DATA || c.DeadLetterLimit == 0, "dead_letter_limit: needs the insert loader")
+	for key, o := range c.Tables {
+		check(key != "" && !strings.HasPrefix(key, ".") && !strings.HasSuffix(key, ".") && strings.Count(key, ".") <= 1,
+			"tables.%s: expected a key \"db\" or \"db.table\"", key)
+		check(o.BatchSize == 0 || (o.BatchSize >= migrator.MIN_BATCH_SIZE && o.BatchSize <= migrator.MAX_BATCH_SIZE),
+			"tables.%s.batch_size: must be between %d and %d, got %d", key, migrator.MIN_BATCH_SIZE, migrator.MAX_BATCH_SIZE, o.BatchSize)
+		check(o.CommitInterval >= 0, "tables.%s.commit_interval: must not be negative, got %d", key, o.CommitInterval)
+		check(o.Loader == "" || validLoader(o.Loader), "tables.%s.loader: unknown loader %q, expected insert or loaddata", key, o.Loader)
+		check(o.OnConflict == "" || validConflict(o.OnConflict), "tables.%s.on_conflict: unknown policy %q, expected ignore, replace or newer", key, o.OnConflict)
+		check(c.Dedup != migrator.DEDUP_SERVER || o.Loader != migrator.LOADER_LOAD_DATA, "tables.%s.loader: dedup server needs the insert loader", key)
+		check(c.DeadLetterLimit == 0 || o.Loader != migrator.LOADER_LOAD_DATA, "tables.%s.loader: dead_letter_limit needs the insert loader", key)
+	}
+	check(c.LockWaitTimeout >= 0, "lock_wait_timeout: must not be negative, got %d", c.LockWaitTimeout)
+	_, tzErr := migrator.SessionLocation(c.TimeZone)
+	check(tzErr == nil, "time_zone: %v", tzErr)
+	check(c.WorkDir != "", "work_dir: must not be empty")
+	_, err := logging.ParseLevel(c.LogLevel)
+	check(err == nil, "log_level: unknown level %q, expected debug, info, warn or error", c.LogLevel)
+	check(c.LogFormat == logging.FORMAT_TEXT || c.LogFormat == logging.FORMAT_JSON, "log_format: unknown format %q, expected text or json", c.LogFormat)
+	check(c.DeadLetterLimit >= 0, "dead_letter_limit: must not be negative, got %d", c.DeadLetterLimit)
+	check(c.Lint == LINT_FAIL || c.Lint == LINT_WARN || c.Lint == LINT_OFF, "lint: unknown mode %q, expected fail, warn or off", c.Lint)
+	check(c.PresortMemMB >= 0, "presort_mem_mb: must not be negative, got %d", c.PresortMemMB)
+	check(c.MaxPresortJobs >= 1, "max_presort_jobs: must be at least 1, got %d", c.MaxPresortJobs)
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.New("invalid config:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// the logger of the log_* settings, the file is opened for appending and stays open
+func (c *Config) OpenLogger() (*logging.Logger, error) {
+	level, err := logging.ParseLevel(c.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	if c.LogFile == "" {
+		return logging.New(os.Stderr, c.LogFormat, level), nil
+	}
+	f, err := os.OpenFile(c.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening log file: %w", err)
+	}
+	return logging.New(f, c.LogFormat, level), nil
+}
+
+// set the package variables of the presort from the settings, and normalize the paths
+func (c *Config) Apply() {
+	if !strings.HasSuffix(c.DataPath, "/") {
+		c.DataPath += "/"
+	}
+	if !strings.HasSuffix(c.PresortPath, "/") {
+		c.PresortPath += "/"
+	}
+
+	srcreader.PresortPath = c.PresortPath
+	srcreader.SortMergerProgram = c.SortMergerProgram
+	srcreader.PresortMemoryBudgetMB = c.PresortMemMB
+	srcreader.MaxPresortJobs = c.MaxPresortJobs
+}
+
+// the settings of a migrator.Migrator
+func (c *Config) MigratorSettings() migrator.Settings {
+	return migrator.Settings{
+		BatchSize:         c.BatchSize,
+		CommitInterval:    c.CommitInterval,
+		ConcurrentWorkers: c.ConcurrentWorkers,
+		Adaptive:          c.Adaptive,
+		RangesPerTable:    c.RangesPerTable,
+		MinRangeSize:      c.MinRangeSize,
+
+		ConcurrentTablesPerDatabase: c.ConcurrentTablesPerDatabase,
+		DatabaseConcurrencyCaps:     c.DatabaseConcurrencyCaps,
+		FailFast:                    c.FailFast,
+
+		Dedup:        c.Dedup,
+		Loader:       c.Loader,
+		OnConflict:   c.OnConflict,
+		DeferIndexes: c.DeferIndexes,
+		Interpolate:  c.Interpolate,
+		Tables:       c.Tables,
+
+		Session: migrator.SessionConfig{
+			DisableUniqueChecks:     c.DisableUniqueChecks,
+			DisableForeignKeyChecks: c.DisableForeignKeyChecks,
+			DisableBinlog:           c.DisableBinlog,
+			TimeZone:                c.TimeZone,
+			LockWaitTimeout:         c.LockWaitTimeout,
+		},
+
+		CheckpointPath:  c.CheckpointPath(),
+		DeadLetterLimit: c.DeadLetterLimit,
+		DeadLetterPath:  c.DeadLetterPath(),
+		LogBatches:      !c.SuppressLog,
+	}
+}
+
+// the effective settings as indented json, with the password masked
+func (c *Config) String() string {
+	redacted := *c
+	if redacted.DstPassword != "" {
+		redacted.DstPassword = REDACTED
+	}
+	data, err := json.MarshalIndent(&redacted, "", "  ")
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Emanatry/tdsql-migrate-go/migrator"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		errs   []string // the lines of the error, nil if valid
+	}{
+		{"defaults", func(c *Config) {}, nil},
+		{"example overrides", func(c *Config) {
+			c.Tables = map[string]migrator.TableOverride{
+				"db1":   {CommitInterval: 20},
+				"db1.4": {Loader: migrator.LOADER_LOAD_DATA},
+				"db2.1": {BatchSize: 500, OnConflict: migrator.CONFLICT_REPLACE},
+			}
+		}, nil},
+		{"empty data path", func(c *Config) { c.DataPath = "" }, []string{"data_path: must not be empty"}},
+		{"port", func(c *Config) { c.DstPort = 70000 }, []string{"dst_port: 70000 is not a valid port"}},
+		{"batch size", func(c *Config) { c.BatchSize = 0 }, []string{"batch_size: must be between"}},
+		{"commit interval", func(c *Config) { c.CommitInterval = 0 }, []string{"commit_interval: must be at least 1, got 0"}},
+		{"workers", func(c *Config) { c.ConcurrentWorkers = 0 }, []string{"concurrent_workers: must be at least 1, got 0"}},
+		{"adaptive workers", func(c *Config) { c.ConcurrentWorkers = migrator.ADAPTIVE_MAX_WORKERS + 1 }, []string{"concurrent_workers: must be at most"}},
+		{"negative cap", func(c *Config) { c.DatabaseConcurrencyCaps = map[string]int{"db1": -1} }, []string{"database_concurrency_caps.db1: must not be negative, got -1"}},
+		{"dedup", func(c *Config) { c.Dedup = "both" }, []string{`dedup: unknown mode "both"`}},
+		{"loader", func(c *Config) { c.Loader = "copy" }, []string{`loader: unknown loader "copy"`}},
+		{"conflict", func(c *Config) { c.OnConflict = "merge" }, []string{`on_conflict: unknown policy "merge"`}},
+		{"server dedup with load data", func(c *Config) {
+			c.Dedup = migrator.DEDUP_SERVER
+			c.Loader = migrator.LOADER_LOAD_DATA
+		}, []string{"loader: dedup server needs the insert loader"}},
+		{"newer with load data", func(c *Config) {
+			c.Loader = migrator.LOADER_LOAD_DATA
+			c.OnConflict = migrator.CONFLICT_NEWER
+		}, []string{"on_conflict: newer needs the insert loader"}},
+		{"table key", func(c *Config) { c.Tables = map[string]migrator.TableOverride{"db1.": {}} }, []string{`tables.db1.: expected a key "db" or "db.table"`}},
+		{"table key with two dots", func(c *Config) { c.Tables = map[string]migrator.TableOverride{"a.b.c": {}} }, []string{`tables.a.b.c: expected a key`}},
+		{"table overrides", func(c *Config) {
+			c.Tables = map[string]migrator.TableOverride{"db1.4": {BatchSize: 1, CommitInterval: -1, Loader: "copy", OnConflict: "merge"}}
+		}, []string{
+			"tables.db1.4.batch_size: must be between",
+			"tables.db1.4.commit_interval: must not be negative, got -1",
+			`tables.db1.4.loader: unknown loader "copy"`,
+			`tables.db1.4.on_conflict: unknown policy "merge"`,
+		}},
+		{"table load data with server dedup", func(c *Config) {
+			c.Dedup = migrator.DEDUP_SERVER
+			c.Tables = map[string]migrator.TableOverride{"db1": {Loader: migrator.LOADER_LOAD_DATA}}
+		}, []string{"tables.db1.loader: dedup server needs the insert loader"}},
+		{"log level", func(c *Config) { c.LogLevel = "trace" }, []string{`log_level: unknown level "trace"`}},
+		{"log format", func(c *Config) { c.LogFormat = "xml" }, []string{`log_format: unknown format "xml"`}},
+		{"dead letter limit", func(c *Config) { c.DeadLetterLimit = -1 }, []string{"dead_letter_limit: must not be negative, got -1"}},
+		{"dead letters with load data", func(c *Config) {
+			c.DeadLetterLimit = 10
+			c.Loader = migrator.LOADER_LOAD_DATA
+		}, []string{"dead_letter_limit: needs the insert loader"}},
+		{"dead letters with a load data table", func(c *Config) {
+			c.DeadLetterLimit = 10
+			c.Tables = map[string]migrator.TableOverride{"db1.4": {Loader: migrator.LOADER_LOAD_DATA}}
+		}, []string{"tables.db1.4.loader: dead_letter_limit needs the insert loader"}},
+		{"lint", func(c *Config) { c.Lint = "strict" }, []string{`lint: unknown mode "strict"`}},
+		{"time zone offset", func(c *Config) { c.TimeZone = "-05:30" }, nil},
+		{"named time zone", func(c *Config) { c.TimeZone = "UTC" }, nil},
+		{"invalid time zone offset", func(c *Config) { c.TimeZone = "+8" }, []string{`time_zone: invalid time zone offset "+8", expected +hh:mm`}},
+		{"unknown time zone", func(c *Config) { c.TimeZone = "Mars/Olympus" }, []string{`time_zone: unknown time zone "Mars/Olympus"`}},
+		{"tls", func(c *Config) { c.DstTLSMode = "verify-ca" }, []string{"dst_tls_ca: required with dst_tls_mode verify-ca"}},
+		{"presort", func(c *Config) {
+			c.PresortMemMB = -1
+			c.MaxPresortJobs = 0
+		}, []string{"max_presort_jobs: must be at least 1, got 0", "presort_mem_mb: must not be negative, got -1"}},
+		{"every error at once, sorted", func(c *Config) {
+			c.WorkDir = ""
+			c.BatchSize = 0
+			c.LockWaitTimeout = -1
+		}, []string{"batch_size: must be between", "lock_wait_timeout: must not be negative, got -1", "work_dir: must not be empty"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.modify(c)
+			err := c.Validate()
+			if tt.errs == nil {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() = nil, want %q", tt.errs)
+			}
+			lines := strings.Split(err.Error(), "\n")
+			if lines[0] != "invalid config:" || len(lines)-1 != len(tt.errs) {
+				t.Fatalf("Validate() = %v, want %d error(s) %q", err, len(tt.errs), tt.errs)
+			}
+			for i, want := range tt.errs {
+				if got := strings.TrimSpace(lines[i+1]); !strings.HasPrefix(got, want) {
+					t.Errorf("error %d = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
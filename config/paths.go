@@ -0,0 +1,73 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// files shipped with the binary are looked up next to the executable first, then in the current
+// dir (go run builds the executable in a temp dir)
+func installedFile(candidates ...string) (string, bool) {
+	var dirs []string
+	if exe, err := os.Executable(); err == nil {
+		if exe, err = filepath.EvalSymlinks(exe); err == nil {
+			dirs = append(dirs, filepath.Dir(exe))
+		}
+	}
+	dirs = append(dirs, ".")
+	for _, dir := range dirs {
+		for _, name := range candidates {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); err == nil {
+				return path, true
+			}
+		}
+	}
+	return "", false
+}
+
+// label.txt written by zip_for_uploading.sh, "" if there is none
+func LabelFile() string {
+	path, _ := installedFile("label.txt")
+	return path
+}
+
+// the checkpoints of the tables
+func (c *Config) CheckpointPath() string {
+	return filepath.Join(c.WorkDir, "migration_log")
+}
+
+// the rows rejected by the target, see migrator.Settings.DeadLetterLimit
+func (c *Config) DeadLetterPath() string {
+	return filepath.Join(c.WorkDir, "dead_letter")
+}
+
+// marks a migration that was started and hasn't finished yet
+func (c *Config) InProgressFile() string {
+	return filepath.Join(c.WorkDir, "migration_inprogress.txt")
+}
+
+// fill the paths left empty from work_dir and the install dir, and create work_dir
+func (c *Config) resolvePaths() error {
+	if c.WorkDir == "" {
+		return nil // reported by Validate
+	}
+	if err := os.MkdirAll(c.WorkDir, 0755); err != nil {
+		return fmt.Errorf("failed creating work_dir: %w", err)
+	}
+	if c.PresortPath == "" {
+		c.PresortPath = filepath.Join(c.WorkDir, "presort", "data")
+	}
+	if c.SortMergerProgram == "" {
+		if path, ok := installedFile("presort/sortmerge", "sortmerge"); ok {
+			c.SortMergerProgram = path
+		} else if path, err := exec.LookPath("sortmerge"); err == nil {
+			c.SortMergerProgram = path
+		} else {
+			c.SortMergerProgram = "./presort/sortmerge" // reported by preflight, or when presorting
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePaths(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	// a sortmerge shipped in the current dir, as after unpacking the release zip
+	if err := os.MkdirAll("presort", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, "presort", "sortmerge", "#!/bin/sh\n")
+
+	tests := []struct {
+		name          string
+		modify        func(c *Config)
+		wantPresort   string
+		wantSortMerge string
+	}{
+		{"defaults", func(c *Config) { c.WorkDir = "state" },
+			filepath.Join("state", "presort", "data"), filepath.Join("presort", "sortmerge")},
+		{"nested work dir", func(c *Config) { c.WorkDir = filepath.Join(dir, "a", "b") },
+			filepath.Join(dir, "a", "b", "presort", "data"), filepath.Join("presort", "sortmerge")},
+		{"explicit paths", func(c *Config) {
+			c.WorkDir = "state"
+			c.PresortPath = "/data/presort/"
+			c.SortMergerProgram = "/opt/sortmerge"
+		}, "/data/presort/", "/opt/sortmerge"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.modify(c)
+			if err := c.resolvePaths(); err != nil {
+				t.Fatal(err)
+			}
+			if info, err := os.Stat(c.WorkDir); err != nil || !info.IsDir() {
+				t.Errorf("work_dir %s wasn't created: %v", c.WorkDir, err)
+			}
+			if c.PresortPath != tt.wantPresort || c.SortMergerProgram != tt.wantSortMerge {
+				t.Errorf("presort_path %q, sortmerger_program %q, want %q, %q", c.PresortPath, c.SortMergerProgram, tt.wantPresort, tt.wantSortMerge)
+			}
+		})
+	}
+}
+
+func TestWorkDirFlag(t *testing.T) {
+	workDir := filepath.Join(t.TempDir(), "work")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	if err := fs.Parse([]string{"-work_dir", workDir, "-sortmerger_program", "/opt/sortmerge"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := flags.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.PresortPath != filepath.Join(workDir, "presort", "data") {
+		t.Errorf("presort_path %q isn't under the work dir", c.PresortPath)
+	}
+	if got := c.InProgressFile(); got != filepath.Join(workDir, "migration_inprogress.txt") {
+		t.Errorf("in progress file %q isn't under the work dir", got)
+	}
+}
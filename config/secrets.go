@@ -0,0 +1,148 @@
+package config
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Emanatry/tdsql-migrate-go/migrator"
+	"github.com/go-sql-driver/mysql"
+)
+
+// printed in place of passwords
+const REDACTED = "******"
+
+// fill the connection settings from the other credential sources, once everything else is loaded:
+// dst_password_file, then the [client] section of dst_defaults_file for whatever is still unset.
+// dst_password itself can come from TDSQL_MIGRATE_DST_PASSWORD instead of the command line.
+func (c *Config) resolveCredentials() error {
+	if c.DstPasswordFile != "" {
+		if c.DstPassword != "" {
+			return fmt.Errorf("dst_password and dst_password_file are both set, use only one")
+		}
+		data, err := ioutil.ReadFile(c.DstPasswordFile)
+		if err != nil {
+			return fmt.Errorf("failed reading dst_password_file: %w", err)
+		}
+		c.DstPassword = strings.TrimRight(string(data), "\r\n")
+	}
+	if c.DstDefaultsFile != "" {
+		client, err := readOptionFile(c.DstDefaultsFile, "client")
+		if err != nil {
+			return fmt.Errorf("failed reading dst_defaults_file: %w", err)
+		}
+		if c.DstUser == "" {
+			c.DstUser = client["user"]
+		}
+		if c.DstPassword == "" {
+			c.DstPassword = client["password"]
+		}
+		if c.DstIP == "" {
+			c.DstIP = client["host"]
+		}
+		if c.DstPort == 0 && client["port"] != "" {
+			port, err := strconv.Atoi(client["port"])
+			if err != nil {
+				return fmt.Errorf("dst_defaults_file: invalid port %q", client["port"])
+			}
+			c.DstPort = port
+		}
+	}
+	return nil
+}
+
+// the options of a section of a mysql option file (my.cnf), "key = value" or "key" per line.
+// dashes in the keys are read as underscores, like mysql does. values may be quoted, a '#' outside
+// the quotes starts a comment.
+func readOptionFile(path string, section string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	options := map[string]string{}
+	current := ""
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' || line[0] == '!' { // comments, !include
+			continue
+		}
+		if line[0] == '[' {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("%s:%d: invalid section header", path, lineno)
+			}
+			current = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if current != section {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		key := strings.Replace(strings.TrimSpace(kv[0]), "-", "_", -1)
+		value := ""
+		if len(kv) == 2 {
+			value = optionValue(strings.TrimSpace(kv[1]))
+		}
+		options[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+func (c *Config) mysqlConfig() *mysql.Config {
+	m := mysql.NewConfig()
+	m.User = c.DstUser
+	m.Passwd = c.DstPassword
+	m.Net = "tcp"
+	m.Addr = fmt.Sprintf("%s:%d", c.DstIP, c.DstPort)
+	m.ParseTime = true
+	// the loader parses the datetimes of the csv in this location, formatting them back in the same
+	// one sends them as written
+	m.Loc = c.Location()
+	m.TLSConfig = c.tlsConfigName
+	return m
+}
+
+// the location of the loading sessions, time.Local if time_zone is invalid (see Validate)
+func (c *Config) Location() *time.Location {
+	loc, err := migrator.SessionLocation(c.TimeZone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// the value of an option: a quoted value up to its closing quote, '#' starts a comment otherwise
+func optionValue(s string) string {
+	if len(s) > 0 && (s[0] == '"' || s[0] == '\'') {
+		if end := strings.IndexByte(s[1:], s[0]); end >= 0 {
+			return s[1 : end+1]
+		}
+	}
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	return s
+}
+
+// the connector of the target. not a DSN: the driver can't parse a fixed offset location back from one
+func (c *Config) Connector() (driver.Connector, error) {
+	return mysql.NewConnector(c.mysqlConfig())
+}
+
+// the DSN with the password masked, for logging
+func (c *Config) RedactedDSN() string {
+	m := c.mysqlConfig()
+	if m.Passwd != "" {
+		m.Passwd = REDACTED
+	}
+	return m.FormatDSN()
+}
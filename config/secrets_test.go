@@ -0,0 +1,176 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// set an environment variable for the duration of the test
+func setenv(t *testing.T, key string, value string) {
+	t.Helper()
+	old, had := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if had {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadOptionFile(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "my.cnf", `# comment
+; another comment
+!includedir /etc/mysql/conf.d/
+[mysqld]
+password = wrong
+
+[client]
+user = migrator
+password = "p#ss word" # quoted, with a comment
+host=10.0.0.1 # the target
+port = 3307
+ssl-mode = 'REQUIRED'
+no-beep
+
+[mysql]
+user = other
+`)
+	got, err := readOptionFile(path, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"user":     "migrator",
+		"password": "p#ss word",
+		"host":     "10.0.0.1",
+		"port":     "3307",
+		"ssl_mode": "REQUIRED",
+		"no_beep":  "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	bad := writeFile(t, t.TempDir(), "bad.cnf", "[client\nuser = x\n")
+	if _, err := readOptionFile(bad, "client"); err == nil || !strings.Contains(err.Error(), ":1: invalid section header") {
+		t.Errorf("got %v, want an invalid section header on line 1", err)
+	}
+}
+
+func TestCredentialsPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	configFile := writeFile(t, dir, "config.json", `{"dst_password": "from-config"}`)
+	passwordFile := writeFile(t, dir, "password", "from-file\n")
+	defaultsFile := writeFile(t, dir, "my.cnf", "[client]\nuser = cnf-user\npassword = from-cnf\nhost = 10.0.0.1\nport = 3307\n")
+	badPort := writeFile(t, dir, "port.cnf", "[client]\nport = x\n")
+	tests := []struct {
+		name     string
+		env      string // TDSQL_MIGRATE_DST_PASSWORD, unset if empty
+		args     []string
+		password string
+		err      string // substring of the error, "" if none
+	}{
+		{"flag", "", []string{"-dst_password", "from-flag"}, "from-flag", ""},
+		{"env", "from-env", nil, "from-env", ""},
+		{"flag over env", "from-env", []string{"-dst_password", "from-flag"}, "from-flag", ""},
+		{"env over config file", "from-env", []string{"-config", configFile}, "from-env", ""},
+		{"config file", "", []string{"-config", configFile}, "from-config", ""},
+		{"password file without its newline", "", []string{"-dst_password_file", passwordFile}, "from-file", ""},
+		{"password file and env", "from-env", []string{"-dst_password_file", passwordFile}, "", "dst_password and dst_password_file are both set"},
+		{"password file and flag", "", []string{"-dst_password_file", passwordFile, "-dst_password", "from-flag"}, "", "dst_password and dst_password_file are both set"},
+		{"option file", "", []string{"-dst_defaults_file", defaultsFile}, "from-cnf", ""},
+		{"env over option file", "from-env", []string{"-dst_defaults_file", defaultsFile}, "from-env", ""},
+		{"password file over option file", "", []string{"-dst_defaults_file", defaultsFile, "-dst_password_file", passwordFile}, "from-file", ""},
+		{"option file with an invalid port", "", []string{"-dst_defaults_file", badPort}, "", "dst_defaults_file: invalid port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				setenv(t, ENV_PREFIX+"DST_PASSWORD", tt.env)
+			} else {
+				old, had := os.LookupEnv(ENV_PREFIX + "DST_PASSWORD")
+				os.Unsetenv(ENV_PREFIX + "DST_PASSWORD")
+				if had {
+					t.Cleanup(func() { os.Setenv(ENV_PREFIX+"DST_PASSWORD", old) })
+				}
+			}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags := RegisterFlags(fs)
+			if err := fs.Parse(append([]string{"-work_dir", t.TempDir()}, tt.args...)); err != nil {
+				t.Fatal(err)
+			}
+			c, err := flags.Load()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, want an error with %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.DstPassword != tt.password {
+				t.Errorf("password %q, want %q", c.DstPassword, tt.password)
+			}
+		})
+	}
+
+	// the option file only fills what is still unset
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	if err := fs.Parse([]string{"-work_dir", t.TempDir(), "-dst_defaults_file", defaultsFile, "-dst_user", "flag-user"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := flags.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DstUser != "flag-user" || c.DstIP != "10.0.0.1" || c.DstPort != 3307 {
+		t.Errorf("user %q host %q port %d, want flag-user 10.0.0.1 3307", c.DstUser, c.DstIP, c.DstPort)
+	}
+}
+
+func TestPasswordRedacted(t *testing.T) {
+	const password = "s3cr3t-p@ss"
+	c := Default()
+	c.DstUser = "root"
+	c.DstPassword = password
+	c.DstIP = "10.0.0.1"
+	c.DstPort = 3306
+	for name, s := range map[string]string{"String": c.String(), "RedactedDSN": c.RedactedDSN()} {
+		if strings.Contains(s, password) {
+			t.Errorf("%s shows the password: %s", name, s)
+		}
+		if !strings.Contains(s, REDACTED) {
+			t.Errorf("%s doesn't show the password is set: %s", name, s)
+		}
+	}
+	if c.DstPassword != password {
+		t.Errorf("redacting changed the config's password to %q", c.DstPassword)
+	}
+	if conn := c.mysqlConfig(); conn.Passwd != password {
+		t.Errorf("connection password %q, want the real one", conn.Passwd)
+	}
+
+	// no password, nothing to redact
+	c.DstPassword = ""
+	if strings.Contains(c.RedactedDSN(), REDACTED) || strings.Contains(c.String(), REDACTED) {
+		t.Errorf("an empty password is shown as set: %s", c.RedactedDSN())
+	}
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// tls modes of the target connection, the same as mysql's --ssl-mode
+const (
+	TLS_DISABLED        = "disabled"        // plaintext
+	TLS_PREFERRED       = "preferred"       // tls if the server supports it, without verifying its certificate
+	TLS_REQUIRED        = "required"        // tls, without verifying the server's certificate
+	TLS_VERIFY_CA       = "verify-ca"       // tls, the server's certificate must be signed by dst_tls_ca
+	TLS_VERIFY_IDENTITY = "verify-identity" // verify-ca, and the certificate must be issued for dst_ip
+)
+
+// name of the tls config registered in the driver
+const TLS_CONFIG_NAME = "tdsql-migrate"
+
+func validTLSMode(s string) bool {
+	switch s {
+	case TLS_DISABLED, TLS_PREFERRED, TLS_REQUIRED, TLS_VERIFY_CA, TLS_VERIFY_IDENTITY:
+		return true
+	}
+	return false
+}
+
+// set the DSN's tls parameter, registering a tls config in the driver when the mode needs one.
+// the driver's own "preferred" is used when there is no client certificate to present, with one
+// preferred behaves like required.
+func (c *Config) setupTLS() error {
+	switch {
+	case c.DstTLSMode == TLS_DISABLED:
+		c.tlsConfigName = "false"
+		return nil
+	case c.DstTLSMode == TLS_PREFERRED && c.DstTLSCert == "":
+		c.tlsConfigName = "preferred"
+		return nil
+	}
+
+	t, err := c.tlsConfig()
+	if err != nil {
+		return err
+	}
+	if err := mysql.RegisterTLSConfig(TLS_CONFIG_NAME, t); err != nil {
+		return fmt.Errorf("failed registering tls config: %w", err)
+	}
+	c.tlsConfigName = TLS_CONFIG_NAME
+	return nil
+}
+
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	t := &tls.Config{}
+	if c.DstTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.DstTLSCert, c.DstTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading dst_tls_cert and dst_tls_key: %w", err)
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+	var roots *x509.CertPool // nil for the system roots
+	if c.DstTLSCA != "" {
+		pem, err := ioutil.ReadFile(c.DstTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading dst_tls_ca: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no pem certificates found in dst_tls_ca %s", c.DstTLSCA)
+		}
+	}
+
+	switch c.DstTLSMode {
+	case TLS_PREFERRED, TLS_REQUIRED:
+		t.InsecureSkipVerify = true
+	case TLS_VERIFY_CA:
+		// the chain is verified by hand, without matching the host name
+		t.InsecureSkipVerify = true
+		t.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, roots)
+		}
+	case TLS_VERIFY_IDENTITY:
+		t.RootCAs = roots
+		t.ServerName = c.DstIP
+	default:
+		return nil, fmt.Errorf("dst_tls_mode: unknown mode %q", c.DstTLSMode)
+	}
+	return t, nil
+}
+
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("the server sent no certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed parsing server certificate: %w", err)
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	return err
+}
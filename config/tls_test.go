@@ -0,0 +1,208 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// a server certificate signed by the CA, issued for the ip
+func (ca *testCA) issue(t *testing.T, ip string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "tdsql"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP(ip)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// handshake with a server presenting cert, the error of the client side
+func handshake(t *testing.T, client *tls.Config, cert tls.Certificate) error {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", l.Addr().String(), client)
+	if err == nil {
+		conn.Close()
+	}
+	<-done
+	return err
+}
+
+func TestTLSConfig(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	other := newTestCA(t, "other ca")
+	dir := t.TempDir()
+	caFile := writeFile(t, dir, "ca.pem", string(ca.pem))
+	otherFile := writeFile(t, dir, "other.pem", string(other.pem))
+	notPem := writeFile(t, dir, "not.pem", "not a certificate")
+
+	valid := ca.issue(t, "10.0.0.1")
+	wrongHost := ca.issue(t, "10.0.0.2")
+	untrusted := other.issue(t, "10.0.0.1")
+	tests := []struct {
+		name    string
+		mode    string
+		ca      string
+		cert    tls.Certificate
+		wantErr bool
+	}{
+		{"verify-ca valid chain", TLS_VERIFY_CA, caFile, valid, false},
+		{"verify-ca wrong ca", TLS_VERIFY_CA, caFile, untrusted, true},
+		{"verify-ca other host", TLS_VERIFY_CA, caFile, wrongHost, false},
+		{"verify-identity valid chain", TLS_VERIFY_IDENTITY, caFile, valid, false},
+		{"verify-identity wrong ca", TLS_VERIFY_IDENTITY, otherFile, valid, true},
+		{"verify-identity other host", TLS_VERIFY_IDENTITY, caFile, wrongHost, true},
+		{"required doesn't verify", TLS_REQUIRED, "", untrusted, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			c.DstIP = "10.0.0.1"
+			c.DstTLSMode = tt.mode
+			c.DstTLSCA = tt.ca
+			client, err := c.tlsConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = handshake(t, client, tt.cert)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handshake: %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	for name, c := range map[string]*Config{
+		"unknown mode":     {DstTLSMode: "verify"},
+		"missing ca":       {DstTLSMode: TLS_VERIFY_CA, DstTLSCA: filepath.Join(dir, "missing.pem")},
+		"ca without certs": {DstTLSMode: TLS_VERIFY_CA, DstTLSCA: notPem},
+		"missing key pair": {DstTLSMode: TLS_REQUIRED, DstTLSCert: filepath.Join(dir, "cert.pem"), DstTLSKey: filepath.Join(dir, "key.pem")},
+	} {
+		if _, err := c.tlsConfig(); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	other := newTestCA(t, "other ca")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	// the host name isn't matched
+	if err := verifyChain(ca.issue(t, "10.0.0.2").Certificate, roots); err != nil {
+		t.Errorf("valid chain: %v", err)
+	}
+	if err := verifyChain(other.issue(t, "10.0.0.2").Certificate, roots); err == nil {
+		t.Error("wrong ca: no error")
+	}
+	if err := verifyChain(nil, roots); err == nil {
+		t.Error("no certificate: no error")
+	}
+	if err := verifyChain([][]byte{[]byte("garbage")}, roots); err == nil {
+		t.Error("garbage certificate: no error")
+	}
+}
+
+func TestSetupTLS(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	caFile := writeFile(t, t.TempDir(), "ca.pem", string(ca.pem))
+	tests := []struct {
+		mode string
+		ca   string
+		want string // the DSN's tls parameter, "" if rejected
+	}{
+		{TLS_DISABLED, "", "false"},
+		{TLS_PREFERRED, "", "preferred"},
+		{TLS_REQUIRED, "", TLS_CONFIG_NAME},
+		{TLS_VERIFY_CA, caFile, TLS_CONFIG_NAME},
+		{TLS_VERIFY_IDENTITY, caFile, TLS_CONFIG_NAME},
+		{"verify-full", "", ""},
+	}
+	for _, tt := range tests {
+		c := Default()
+		c.DstIP = "10.0.0.1"
+		c.DstTLSMode = tt.mode
+		c.DstTLSCA = tt.ca
+		err := c.setupTLS()
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: no error", tt.mode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.mode, err)
+		} else if c.tlsConfigName != tt.want {
+			t.Errorf("%s: tls=%s, want %s", tt.mode, c.tlsConfigName, tt.want)
+		}
+	}
+}
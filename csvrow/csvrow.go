@@ -0,0 +1,429 @@
+// rows of the merged csv converted for a multi-row INSERT.
+// fields are split in place over the line, converted into typed column buffers reused from batch
+// to batch, and the INSERT arguments are pointers into those buffers, set up once, so parsing a
+// line doesn't allocate. an Exec still boxes every value: database/sql hands each pointer to the
+// driver's converter, which dereferences it into a new interface (see BenchmarkExecArgs).
+// AppendValues formats the rows as SQL literals instead, without going through the arguments.
+package csvrow
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// how a column's csv text is sent to the target
+type Kind int
+
+const (
+	KindBytes    Kind = iota // raw text, converted by the server (char, varchar, decimal...)
+	KindInt                  // signed integers
+	KindUint                 // unsigned integers
+	KindFloat                // float and double, always parsed as 64-bit
+	KindDatetime             // datetime, timestamp and date
+)
+
+func (k Kind) String() string {
+	return [...]string{"bytes", "int", "uint", "float", "datetime"}[k]
+}
+
+// the kind of a column from DATA_TYPE and COLUMN_TYPE of information_schema.COLUMNS
+func KindOf(dataType string, columnType string) Kind {
+	switch strings.ToLower(dataType) {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint":
+		if strings.Contains(strings.ToLower(columnType), "unsigned") {
+			return KindUint
+		}
+		return KindInt
+	case "float", "double", "real":
+		return KindFloat
+	case "datetime", "timestamp", "date":
+		return KindDatetime
+	}
+	// decimal is kept as text so that it isn't rounded through a float
+	return KindBytes
+}
+
+const DATETIME_LAYOUT = "2006-01-02 15:04:05"
+const DATE_LAYOUT = "2006-01-02"
+
+type column struct {
+	kind   Kind
+	bytes  [][]byte
+	ints   []int64
+	uints  []uint64
+	floats []float64
+	times  []time.Time
+}
+
+// a batch of converted rows, reused with Reset.
+// the arguments are only valid until the next Reset.
+type Batch struct {
+	cols  []column
+	args  []interface{}
+	rows  int
+	arena []byte // backing store of the bytes columns
+	loc   *time.Location
+}
+
+func NewBatch(kinds []Kind, loc *time.Location) *Batch {
+	b := &Batch{cols: make([]column, len(kinds)), loc: loc}
+	for i, kind := range kinds {
+		b.cols[i].kind = kind
+	}
+	return b
+}
+
+func (b *Batch) Reset() {
+	b.rows = 0
+	b.arena = b.arena[:0]
+}
+
+func (b *Batch) Rows() int {
+	return b.rows
+}
+
+// the INSERT arguments of the rows so far, row by row
+func (b *Batch) Args() []interface{} {
+	return b.args[:b.rows*len(b.cols)]
+}
+
+// make room for one more row. the column buffers and the argument pointers into them only grow,
+// when they do all the pointers are set again.
+func (b *Batch) grow() {
+	if b.rows < len(b.args)/len(b.cols) {
+		return
+	}
+	capacity := 2 * b.rows
+	if capacity < 64 {
+		capacity = 64
+	}
+	ncols := len(b.cols)
+	b.args = make([]interface{}, capacity*ncols)
+	for i := range b.cols {
+		c := &b.cols[i]
+		switch c.kind {
+		case KindBytes:
+			c.bytes = append(c.bytes, make([][]byte, capacity-len(c.bytes))...)
+		case KindInt:
+			c.ints = append(c.ints, make([]int64, capacity-len(c.ints))...)
+		case KindUint:
+			c.uints = append(c.uints, make([]uint64, capacity-len(c.uints))...)
+		case KindFloat:
+			c.floats = append(c.floats, make([]float64, capacity-len(c.floats))...)
+		case KindDatetime:
+			c.times = append(c.times, make([]time.Time, capacity-len(c.times))...)
+		}
+		for row := 0; row < capacity; row++ {
+			var arg interface{}
+			switch c.kind {
+			case KindBytes:
+				arg = &c.bytes[row]
+			case KindInt:
+				arg = &c.ints[row]
+			case KindUint:
+				arg = &c.uints[row]
+			case KindFloat:
+				arg = &c.floats[row]
+			case KindDatetime:
+				arg = &c.times[row]
+			}
+			b.args[row*ncols+i] = arg
+		}
+	}
+}
+
+// a field that failed to convert, Field is 0-based
+type FieldError struct {
+	Field int
+	Value string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("failed converting input data [%s]: %s", e.Value, e.Err.Error())
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// a line with the wrong number of fields
+type FieldCountError struct {
+	Expected int
+	Got      int
+}
+
+func (e *FieldCountError) Error() string {
+	return fmt.Sprintf("expected %d fields, got %d", e.Expected, e.Got)
+}
+
+var errSyntax = errors.New("invalid syntax")
+var errRange = errors.New("value out of range")
+var errSkippedTime = errors.New("doesn't exist in the time zone, its clocks skip it")
+
+// split one csv line and convert its fields into a new row. the line can be reused afterwards,
+// bytes fields are copied into the batch. on error the row isn't added.
+func (b *Batch) AppendLine(line []byte) error {
+	b.grow()
+	line = trimSpace(line)
+	ncols := len(b.cols)
+	arenaStart := len(b.arena)
+	field := 0
+	for start := 0; ; field++ {
+		end := start
+		for end < len(line) && line[end] != ',' {
+			end++
+		}
+		if field < ncols {
+			if err := b.setField(field, line[start:end]); err != nil {
+				b.arena = b.arena[:arenaStart]
+				return &FieldError{Field: field, Value: string(line[start:end]), Err: err}
+			}
+		}
+		if end == len(line) {
+			break
+		}
+		start = end + 1
+	}
+	if field+1 != ncols {
+		b.arena = b.arena[:arenaStart]
+		return &FieldCountError{Expected: ncols, Got: field + 1}
+	}
+	b.rows++
+	return nil
+}
+
+func (b *Batch) setField(i int, f []byte) error {
+	c := &b.cols[i]
+	row := b.rows
+	var err error
+	switch c.kind {
+	case KindBytes:
+		start := len(b.arena)
+		b.arena = append(b.arena, f...)
+		c.bytes[row] = b.arena[start:len(b.arena):len(b.arena)]
+	case KindInt:
+		c.ints[row], err = parseInt(f)
+	case KindUint:
+		c.uints[row], err = parseUint(f)
+	case KindFloat:
+		c.floats[row], err = parseFloat(f)
+	case KindDatetime:
+		c.times[row], err = parseDatetime(f, b.loc)
+	}
+	return err
+}
+
+// the error converting a field into a column of the kind, nil if AppendLine would accept it
+func CheckField(kind Kind, f []byte, loc *time.Location) error {
+	var err error
+	switch kind {
+	case KindInt:
+		_, err = parseInt(f)
+	case KindUint:
+		_, err = parseUint(f)
+	case KindFloat:
+		_, err = parseFloat(f)
+	case KindDatetime:
+		_, err = parseDatetime(f, loc)
+	}
+	return err
+}
+
+func trimSpace(s []byte) []byte {
+	for len(s) > 0 && (s[len(s)-1] == '\n' || s[len(s)-1] == '\r' || s[len(s)-1] == ' ' || s[len(s)-1] == '\t') {
+		s = s[:len(s)-1]
+	}
+	for len(s) > 0 && (s[0] == ' ' || s[0] == '\t') {
+		s = s[1:]
+	}
+	return s
+}
+
+// a string sharing the memory of b, only for calls that don't keep it
+func unsafeString(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
+
+// decimal syntax only: strconv also takes NaN, Inf and hex floats, which can't be sent as literals
+func parseFloat(f []byte) (float64, error) {
+	if len(f) == 0 {
+		return 0, errSyntax
+	}
+	for _, c := range f {
+		if !(c >= '0' && c <= '9' || c == '.' || c == 'e' || c == 'E' || c == '+' || c == '-') {
+			return 0, errSyntax
+		}
+	}
+	// the NumError would keep a reference to f
+	v, err := strconv.ParseFloat(unsafeString(f), 64)
+	switch {
+	case math.IsInf(v, 0):
+		return 0, errRange
+	case err != nil && !errors.Is(err, strconv.ErrRange): // underflows are rounded to 0 like the server does
+		return 0, errSyntax
+	}
+	return v, nil
+}
+
+func parseUint(f []byte) (uint64, error) {
+	if len(f) == 0 {
+		return 0, errSyntax
+	}
+	var n uint64
+	for _, c := range f {
+		if c < '0' || c > '9' {
+			return 0, errSyntax
+		}
+		d := uint64(c - '0')
+		if n > (1<<64-1-d)/10 {
+			return 0, errRange
+		}
+		n = n*10 + d
+	}
+	return n, nil
+}
+
+func parseInt(f []byte) (int64, error) {
+	neg := len(f) > 0 && f[0] == '-'
+	if neg || (len(f) > 0 && f[0] == '+') {
+		f = f[1:]
+	}
+	n, err := parseUint(f)
+	if err != nil {
+		return 0, err
+	}
+	if neg {
+		if n > 1<<63 {
+			return 0, errRange
+		}
+		return -int64(n), nil
+	}
+	if n > 1<<63-1 {
+		return 0, errRange
+	}
+	return int64(n), nil
+}
+
+// "2006-01-02 15:04:05" is parsed by hand, anything else goes through time.ParseInLocation.
+// a time skipped by the clocks of loc is rejected, rather than moved by the hour it would be sent as.
+func parseDatetime(f []byte, loc *time.Location) (time.Time, error) {
+	if len(f) == len(DATETIME_LAYOUT) && f[4] == '-' && f[7] == '-' && f[10] == ' ' && f[13] == ':' && f[16] == ':' {
+		year, ok1 := digits(f[0:4])
+		month, ok2 := digits(f[5:7])
+		day, ok3 := digits(f[8:10])
+		hour, ok4 := digits(f[11:13])
+		min, ok5 := digits(f[14:16])
+		sec, ok6 := digits(f[17:19])
+		if ok1 && ok2 && ok3 && ok4 && ok5 && ok6 && month >= 1 && month <= 12 && day >= 1 && day <= 31 && hour < 24 && min < 60 && sec < 60 {
+			t := time.Date(year, time.Month(month), day, hour, min, sec, 0, loc)
+			if t.Day() == day { // not normalized from e.g. Feb 30
+				if t.Hour() != hour || t.Minute() != min {
+					return time.Time{}, errSkippedTime
+				}
+				return t, nil
+			}
+		}
+	}
+	layout := DATETIME_LAYOUT
+	if len(f) == len(DATE_LAYOUT) {
+		layout = DATE_LAYOUT
+	}
+	t, err := time.ParseInLocation(layout, string(f), loc)
+	if err != nil {
+		return time.Time{}, errSyntax
+	}
+	if wall, _ := time.Parse(layout, string(f)); wall.Hour() != t.Hour() || wall.Minute() != t.Minute() {
+		return time.Time{}, errSkippedTime
+	}
+	return t, nil
+}
+
+func digits(f []byte) (int, bool) {
+	n := 0
+	for _, c := range f {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, true
+}
+
+// append the rows as SQL literals "(v1,v2...),(...)" for an INSERT without placeholders.
+// strings are quoted and escaped according to the session's NO_BACKSLASH_ESCAPES sql_mode.
+func (b *Batch) AppendValues(dst []byte, noBackslashEscapes bool) []byte {
+	return b.AppendValuesRange(dst, 0, b.rows, noBackslashEscapes)
+}
+
+// same as AppendValues for the rows [from, to) only
+func (b *Batch) AppendValuesRange(dst []byte, from int, to int, noBackslashEscapes bool) []byte {
+	for row := from; row < to; row++ {
+		if row > from {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, '(')
+		for i := range b.cols {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			c := &b.cols[i]
+			switch c.kind {
+			case KindBytes:
+				dst = appendQuoted(dst, c.bytes[row], noBackslashEscapes)
+			case KindInt:
+				dst = strconv.AppendInt(dst, c.ints[row], 10)
+			case KindUint:
+				dst = strconv.AppendUint(dst, c.uints[row], 10)
+			case KindFloat:
+				// shortest representation that parses back to the same float64, like the binary protocol sends
+				dst = strconv.AppendFloat(dst, c.floats[row], 'g', -1, 64)
+			case KindDatetime:
+				dst = append(dst, '\'')
+				dst = c.times[row].In(b.loc).AppendFormat(dst, DATETIME_LAYOUT)
+				dst = append(dst, '\'')
+			}
+		}
+		dst = append(dst, ')')
+	}
+	return dst
+}
+
+// same escaping as the driver's interpolateParams
+func appendQuoted(dst []byte, v []byte, noBackslashEscapes bool) []byte {
+	dst = append(dst, '\'')
+	for _, c := range v {
+		if noBackslashEscapes {
+			if c == '\'' {
+				dst = append(dst, '\'', '\'')
+			} else {
+				dst = append(dst, c)
+			}
+			continue
+		}
+		switch c {
+		case 0:
+			dst = append(dst, '\\', '0')
+		case '\n':
+			dst = append(dst, '\\', 'n')
+		case '\r':
+			dst = append(dst, '\\', 'r')
+		case '\x1a':
+			dst = append(dst, '\\', 'Z')
+		case '\'':
+			dst = append(dst, '\\', '\'')
+		case '"':
+			dst = append(dst, '\\', '"')
+		case '\\':
+			dst = append(dst, '\\', '\\')
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return append(dst, '\'')
+}
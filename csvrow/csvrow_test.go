@@ -0,0 +1,515 @@
+package csvrow
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestParseInt(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		err  error
+	}{
+		{"0", 0, nil},
+		{"42", 42, nil},
+		{"+42", 42, nil},
+		{"-42", -42, nil},
+		{"-0", 0, nil},
+		{"007", 7, nil},
+		{"9223372036854775807", 1<<63 - 1, nil},
+		{"+9223372036854775807", 1<<63 - 1, nil},
+		{"-9223372036854775808", -1 << 63, nil},
+		{"9223372036854775808", 0, errRange},
+		{"-9223372036854775809", 0, errRange},
+		{"18446744073709551615", 0, errRange},
+		{"18446744073709551616", 0, errRange},
+		{"99999999999999999999999", 0, errRange},
+		{"", 0, errSyntax},
+		{"+", 0, errSyntax},
+		{"-", 0, errSyntax},
+		{"--1", 0, errSyntax},
+		{"+-1", 0, errSyntax},
+		{"1-", 0, errSyntax},
+		{" 1", 0, errSyntax},
+		{"1.0", 0, errSyntax},
+		{"1e3", 0, errSyntax},
+		{"0x10", 0, errSyntax},
+	}
+	for _, tt := range tests {
+		got, err := parseInt([]byte(tt.in))
+		if got != tt.want || err != tt.err {
+			t.Errorf("parseInt(%q) = %d, %v, want %d, %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestParseUint(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint64
+		err  error
+	}{
+		{"0", 0, nil},
+		{"42", 42, nil},
+		{"9223372036854775808", 1 << 63, nil},
+		{"18446744073709551615", 1<<64 - 1, nil},
+		{"18446744073709551616", 0, errRange},
+		{"18446744073709551620", 0, errRange},
+		{"100000000000000000000", 0, errRange},
+		{"", 0, errSyntax},
+		{"+1", 0, errSyntax},
+		{"-1", 0, errSyntax},
+		{"-0", 0, errSyntax},
+		{"1 ", 0, errSyntax},
+	}
+	for _, tt := range tests {
+		got, err := parseUint([]byte(tt.in))
+		if got != tt.want || err != tt.err {
+			t.Errorf("parseUint(%q) = %d, %v, want %d, %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestParseFloat(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		err  error
+	}{
+		{"0", 0, nil},
+		{"-3.5", -3.5, nil},
+		{"+1e3", 1000, nil},
+		{".5", 0.5, nil},
+		{"1E-2", 0.01, nil},
+		{"1e-400", 0, nil}, // underflow, the server rounds it to 0 too
+		{"1e400", 0, errRange},
+		{"-1e400", 0, errRange},
+		{"", 0, errSyntax},
+		{"1.5.1", 0, errSyntax},
+		// accepted by strconv, but they'd be sent as bare identifiers
+		{"NaN", 0, errSyntax},
+		{"nan", 0, errSyntax},
+		{"Inf", 0, errSyntax},
+		{"+Inf", 0, errSyntax},
+		{"-Infinity", 0, errSyntax},
+		{"0x1p-2", 0, errSyntax},
+		{"1_000", 0, errSyntax},
+	}
+	for _, tt := range tests {
+		got, err := parseFloat([]byte(tt.in))
+		if got != tt.want || err != tt.err {
+			t.Errorf("parseFloat(%q) = %v, %v, want %v, %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestParseDatetime(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	tests := []struct {
+		in   string
+		want time.Time
+		err  error
+	}{
+		{"2021-12-12 08:30:59", time.Date(2021, 12, 12, 8, 30, 59, 0, loc), nil},
+		{"2024-02-29 23:59:59", time.Date(2024, 2, 29, 23, 59, 59, 0, loc), nil},
+		{"0001-01-01 00:00:00", time.Date(1, 1, 1, 0, 0, 0, 0, loc), nil},
+		{"9999-12-31 23:59:59", time.Date(9999, 12, 31, 23, 59, 59, 0, loc), nil},
+		// not the fast path but time.ParseInLocation, accepted by mysql as well
+		{"2023-01-01 0:00:00", time.Date(2023, 1, 1, 0, 0, 0, 0, loc), nil},
+		{"2023-01-01 00:00:00.5", time.Date(2023, 1, 1, 0, 0, 0, 5e8, loc), nil},
+		// the date only layout
+		{"2021-12-12", time.Date(2021, 12, 12, 0, 0, 0, 0, loc), nil},
+		{"2024-02-29", time.Date(2024, 2, 29, 0, 0, 0, 0, loc), nil},
+		// dates that don't exist, rather than normalized into the next month
+		{"2023-02-30 00:00:00", time.Time{}, errSyntax},
+		{"2023-02-29 00:00:00", time.Time{}, errSyntax},
+		{"2023-04-31 12:00:00", time.Time{}, errSyntax},
+		{"2023-02-30", time.Time{}, errSyntax},
+		{"2023-02-29", time.Time{}, errSyntax},
+		{"2023-00-10 00:00:00", time.Time{}, errSyntax},
+		{"2023-13-01 00:00:00", time.Time{}, errSyntax},
+		{"2023-01-00 00:00:00", time.Time{}, errSyntax},
+		{"2023-01-01 24:00:00", time.Time{}, errSyntax},
+		{"2023-01-01 00:60:00", time.Time{}, errSyntax},
+		{"2023-01-01 00:00:60", time.Time{}, errSyntax},
+		{"2023-13-01", time.Time{}, errSyntax},
+		{"2023-01-01T00:00:00", time.Time{}, errSyntax},
+		{"2023/01/01 00:00:00", time.Time{}, errSyntax},
+		{"20230101", time.Time{}, errSyntax},
+		{"", time.Time{}, errSyntax},
+	}
+	for _, tt := range tests {
+		got, err := parseDatetime([]byte(tt.in), loc)
+		if !got.Equal(tt.want) || err != tt.err {
+			t.Errorf("parseDatetime(%q) = %v, %v, want %v, %v", tt.in, got, err, tt.want, tt.err)
+		}
+		if err == nil && got.Location() != loc {
+			t.Errorf("parseDatetime(%q) is in %v, want %v", tt.in, got.Location(), loc)
+		}
+	}
+}
+
+func TestParseDatetimeSkipped(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		in   string
+		want time.Time
+		err  error
+	}{
+		{"2021-03-28 01:59:59", time.Date(2021, 3, 28, 1, 59, 59, 0, berlin), nil},
+		{"2021-03-28 03:00:00", time.Date(2021, 3, 28, 3, 0, 0, 0, berlin), nil},
+		// the clocks go from 02:00 to 03:00
+		{"2021-03-28 02:00:00", time.Time{}, errSkippedTime},
+		{"2021-03-28 02:30:00", time.Time{}, errSkippedTime},
+		{"2021-03-28 2:30:00", time.Time{}, errSkippedTime},
+		// and from 03:00 back to 02:00, the time exists twice
+		{"2021-10-31 02:30:00", time.Date(2021, 10, 31, 2, 30, 0, 0, berlin), nil},
+	}
+	for _, tt := range tests {
+		got, err := parseDatetime([]byte(tt.in), berlin)
+		if !got.Equal(tt.want) || err != tt.err {
+			t.Errorf("parseDatetime(%q) = %v, %v, want %v, %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+// the values of the row as the INSERT arguments point to them
+func argValues(b *Batch, row int) []interface{} {
+	ncols := len(b.cols)
+	var values []interface{}
+	for _, arg := range b.Args()[row*ncols : (row+1)*ncols] {
+		switch v := arg.(type) {
+		case *[]byte:
+			values = append(values, string(*v))
+		case *int64:
+			values = append(values, *v)
+		case *uint64:
+			values = append(values, *v)
+		case *float64:
+			values = append(values, *v)
+		case *time.Time:
+			values = append(values, v.Format(DATETIME_LAYOUT))
+		}
+	}
+	return values
+}
+
+func TestAppendLine(t *testing.T) {
+	kinds := []Kind{KindInt, KindUint, KindFloat, KindBytes, KindDatetime}
+	tests := []struct {
+		name  string
+		line  string
+		want  []interface{}
+		field int // field of the FieldError, -1 for none
+		count *FieldCountError
+	}{
+		{"plain", "1,2,3.5,abc,2021-12-12 00:00:01\n", []interface{}{int64(1), uint64(2), 3.5, "abc", "2021-12-12 00:00:01"}, -1, nil},
+		{"crlf and spaces around the line", "  -1,2,-3.5,abc,2021-12-12\r\n", []interface{}{int64(-1), uint64(2), -3.5, "abc", "2021-12-12 00:00:00"}, -1, nil},
+		{"signs", "+7,0,+1e3,,2021-12-12 00:00:01", []interface{}{int64(7), uint64(0), 1000.0, "", "2021-12-12 00:00:01"}, -1, nil},
+		{"int64 limits", "-9223372036854775808,18446744073709551615,0,x,2021-12-12", []interface{}{int64(-1 << 63), uint64(1<<64 - 1), 0.0, "x", "2021-12-12 00:00:00"}, -1, nil},
+		{"empty bytes field", "1,2,3,,2021-12-12", []interface{}{int64(1), uint64(2), 3.0, "", "2021-12-12 00:00:00"}, -1, nil},
+		{"spaces inside fields are kept", "1,2,3, a b ,2021-12-12", []interface{}{int64(1), uint64(2), 3.0, " a b ", "2021-12-12 00:00:00"}, -1, nil},
+		{"empty int", ",2,3,x,2021-12-12", nil, 0, nil},
+		{"empty uint", "1,,3,x,2021-12-12", nil, 1, nil},
+		{"empty float", "1,2,,x,2021-12-12", nil, 2, nil},
+		{"empty datetime", "1,2,3,x,", nil, 4, nil},
+		{"int overflow", "9223372036854775808,2,3,x,2021-12-12", nil, 0, nil},
+		{"negative uint", "1,-2,3,x,2021-12-12", nil, 1, nil},
+		{"bad float", "1,2,3.5.1,x,2021-12-12", nil, 2, nil},
+		{"nan", "1,2,NaN,x,2021-12-12", nil, 2, nil},
+		{"infinity", "1,2,+Inf,x,2021-12-12", nil, 2, nil},
+		{"hex float", "1,2,0x1p3,x,2021-12-12", nil, 2, nil},
+		{"february 30", "1,2,3,x,2023-02-30 00:00:00", nil, 4, nil},
+		{"too few fields", "1,2,3,abc", nil, -1, &FieldCountError{Expected: 5, Got: 4}},
+		{"too many fields", "1,2,3,abc,2021-12-12,extra", nil, -1, &FieldCountError{Expected: 5, Got: 6}},
+		{"trailing comma", "1,2,3,abc,2021-12-12,", nil, -1, &FieldCountError{Expected: 5, Got: 6}},
+		{"empty line", "", nil, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBatch(kinds, time.UTC)
+			// a row before, whose bytes have to survive a rejected line
+			if err := b.AppendLine([]byte("0,0,0,first,2000-01-01 00:00:00")); err != nil {
+				t.Fatal(err)
+			}
+			arena := len(b.arena)
+
+			line := []byte(tt.line)
+			err := b.AppendLine(line)
+			var fieldErr *FieldError
+			var countErr *FieldCountError
+			switch {
+			case tt.count != nil:
+				if !errors.As(err, &countErr) || *countErr != *tt.count {
+					t.Fatalf("AppendLine(%q) = %v, want %v", tt.line, err, tt.count)
+				}
+			case tt.field >= 0:
+				if !errors.As(err, &fieldErr) || fieldErr.Field != tt.field {
+					t.Fatalf("AppendLine(%q) = %v, want a FieldError of field %d", tt.line, err, tt.field)
+				}
+			case err != nil:
+				t.Fatalf("AppendLine(%q) = %v", tt.line, err)
+			}
+
+			if err != nil {
+				// the row isn't added and the bytes it copied are rolled back
+				if b.Rows() != 1 || len(b.Args()) != len(kinds) {
+					t.Fatalf("%d rows after a rejected line, want 1", b.Rows())
+				}
+				if len(b.arena) != arena {
+					t.Fatalf("arena of %d bytes after a rejected line, want %d", len(b.arena), arena)
+				}
+				if err := b.AppendLine([]byte("9,9,9,next,2000-01-01 00:00:00")); err != nil {
+					t.Fatal(err)
+				}
+				tt.want = []interface{}{int64(9), uint64(9), 9.0, "next", "2000-01-01 00:00:00"}
+			}
+			// the line can be reused once converted
+			for i := range line {
+				line[i] = 'X'
+			}
+			if got := argValues(b, 0); got[3] != "first" {
+				t.Errorf("first row = %v, its bytes were overwritten", got)
+			}
+			got := argValues(b, 1)
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Fatalf("row = %#v, want %#v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchReuse(t *testing.T) {
+	b := NewBatch([]Kind{KindInt, KindBytes}, time.UTC)
+	for round := 0; round < 3; round++ {
+		b.Reset()
+		for i := 0; i < 200; i++ { // more than the first capacity, the arguments are set up again
+			if err := b.AppendLine([]byte("7,row")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if b.Rows() != 200 || len(b.Args()) != 400 {
+			t.Fatalf("round %d: %d rows, %d args", round, b.Rows(), len(b.Args()))
+		}
+		for row := 0; row < b.Rows(); row++ {
+			if got := argValues(b, row); got[0] != int64(7) || got[1] != "row" {
+				t.Fatalf("round %d row %d = %v", round, row, got)
+			}
+		}
+	}
+}
+
+func TestCheckField(t *testing.T) {
+	tests := []struct {
+		kind Kind
+		in   string
+		ok   bool
+	}{
+		{KindBytes, "", true},
+		{KindBytes, "anything, really", true},
+		{KindInt, "-9223372036854775808", true},
+		{KindInt, "9223372036854775808", false},
+		{KindUint, "18446744073709551615", true},
+		{KindUint, "-1", false},
+		{KindFloat, "1.5e10", true},
+		{KindFloat, "", false},
+		{KindFloat, "NaN", false},
+		{KindFloat, "-Inf", false},
+		{KindFloat, "0x10", false},
+		{KindDatetime, "2021-12-12", true},
+		{KindDatetime, "2023-02-30", false},
+	}
+	for _, tt := range tests {
+		if err := CheckField(tt.kind, []byte(tt.in), time.UTC); (err == nil) != tt.ok {
+			t.Errorf("CheckField(%v, %q) = %v, want ok %v", tt.kind, tt.in, err, tt.ok)
+		}
+	}
+}
+
+func BenchmarkAppendLine(b *testing.B) {
+	batch := NewBatch([]Kind{KindUint, KindFloat, KindBytes, KindDatetime}, time.UTC)
+	line := []byte("123456,-512.25,0123456789abcdef0123456789abcdef,2021-12-12 08:30:59\n")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if i%2000 == 0 {
+			batch.Reset()
+		}
+		if err := batch.AppendLine(line); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// AppendLine followed by what an Exec does to the arguments: database/sql hands every one of them to
+// the driver's converter, which dereferences the pointer and boxes the value into a new interface
+func BenchmarkExecArgs(b *testing.B) {
+	batch := NewBatch([]Kind{KindUint, KindFloat, KindBytes, KindDatetime}, time.UTC)
+	line := []byte("123456,-512.25,0123456789abcdef0123456789abcdef,2021-12-12 08:30:59\n")
+	values := make([]driver.Value, 4)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if i%2000 == 0 {
+			batch.Reset()
+		}
+		if err := batch.AppendLine(line); err != nil {
+			b.Fatal(err)
+		}
+		row := batch.Rows() - 1
+		for j, arg := range batch.Args()[row*4 : row*4+4] {
+			v, err := driver.DefaultParameterConverter.ConvertValue(arg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			values[j] = v
+		}
+	}
+}
+
+// a mysql server just good enough for the driver to connect and run queries, answering every one of
+// them with an OK packet. the queries it got are sent to queries.
+func fakeMySQLServer(conn net.Conn, status uint16, queries chan<- string) {
+	defer conn.Close()
+	write := func(seq byte, payload []byte) error {
+		header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq}
+		_, err := conn.Write(append(header, payload...))
+		return err
+	}
+	read := func() ([]byte, error) {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+		_, err := io.ReadFull(conn, payload)
+		return payload, err
+	}
+	ok := []byte{0x00, 0, 0, byte(status), byte(status >> 8), 0, 0}
+
+	// protocol 10 handshake: version, connection id, scramble, capabilities (protocol 4.1, secure
+	// connection, plugin auth), charset, status, auth plugin
+	var handshake bytes.Buffer
+	handshake.WriteByte(10)
+	handshake.WriteString("5.7.0-fake\x00")
+	handshake.Write([]byte{1, 0, 0, 0})
+	handshake.WriteString("12345678\x00")
+	binary.Write(&handshake, binary.LittleEndian, uint16(0x8200))
+	handshake.WriteByte(33)
+	binary.Write(&handshake, binary.LittleEndian, status)
+	binary.Write(&handshake, binary.LittleEndian, uint16(0x0008))
+	handshake.WriteByte(21)
+	handshake.Write(make([]byte, 10))
+	handshake.WriteString("123456789012\x00")
+	handshake.WriteString("mysql_native_password\x00")
+	if write(0, handshake.Bytes()) != nil {
+		return
+	}
+	if _, err := read(); err != nil { // the handshake response
+		return
+	}
+	if write(2, ok) != nil {
+		return
+	}
+	for {
+		cmd, err := read()
+		if err != nil || len(cmd) == 0 || cmd[0] == 0x01 { // COM_QUIT
+			return
+		}
+		if cmd[0] == 0x03 { // COM_QUERY
+			queries <- string(cmd[1:])
+		}
+		if write(1, ok) != nil {
+			return
+		}
+	}
+}
+
+// the text the driver sends for "SELECT ?" with the string v, with interpolateParams
+func driverInterpolate(t *testing.T, noBackslashEscapes bool, values []string) []string {
+	t.Helper()
+	var status uint16
+	if noBackslashEscapes {
+		status = 0x0200 // SERVER_STATUS_NO_BACKSLASH_ESCAPES
+	}
+	netName := "csvrow-fake-" + strconv.FormatBool(noBackslashEscapes)
+	queries := make(chan string, 1)
+	var wg sync.WaitGroup
+	mysql.RegisterDialContext(netName, func(ctx context.Context, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fakeMySQLServer(server, status, queries)
+		}()
+		return client, nil
+	})
+	cfg := mysql.NewConfig()
+	cfg.Net = netName
+	cfg.Addr = "fake"
+	cfg.User = "root"
+	cfg.InterpolateParams = true
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(1)
+	defer wg.Wait()
+	defer db.Close()
+
+	var sent []string
+	for _, v := range values {
+		if _, err := db.Exec("SELECT ?", v); err != nil {
+			t.Fatalf("exec through the fake server: %v", err)
+		}
+		sent = append(sent, <-queries)
+	}
+	return sent
+}
+
+func TestAppendQuotedMatchesDriver(t *testing.T) {
+	values := []string{
+		"",
+		"plain text",
+		"\x00", "\n", "\r", "\x1a", "'", "\"", "\\",
+		"a\x00b\nc\rd\x1ae'f\"g\\h",
+		"''", "\\'", "\\\\", "'; DROP TABLE t; --",
+		"\\' OR 1=1 -- ",
+		"中文,逗号",
+	}
+	var all []byte
+	for c := 0; c < 256; c++ {
+		all = append(all, byte(c))
+	}
+	values = append(values, string(all))
+
+	for _, noBackslashEscapes := range []bool{false, true} {
+		t.Run("noBackslashEscapes="+strconv.FormatBool(noBackslashEscapes), func(t *testing.T) {
+			sent := driverInterpolate(t, noBackslashEscapes, values)
+			for i, v := range values {
+				want := sent[i][len("SELECT "):]
+				got := string(appendQuoted(nil, []byte(v), noBackslashEscapes))
+				if got != want {
+					t.Errorf("appendQuoted(%q) = %q, the driver sends %q", v, got, want)
+				}
+			}
+		})
+	}
+}
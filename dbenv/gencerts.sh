@@ -0,0 +1,17 @@
+#!/bin/sh
+# self-signed CA, server and client certificates for testing the tls modes against the test mysql:
+#   ./gencerts.sh && docker-compose -f docker-compose.yaml -f docker-compose.tls.yaml up -d
+set -e
+cd "$(dirname "$0")"
+mkdir -p certs
+cd certs
+openssl req -x509 -newkey rsa:2048 -nodes -days 3650 -subj "/CN=tdsql-migrate test CA" -keyout ca-key.pem -out ca.pem
+# issued for localhost and 127.0.0.1, so that verify-identity passes with -dst_ip 127.0.0.1
+openssl req -newkey rsa:2048 -nodes -subj "/CN=localhost" -keyout server-key.pem -out server.csr
+printf "subjectAltName=DNS:localhost,IP:127.0.0.1\n" > server.ext
+openssl x509 -req -in server.csr -CA ca.pem -CAkey ca-key.pem -CAcreateserial -days 3650 -extfile server.ext -out server-cert.pem
+openssl req -newkey rsa:2048 -nodes -subj "/CN=root" -keyout client-key.pem -out client.csr
+openssl x509 -req -in client.csr -CA ca.pem -CAkey ca-key.pem -CAcreateserial -days 3650 -out client-cert.pem
+rm -f server.csr server.ext client.csr ca.srl
+# readable by the mysql user of the container
+chmod 644 *.pem
@@ -0,0 +1,213 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LEVEL_DEBUG Level = iota // every batch sent
+	LEVEL_INFO               // progress of the migration and of every table
+	LEVEL_WARN               // something went wrong and was worked around, e.g. a retry
+	LEVEL_ERROR              // a table or the migration failed
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LEVEL_DEBUG || l > LEVEL_ERROR {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// "debug", "info", "warn" or "error"
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LEVEL_INFO, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", s)
+}
+
+// how the lines are written
+const (
+	FORMAT_TEXT = "text" // "2021-12-12 00:00:00.000 INFO  message source=src_a db=db1 table=1"
+	FORMAT_JSON = "json" // one object per line: {"time":...,"level":"info","msg":...,"source":"src_a",...}
+)
+
+const TEXT_TIME_LAYOUT = "2006-01-02 15:04:05.000"
+
+// where the lines of a logger and of every logger derived from it with With go
+type output struct {
+	lock   sync.Mutex
+	w      io.Writer
+	printf func(format string, v ...interface{}) // instead of w, see NewPrintf
+	format string
+	level  Level
+	buf    []byte
+}
+
+// writes leveled lines with context fields, safe for concurrent use.
+// loggers derived with With share the output of their parent.
+type Logger struct {
+	out    *output
+	fields []string // key, value, key, value...
+}
+
+func New(w io.Writer, format string, level Level) *Logger {
+	return &Logger{out: &output{w: w, format: format, level: level}}
+}
+
+// a logger handing every line to printf without the time, e.g. to the Printf of a *log.Logger
+func NewPrintf(printf func(format string, v ...interface{}), level Level) *Logger {
+	return &Logger{out: &output{printf: printf, format: FORMAT_TEXT, level: level}}
+}
+
+// a logger that writes nothing
+func Discard() *Logger {
+	return New(ioutil.Discard, FORMAT_TEXT, LEVEL_ERROR+1)
+}
+
+var (
+	stdLock sync.RWMutex
+	std     = New(os.Stderr, FORMAT_TEXT, LEVEL_INFO)
+)
+
+// the logger of the process, used by the packages without a logger of their own (srcreader, stats).
+// writes text lines of info and above to stderr until SetDefault is called.
+func Default() *Logger {
+	stdLock.RLock()
+	defer stdLock.RUnlock()
+	return std
+}
+
+// safe to call while other goroutines log, the loggers they already hold keep their output
+func SetDefault(l *Logger) {
+	stdLock.Lock()
+	defer stdLock.Unlock()
+	std = l
+}
+
+// a logger adding the fields to every line, keyvals are key and value pairs:
+// log.With("source", "src_a", "db", "db1", "table", "1")
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]string, len(l.fields), len(l.fields)+len(keyvals))
+	copy(fields, l.fields)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fields = append(fields, fmt.Sprint(keyvals[i]), fmt.Sprint(keyvals[i+1]))
+	}
+	return &Logger{out: l.out, fields: fields}
+}
+
+// true if lines of that level are written, to skip building expensive ones
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.out.level
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.log(LEVEL_DEBUG, format, v)
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.log(LEVEL_INFO, format, v)
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.log(LEVEL_WARN, format, v)
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.log(LEVEL_ERROR, format, v)
+}
+
+// same as Infof, so that a *Logger can be passed where a Printf is expected
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.log(LEVEL_INFO, format, v)
+}
+
+func (l *Logger) log(level Level, format string, v []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	now := time.Now()
+	msg := strings.TrimRight(fmt.Sprintf(format, v...), "\n")
+
+	o := l.out
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.buf = o.buf[:0]
+	if o.format == FORMAT_JSON {
+		o.buf = appendJSON(o.buf, now, level, msg, l.fields)
+	} else {
+		o.buf = appendText(o.buf, now, level, msg, l.fields, o.printf == nil)
+	}
+	if o.printf != nil {
+		o.printf("%s", o.buf)
+		return
+	}
+	o.buf = append(o.buf, '\n')
+	o.w.Write(o.buf)
+}
+
+func appendText(dst []byte, now time.Time, level Level, msg string, fields []string, withTime bool) []byte {
+	if withTime {
+		dst = now.AppendFormat(dst, TEXT_TIME_LAYOUT)
+		dst = append(dst, ' ')
+	}
+	name := strings.ToUpper(level.String())
+	dst = append(dst, name...)
+	dst = append(dst, "      "[len(name):]...)
+	// the fields stay on the first line of a message of several lines
+	rest := ""
+	if nl := strings.IndexByte(msg, '\n'); nl >= 0 {
+		msg, rest = msg[:nl], msg[nl:]
+	}
+	dst = append(dst, msg...)
+	for i := 0; i+1 < len(fields); i += 2 {
+		dst = append(dst, ' ')
+		dst = append(dst, fields[i]...)
+		dst = append(dst, '=')
+		if fields[i+1] == "" || strings.ContainsAny(fields[i+1], " \t\r\n\"=") {
+			dst = strconv.AppendQuote(dst, fields[i+1])
+		} else {
+			dst = append(dst, fields[i+1]...)
+		}
+	}
+	return append(dst, rest...)
+}
+
+func appendJSON(dst []byte, now time.Time, level Level, msg string, fields []string) []byte {
+	dst = append(dst, `{"time":"`...)
+	dst = now.AppendFormat(dst, time.RFC3339Nano)
+	dst = append(dst, `","level":"`...)
+	dst = append(dst, level.String()...)
+	dst = append(dst, `","msg":`...)
+	dst = appendJSONString(dst, msg)
+	for i := 0; i+1 < len(fields); i += 2 {
+		dst = append(dst, ',')
+		dst = appendJSONString(dst, fields[i])
+		dst = append(dst, ':')
+		dst = appendJSONString(dst, fields[i+1])
+	}
+	return append(dst, '}')
+}
+
+func appendJSONString(dst []byte, s string) []byte {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return append(dst, bytes.TrimRight(b.Bytes(), "\n")...)
+}
@@ -0,0 +1,176 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the lines written, without their time
+func textLines(t *testing.T, buf *bytes.Buffer) []string {
+	t.Helper()
+	var lines []string
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		if len(line) > len(TEXT_TIME_LAYOUT) && line[len(TEXT_TIME_LAYOUT)] == ' ' {
+			if _, err := time.Parse(TEXT_TIME_LAYOUT, line[:len(TEXT_TIME_LAYOUT)]); err == nil {
+				line = line[len(TEXT_TIME_LAYOUT)+1:]
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	log := New(&buf, FORMAT_TEXT, LEVEL_WARN)
+	log.Debugf("debug")
+	log.Infof("info")
+	log.Printf("printf")
+	log.Warnf("warn %d", 1)
+	log.Errorf("error %d", 2)
+	want := []string{"WARN  warn 1\n", "ERROR error 2\n"}
+	if got := textLines(t, &buf); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if log.Enabled(LEVEL_INFO) || !log.Enabled(LEVEL_WARN) {
+		t.Error("Enabled doesn't follow the level")
+	}
+
+	if Discard().Enabled(LEVEL_ERROR) {
+		t.Error("Discard is enabled")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]Level{"debug": LEVEL_DEBUG, "INFO": LEVEL_INFO, "Warn": LEVEL_WARN, "error": LEVEL_ERROR} {
+		if got, err := ParseLevel(s); err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseLevel("warning"); err == nil {
+		t.Error("ParseLevel(warning): no error")
+	}
+}
+
+func TestWith(t *testing.T) {
+	var buf bytes.Buffer
+	log := New(&buf, FORMAT_TEXT, LEVEL_INFO)
+	source := log.With("source", "src_a")
+	// room for more fields in source's slice must not let its children overwrite each other's
+	db1 := source.With("db", "db1")
+	db2 := source.With("db", "db2")
+	table := db1.With("table", 1, "odd")
+	log.Infof("a")
+	source.Infof("b")
+	db1.Infof("c")
+	db2.Infof("d")
+	table.Infof("e")
+	want := []string{
+		"INFO  a\n",
+		"INFO  b source=src_a\n",
+		"INFO  c source=src_a db=db1\n",
+		"INFO  d source=src_a db=db2\n",
+		"INFO  e source=src_a db=db1 table=1\n",
+	}
+	if got := textLines(t, &buf); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestText(t *testing.T) {
+	var lines []string
+	log := NewPrintf(func(format string, v ...interface{}) { lines = append(lines, fmt.Sprintf(format, v...)) }, LEVEL_INFO)
+	log.With("plain", "x", "space", "a b", "eq", "a=b", "quote", `say "hi"`, "newline", "a\nb", "tab", "a\tb", "empty", "").Infof("values")
+	log.With("table", "1").Errorf("failed:\n  line 1\n  line 2\n")
+	want := []string{
+		`INFO  values plain=x space="a b" eq="a=b" quote="say \"hi\"" newline="a\nb" tab="a\tb" empty=""`,
+		"ERROR failed: table=1\n  line 1\n  line 2",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+
+	var buf bytes.Buffer
+	New(&buf, FORMAT_TEXT, LEVEL_INFO).Infof("with time")
+	line := buf.String()
+	if _, err := time.Parse(TEXT_TIME_LAYOUT, line[:len(TEXT_TIME_LAYOUT)]); err != nil || line[len(TEXT_TIME_LAYOUT):] != " INFO  with time\n" {
+		t.Errorf("got %q, want the time then the line", line)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	log := New(&buf, FORMAT_JSON, LEVEL_INFO).With("source", "src_a", "table", "a \"b\"\n<c>")
+	log.Infof("first")
+	log.Warnf("several\nlines\t\"quoted\"")
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %q", len(lines), buf.String())
+	}
+	want := []map[string]string{
+		{"level": "info", "msg": "first", "source": "src_a", "table": "a \"b\"\n<c>"},
+		{"level": "warn", "msg": "several\nlines\t\"quoted\"", "source": "src_a", "table": "a \"b\"\n<c>"},
+	}
+	for i, line := range lines {
+		var got map[string]string
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("line %d isn't valid json: %v: %s", i+1, err, line)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, got["time"]); err != nil {
+			t.Errorf("line %d: %v", i+1, err)
+		}
+		delete(got, "time")
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("line %d: got %v, want %v", i+1, got, want[i])
+		}
+	}
+	if strings.Contains(buf.String(), `\u003c`) {
+		t.Errorf("html is escaped: %s", buf.String())
+	}
+}
+
+func TestConcurrentLines(t *testing.T) {
+	var buf bytes.Buffer
+	log := New(&buf, FORMAT_TEXT, LEVEL_INFO)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			l := log.With("worker", w)
+			for i := 0; i < 100; i++ {
+				l.Infof("line %d", i)
+			}
+		}(w)
+	}
+	// swapping the default while others log
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			old := Default()
+			SetDefault(log)
+			Default().With("i", i)
+			SetDefault(old)
+		}
+	}()
+	wg.Wait()
+	for _, line := range textLines(t, &buf) {
+		var i, w int
+		if n, err := fmt.Sscanf(line, "INFO  line %d worker=%d\n", &i, &w); n != 2 || err != nil {
+			t.Fatalf("interleaved line %q", line)
+		}
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 800 {
+		t.Errorf("%d lines, want 800", n)
+	}
+}
@@ -1,185 +1,62 @@
 package main
 
 import (
-	"database/sql"
-	"errors"
-	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"time"
-
-	"github.com/Emanatry/tdsql-migrate-go/migrator"
-	"github.com/Emanatry/tdsql-migrate-go/srcreader"
-	"github.com/Emanatry/tdsql-migrate-go/stats"
-	_ "github.com/go-sql-driver/mysql"
+	"strings"
 )
 
-var dataPath *string
-var dstIP *string
-var dstPort *int
-var dstUser *string
-var dstPassword *string
-var suppressLog *bool
-
-func main() {
-	// for distinguishing between different builds and logs
-	label, err := ioutil.ReadFile("./label.txt")
-	if err == nil {
-		fmt.Printf("======LABEL OF THIS BUILD======\n%s===============================\n", string(label))
-	}
-
-	// parse arguments
-	println("\n======== parse arguments ========")
-
-	dataPath = flag.String("data_path", "/tmp/data/", "dir path of source data")
-	dstIP = flag.String("dst_ip", "", "ip of dst database address")
-	dstPort = flag.Int("dst_port", 0, "port of dst database address")
-	dstUser = flag.String("dst_user", "", "user name of dst database")
-	dstPassword = flag.String("dst_password", "", "password of dst database")
-	suppressLog = flag.Bool("suppress_log", false, "do suppress dev logs")
-
-	flag.Parse()
-
-	fmt.Printf("data path:%v\n", *dataPath)
-	fmt.Printf("dst ip:%v\n", *dstIP)
-	fmt.Printf("dst port:%v\n", *dstPort)
-	fmt.Printf("dst user:%v\n", *dstUser)
-	fmt.Printf("dst password:%v\n", *dstPassword)
-	stats.DevSuppressLog = *suppressLog
-
-	if (*dataPath)[len(*dataPath)-1:] != "/" {
-		*dataPath += "/"
-	}
-
-	var srcdirs []string
-	dir, err := ioutil.ReadDir(*dataPath)
-	if err != nil {
-		// do nothing
-	} else {
-		for _, v := range dir {
-			srcdirs = append(srcdirs, v.Name())
-		}
-	}
-
-	fmt.Printf("directories in data_path: %v", srcdirs)
-
-	// open sources
-	println("\n======== open sources ========")
-
-	srca, err := srcreader.Open(*dataPath+"src_a", "src_a")
-	if err != nil {
-		println("failed opening source a: " + err.Error())
-		return
-	}
-
-	srcb, err := srcreader.Open(*dataPath+"src_b", "src_b")
-	if err != nil {
-		println("failed opening source b: " + err.Error())
-		return
-	}
-
-	fmt.Printf("source a databases: %v\n", srca.Databases)
-	fmt.Printf("source b databases: %v\n", srcb.Databases)
-
-	// open database connection
-	println("\n======== open database connection ========")
-
-	DSN := fmt.Sprintf("%s:%s@(%s:%d)/?parseTime=true&loc=Local&autocommit=false", *dstUser, *dstPassword, *dstIP, *dstPort)
-	println("DSN: " + DSN)
-
-	db, err := sql.Open("mysql", DSN)
-	if err != nil {
-		panic(err)
-	}
+// exit codes of the commands
+const EXIT_OK = 0
+const EXIT_FAILED = 1
+const EXIT_USAGE = 2
 
-	db.SetConnMaxIdleTime(-1)
-	db.SetConnMaxLifetime(-1)
-	db.SetMaxOpenConns(100)
-	db.SetMaxIdleConns(100)
-	db.Ping()
+// exit code used when the migration was stopped by SIGINT/SIGTERM.
+// all committed progress has been checkpointed, so simply rerun to resume.
+const EXIT_INTERRUPTED = 3
 
-	println("connection to database succesfully established!")
-
-	// test database connection
-	println("\n======== test database connection ========")
-
-	rows, err := db.Query("SHOW DATABASES;")
-	if err != nil {
-		panic(err)
-	}
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int // returns the exit code
+}
 
-	fmt.Printf("remote databases: \n")
+var commands = []*command{
+	{"migrate", "presort, merge and load the sources into the target (the default)", runMigrate},
+	{"plan", "show what migrate would do with every table, without connecting", runPlan},
+	{"status", "show the progress of every table from the checkpoints", runStatus},
+	{"verify", "compare the rows in the target with the merged sources", runVerify},
+	{"lint", "check the source csv files against the schema of their tables", runLint},
+	{"presort", "presort and merge the sources without loading them", runPresort},
+	{"reset", "remove the checkpoints, and optionally the presorted data and the migrated tables", runReset},
+	{"preflight", "check the sources, the local environment and the target before migrating", runPreflight},
+	{"version", "print the version of this build", runVersion},
+}
 
-	for rows.Next() {
-		var dbname string
-		rows.Scan(&dbname)
-		println(" - " + dbname)
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
 	}
+	fmt.Fprintf(os.Stderr, "\nwithout a command the flags are passed to migrate. run '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
 
-	rows.Close()
-
-	fmt.Printf("database stats: \n%+v\n", db.Stats())
-
-	var doExit *bool = stats.StartStatsReportingGoroutine(db)
-	println("\n======== this implementation sorts and merges on the fly ========")
-
-	println("\n======== migrate database ========")
-
-	doCreateTable := true
-	// workaround for a judge env bug where not all tables from a previous migration attempt is dropped
-	if _, err := os.Stat("./migration_inprogress.txt"); errors.Is(err, os.ErrNotExist) {
-		f, err := os.Create("./migration_inprogress.txt")
-		if err != nil {
-			panic(fmt.Sprintf("failed creating migration_inprogress.txt: %s\n", err))
-		}
-		f.Write([]byte(time.Now().String()))
-		if err = migrator.PostJobDropMetaMigration(db); err != nil {
-			fmt.Printf("failed dropping meta_migration: %s\n", err.Error())
+func main() {
+	args := os.Args[1:]
+	name := "migrate"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage()
+		os.Exit(EXIT_OK)
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			os.Exit(cmd.run(args))
 		}
-		f.Close()
-	} else {
-		fmt.Printf("migration_inprogress.txt exists.\n")
-		doCreateTable = false
 	}
-
-	// 准备迁移目标实例的环境，创建迁移过程中需要的临时表等。
-	migrator.PrepareTargetDB(db)
-
-	println("\n======== starting backgound presort & merge ========")
-	srcreader.StartBackgoundPresortMerge(srca, srcb)
-
-	if err := migrator.MigrateSource(srca, srcb, db, DSN, doCreateTable); err != nil {
-		panic(err)
-	}
-
-	// ==== for migrating without local dedup:
-	// if err := migrator.MigrateSource(srca, db, false); err != nil {
-	// 	panic(err)
-	// }
-	// if err := migrator.MigrateSource(srcb, db, false); err != nil {
-	// 	panic(err)
-	// }
-
-	// ==== for migrating a single table:
-	// if err := migrator.MigrateTable(&srcb.Databases[0], "4", db, false); err != nil {
-	// 	panic(err)
-	// }
-
-	// ==== Note: disabled postjob to save some time in the competition.
-	// if err := migrator.PostJob(db); err != nil {
-	// 	// panic(err)
-	// 	println("error: " + err.Error()) // nah, just continue anyway.
-	// }
-
-	if err := migrator.PostJobDropMetaMigration(db); err != nil {
-		fmt.Printf("failed dropping meta migration: %s\n", err.Error())
-	}
-
-	db.Close()
-	*doExit = true
-
-	println("all done, exiting......")
-	os.Remove("./migration_inprogress.txt")
-	os.Exit(0)
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	os.Exit(EXIT_USAGE)
 }
@@ -13,4 +13,4 @@ cat label.txt
 echo ===============================
 # go run ./preflight/preflight.go
 g++ -O2 ./presort/sortmerge.cpp -o ./presort/sortmerge
-go build -o run main.go
\ No newline at end of file
+go build -o run .
\ No newline at end of file
@@ -0,0 +1,192 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Emanatry/tdsql-migrate-go/logging"
+	"github.com/Emanatry/tdsql-migrate-go/stats"
+)
+
+// bounds of the adaptive worker count (Settings.Adaptive), Settings.ConcurrentWorkers is the starting point
+const ADAPTIVE_MIN_WORKERS = 2
+const ADAPTIVE_MAX_WORKERS = 32
+
+// how often the controller looks at the throughput, long enough to average over several commits
+const ADAPTIVE_INTERVAL = 20 * time.Second
+
+// a change in throughput smaller than this (relative) is treated as noise
+const ADAPTIVE_THROUGHPUT_TOLERANCE = 0.05
+
+// back off when the average batch latency exceeds this multiple of the best latency seen so far
+const ADAPTIVE_LATENCY_TOLERANCE = 3.0
+
+// intervals to wait before probing with one more worker again, after the last probe didn't help
+const ADAPTIVE_HOLD_INTERVALS = 3
+
+// intervals with fewer batches than this are too noisy to set the best latency
+const ADAPTIVE_MIN_BATCHES = 10
+
+// AIMD controller of the scheduler's worker limit.
+// one worker is added as long as that keeps increasing the throughput, and a quarter of the workers
+// are taken away when the throughput drops, the batches get much slower or transient errors are
+// retried (the target is saturated).
+type concurrencyController struct {
+	sched *scheduler
+	meter *meter
+	log   *logging.Logger
+
+	lastThroughput float64 // bytes/s of the previous interval
+	lastBytes      int64
+	lastTime       time.Time
+	bestLatency    time.Duration
+	grew           bool // whether the last decision added a worker
+	hold           int  // intervals left before probing again
+}
+
+func newConcurrencyController(sched *scheduler, meter *meter, log *logging.Logger) *concurrencyController {
+	first := meter.sample()
+	return &concurrencyController{
+		sched:     sched,
+		meter:     meter,
+		log:       log,
+		lastBytes: first.bytesTotal,
+		lastTime:  first.at,
+	}
+}
+
+func (c *concurrencyController) run(ctx context.Context) {
+	ticker := time.NewTicker(ADAPTIVE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.step()
+		}
+	}
+}
+
+func (c *concurrencyController) step() {
+	limit, busy := c.sched.getLimit()
+	newLimit, ok := c.decide(c.meter.sample(), limit, busy)
+	if ok {
+		c.sched.setLimit(newLimit)
+	}
+}
+
+// the worker limit after an interval ending with sample s, false if nothing was measured.
+// limit is the current limit and busy the number of running items.
+func (c *concurrencyController) decide(s meterSample, limit int, busy int) (int, bool) {
+	throughput := float64(s.bytesTotal-c.lastBytes) / s.at.Sub(c.lastTime).Seconds()
+	c.lastBytes, c.lastTime = s.bytesTotal, s.at
+
+	if s.batches == 0 {
+		return limit, false // nothing measured, e.g. everything is still presorting
+	}
+	if s.batches >= ADAPTIVE_MIN_BATCHES && (c.bestLatency == 0 || s.latency < c.bestLatency) {
+		c.bestLatency = s.latency
+	}
+
+	newLimit := limit
+	var reason string
+	switch {
+	case s.retries > 0:
+		newLimit = limit * 3 / 4
+		c.hold = ADAPTIVE_HOLD_INTERVALS
+		reason = fmt.Sprintf("%d transient error(s) retried", s.retries)
+	case c.bestLatency > 0 && s.latency > time.Duration(float64(c.bestLatency)*ADAPTIVE_LATENCY_TOLERANCE):
+		newLimit = limit * 3 / 4
+		c.hold = ADAPTIVE_HOLD_INTERVALS
+		reason = fmt.Sprintf("batch latency is over %.1fx the best %v", ADAPTIVE_LATENCY_TOLERANCE, c.bestLatency.Round(time.Millisecond))
+	case c.grew && throughput < c.lastThroughput*(1-ADAPTIVE_THROUGHPUT_TOLERANCE):
+		newLimit = limit * 3 / 4
+		c.hold = ADAPTIVE_HOLD_INTERVALS
+		reason = "throughput dropped after adding a worker"
+	case c.grew && throughput < c.lastThroughput*(1+ADAPTIVE_THROUGHPUT_TOLERANCE):
+		newLimit = limit - 1
+		c.hold = ADAPTIVE_HOLD_INTERVALS
+		reason = "throughput didn't improve after adding a worker"
+	case busy < limit:
+		reason = "not enough work to fill the current workers"
+	case c.hold > 0:
+		c.hold--
+		reason = "holding"
+	default:
+		newLimit = limit + 1
+		reason = "probing with one more worker"
+	}
+	if newLimit < ADAPTIVE_MIN_WORKERS {
+		newLimit = ADAPTIVE_MIN_WORKERS
+	}
+	if newLimit > ADAPTIVE_MAX_WORKERS {
+		newLimit = ADAPTIVE_MAX_WORKERS
+	}
+
+	c.log.Infof("adaptive: %.2f KB/s (was %.2f), batch latency %v, workers %d -> %d: %s",
+		throughput/1024, c.lastThroughput/1024, s.latency.Round(time.Millisecond), limit, newLimit, reason)
+	c.grew = newLimit > limit
+	c.lastThroughput = throughput
+	return newLimit, true
+}
+
+// bytes, batches and retries of one Migrator, for its concurrency controller. the stats line has the process totals.
+type meter struct {
+	lock       sync.Mutex
+	bytesTotal int64
+	latencySum time.Duration
+	batches    int
+	retries    int
+}
+
+// what the meter measured in an interval
+type meterSample struct {
+	at         time.Time
+	bytesTotal int64         // since the start
+	batches    int           // since the last sample
+	latency    time.Duration // average of those batches
+	retries    int           // since the last sample
+}
+
+// total bytes migrated so far, and the batches and retries since the last call
+func (m *meter) sample() meterSample {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s := meterSample{at: time.Now(), bytesTotal: m.bytesTotal, batches: m.batches, retries: m.retries}
+	if m.batches > 0 {
+		s.latency = m.latencySum / time.Duration(m.batches)
+	}
+	m.latencySum = 0
+	m.batches = 0
+	m.retries = 0
+	return s
+}
+
+func (m *Migrator) reportBytes(bytesMigrated int) {
+	if bytesMigrated <= 0 {
+		return
+	}
+	stats.ReportBytesMigrated(bytesMigrated)
+	m.meter.lock.Lock()
+	m.meter.bytesTotal += int64(bytesMigrated)
+	m.meter.lock.Unlock()
+}
+
+// the time it took to execute one batch
+func (m *Migrator) reportBatch(latency time.Duration) {
+	stats.ReportBatchLatency(latency)
+	m.meter.lock.Lock()
+	m.meter.latencySum += latency
+	m.meter.batches++
+	m.meter.lock.Unlock()
+}
+
+// a transient error about to be retried
+func (m *Migrator) reportRetry() {
+	m.meter.lock.Lock()
+	m.meter.retries++
+	m.meter.lock.Unlock()
+}
@@ -0,0 +1,120 @@
+package migrator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Emanatry/tdsql-migrate-go/logging"
+)
+
+func TestConcurrencyControllerDecide(t *testing.T) {
+	type interval struct {
+		throughput float64 // bytes/s
+		batches    int
+		latency    time.Duration
+		retries    int
+		idle       bool // fewer running items than the limit
+		want       int  // limit after the interval, 0 if nothing was measured
+	}
+	ms := time.Millisecond
+	tests := []struct {
+		name      string
+		start     int
+		intervals []interval
+	}{
+		{"probes while the throughput grows", 4, []interval{
+			{1000, 20, 10 * ms, 0, false, 5},
+			{1200, 20, 10 * ms, 0, false, 6},
+			{1500, 20, 10 * ms, 0, false, 7},
+		}},
+		{"steps back and holds when a worker didn't help", 4, []interval{
+			{1000, 20, 10 * ms, 0, false, 5},
+			{1020, 20, 10 * ms, 0, false, 4},
+			{1020, 20, 10 * ms, 0, false, 4},
+			{1020, 20, 10 * ms, 0, false, 4},
+			{1020, 20, 10 * ms, 0, false, 4},
+			{1020, 20, 10 * ms, 0, false, 5},
+		}},
+		{"backs off when the throughput drops after a worker", 8, []interval{
+			{1000, 20, 10 * ms, 0, false, 9},
+			{800, 20, 10 * ms, 0, false, 6},
+			{800, 20, 10 * ms, 0, false, 6},
+		}},
+		{"backs off on latency", 8, []interval{
+			{1000, 20, 10 * ms, 0, false, 9},
+			{1000, 20, 31 * ms, 0, false, 6},
+			{1000, 20, 31 * ms, 0, false, 4},
+		}},
+		{"latency of a few batches doesn't set the best", 8, []interval{
+			{1000, 2, 1 * ms, 0, false, 9},
+			{2000, 20, 10 * ms, 0, false, 10},
+		}},
+		{"backs off on retried errors", 8, []interval{
+			{1000, 20, 10 * ms, 2, false, 6},
+			{1000, 20, 10 * ms, 0, false, 6},
+		}},
+		{"doesn't grow without enough work", 4, []interval{
+			{1000, 20, 10 * ms, 0, true, 4},
+			{1000, 20, 10 * ms, 0, true, 4},
+		}},
+		{"nothing measured", 4, []interval{
+			{0, 0, 0, 0, false, 0},
+			{1000, 20, 10 * ms, 0, false, 5},
+		}},
+		{"never below the minimum", ADAPTIVE_MIN_WORKERS, []interval{
+			{1000, 20, 10 * ms, 0, false, ADAPTIVE_MIN_WORKERS + 1},
+			{1000, 20, 50 * ms, 0, false, ADAPTIVE_MIN_WORKERS},
+			{1000, 20, 50 * ms, 3, false, ADAPTIVE_MIN_WORKERS},
+		}},
+		{"never above the maximum", ADAPTIVE_MAX_WORKERS - 1, []interval{
+			{1000, 20, 10 * ms, 0, false, ADAPTIVE_MAX_WORKERS},
+			{2000, 20, 10 * ms, 0, false, ADAPTIVE_MAX_WORKERS},
+			// not counted as a worker added, so a flat throughput doesn't step back
+			{2000, 20, 10 * ms, 0, false, ADAPTIVE_MAX_WORKERS},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2021, 12, 12, 0, 0, 0, 0, time.UTC)
+			c := &concurrencyController{log: logging.Discard(), lastTime: now}
+			var bytesTotal int64
+			limit := tt.start
+			for i, iv := range tt.intervals {
+				now = now.Add(ADAPTIVE_INTERVAL)
+				bytesTotal += int64(iv.throughput * ADAPTIVE_INTERVAL.Seconds())
+				busy := limit
+				if iv.idle {
+					busy = limit - 1
+				}
+				got, ok := c.decide(meterSample{at: now, bytesTotal: bytesTotal, batches: iv.batches, latency: iv.latency, retries: iv.retries}, limit, busy)
+				if !ok {
+					got = 0
+				}
+				if got != iv.want {
+					t.Fatalf("interval %d: limit %d -> %d, want %d", i, limit, got, iv.want)
+				}
+				if ok {
+					limit = got
+				}
+			}
+		})
+	}
+}
+
+func TestMeterSample(t *testing.T) {
+	m := &Migrator{}
+	m.reportBytes(100)
+	m.reportBatch(10 * time.Millisecond)
+	m.reportBatch(30 * time.Millisecond)
+	m.reportRetry()
+	s := m.meter.sample()
+	if s.bytesTotal != 100 || s.batches != 2 || s.latency != 20*time.Millisecond || s.retries != 1 {
+		t.Fatalf("got %+v", s)
+	}
+	// the batches and retries start over, the bytes are a total
+	m.reportBytes(50)
+	s = m.meter.sample()
+	if s.bytesTotal != 150 || s.batches != 0 || s.latency != 0 || s.retries != 0 {
+		t.Fatalf("got %+v after a second sample", s)
+	}
+}
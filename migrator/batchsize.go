@@ -0,0 +1,221 @@
+package migrator
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Emanatry/tdsql-migrate-go/csvrow"
+	"github.com/Emanatry/tdsql-migrate-go/logging"
+)
+
+// batch sizes (rows per INSERT) the adaptive batch size moves between, a prepared statement is
+// kept for each of them. the table's batch size is the starting point.
+var batchSizeBuckets = []int{MIN_BATCH_SIZE, 100, 250, 500, 1000, 2000, 4000, MAX_BATCH_SIZE}
+
+const MIN_BATCH_SIZE = 50
+const MAX_BATCH_SIZE = 8000
+
+// the batch size is doubled or halved (to the next bucket) to keep the batch latency around this
+const BATCH_TARGET_LATENCY = 1 * time.Second
+
+// mysql doesn't accept more placeholders than this in a single prepared statement
+const MAX_PLACEHOLDERS = 65535
+
+// fraction of max_allowed_packet a batch may use, leaving room for the protocol overhead
+const PACKET_HEADROOM = 0.75
+
+// estimated bytes per value on top of the raw csv text in the binary protocol (type and length)
+const PARAM_OVERHEAD = 4
+
+// what the batches have to fit in, read from the target by detectServerLimits
+type serverLimits struct {
+	maxAllowedPacket   int  // @@max_allowed_packet
+	noBackslashEscapes bool // whether the sql_mode has NO_BACKSLASH_ESCAPES, for quoting literals
+}
+
+// mysql 5.7's
+var defaultServerLimits = serverLimits{maxAllowedPacket: 4 * 1024 * 1024}
+
+// bytes a batch may use
+func (l serverLimits) maxBatchBytes() int {
+	return int(float64(l.maxAllowedPacket) * PACKET_HEADROOM)
+}
+
+func (m *Migrator) detectServerLimits() error {
+	var packet int
+	var sqlMode string
+	if err := m.db.QueryRow("SELECT @@max_allowed_packet, @@sql_mode;").Scan(&packet, &sqlMode); err != nil {
+		return fmt.Errorf("failed reading max_allowed_packet: %w", err)
+	}
+	m.limits.maxAllowedPacket = packet
+	m.limits.noBackslashEscapes = strings.Contains(strings.ToUpper(sqlMode), "NO_BACKSLASH_ESCAPES")
+	m.log.Infof("max_allowed_packet: %d bytes, sql_mode: %s", packet, sqlMode)
+	return nil
+}
+
+// the batch size of a table, shared by the ranges being loaded.
+// the number of rows is capped by the placeholder limit, and the bytes by max_allowed_packet.
+type batchSizer struct {
+	lock     sync.Mutex
+	log      *logging.Logger
+	numCols  int
+	maxRows  int // placeholder limit
+	maxBytes int // packet limit
+	bucket   int // index of the current size in batchSizeBuckets
+}
+
+func newBatchSizer(numCols int, batchSize int, maxBytes int, log *logging.Logger) *batchSizer {
+	b := &batchSizer{log: log, numCols: numCols, maxRows: MAX_PLACEHOLDERS / numCols, maxBytes: maxBytes}
+	for i, size := range batchSizeBuckets {
+		if size <= batchSize && size <= b.maxRows {
+			b.bucket = i
+		}
+	}
+	return b
+}
+
+// the max rows and the max bytes (estimated over the csv lines) of the next batch
+func (b *batchSizer) limits() (rows int, bytes int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	rows = batchSizeBuckets[b.bucket]
+	if rows > b.maxRows {
+		rows = b.maxRows
+	}
+	return rows, b.maxBytes
+}
+
+// the encoded size of a row in a batch, as counted against the bytes limit
+func (b *batchSizer) rowBytes(line []byte) int {
+	return len(line) + b.numCols*PARAM_OVERHEAD
+}
+
+// adjust the size after executing a full batch of rows
+func (b *batchSizer) observe(rows int, latency time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if rows < batchSizeBuckets[b.bucket] && rows < b.maxRows {
+		return // cut short by the bytes limit or the end of the range, says nothing about the size
+	}
+	old := b.bucket
+	if latency < BATCH_TARGET_LATENCY/2 && b.bucket+1 < len(batchSizeBuckets) && batchSizeBuckets[b.bucket+1] <= b.maxRows {
+		b.bucket++
+	} else if latency > BATCH_TARGET_LATENCY*2 && b.bucket > 0 {
+		b.bucket--
+	}
+	if b.bucket != old {
+		b.log.Infof("batch size: %d -> %d rows (latency %v)", batchSizeBuckets[old], batchSizeBuckets[b.bucket], latency.Round(time.Millisecond))
+	}
+}
+
+// prepared insert statements of a table, one per batch size bucket.
+// they are prepared on the pool and shared by the ranges, each connection prepares them once.
+type stmtCache struct {
+	db          *sql.DB
+	dbname      string
+	tablename   string
+	columnNames []string
+	conflict    string
+	noBackslash bool // how literals are quoted, see serverLimits
+	lock        sync.Mutex
+	stmts       map[int]*sql.Stmt
+}
+
+func newStmtCache(db *sql.DB, dbname string, tablename string, columnNames []string, conflict string, noBackslash bool) *stmtCache {
+	return &stmtCache{db: db, dbname: dbname, tablename: tablename, columnNames: columnNames, conflict: conflict, noBackslash: noBackslash, stmts: make(map[int]*sql.Stmt)}
+}
+
+func isBucketSize(rows int) bool {
+	for _, size := range batchSizeBuckets {
+		if rows == size {
+			return true
+		}
+	}
+	return false
+}
+
+// the statement for a batch of the given number of rows within tx.
+// other sizes than the buckets (batches cut short) are prepared on tx only, and closed with it.
+func (c *stmtCache) get(ctx context.Context, tx *sql.Tx, rows int) (*sql.Stmt, error) {
+	if !isBucketSize(rows) && rows != MAX_PLACEHOLDERS/len(c.columnNames) {
+		stmt, err := tx.PrepareContext(ctx, generateBatchInsertStmts(c.dbname, c.tablename, c.columnNames, rows, c.conflict))
+		if err != nil {
+			return nil, fmt.Errorf("failed preparing insert statement: %w", err)
+		}
+		return stmt, nil
+	}
+	c.lock.Lock()
+	stmt, ok := c.stmts[rows]
+	if !ok {
+		var err error
+		stmt, err = c.db.PrepareContext(ctx, generateBatchInsertStmts(c.dbname, c.tablename, c.columnNames, rows, c.conflict))
+		if err != nil {
+			c.lock.Unlock()
+			return nil, fmt.Errorf("failed preparing insert statement: %w", err)
+		}
+		c.stmts[rows] = stmt
+	}
+	c.lock.Unlock()
+	return tx.StmtContext(ctx, stmt), nil
+}
+
+// append a batch insert of the rows [from, to) of data as literals
+func (c *stmtCache) appendLiteralInsert(dst []byte, data *csvrow.Batch, from int, to int) []byte {
+	prefix, suffix := batchInsertStmtParts(c.dbname, c.tablename, c.columnNames, c.conflict)
+	dst = append(dst, prefix...)
+	dst = data.AppendValuesRange(dst, from, to, c.noBackslash)
+	return append(dst, suffix...)
+}
+
+func (c *stmtCache) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, stmt := range c.stmts {
+		stmt.Close() // failing to close this will lead to a connection leak
+	}
+	c.stmts = make(map[int]*sql.Stmt)
+}
+
+// reads csv lines, a line can be put back when it doesn't fit in the current batch.
+// the lines returned are only valid until the next call to next.
+type lineReader struct {
+	r    *bufio.Reader
+	back []byte
+	long []byte // reused for lines longer than the bufio buffer
+}
+
+// returns nil at the end of the file
+func (l *lineReader) next() ([]byte, error) {
+	if l.back != nil {
+		line := l.back
+		l.back = nil
+		return line, nil
+	}
+	line, err := l.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		l.long = append(l.long[:0], line...)
+		for err == bufio.ErrBufferFull {
+			line, err = l.r.ReadSlice('\n')
+			l.long = append(l.long, line...)
+		}
+		line = l.long
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	return line, nil
+}
+
+// the line must be the last one returned by next
+func (l *lineReader) unread(line []byte) {
+	l.back = line
+}
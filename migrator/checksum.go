@@ -0,0 +1,285 @@
+package migrator
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Emanatry/tdsql-migrate-go/csvrow"
+)
+
+// floats without a declared scale are compared rounded to this many decimals, float columns only
+// keep about 7 significant digits of what was loaded
+const FLOAT_CHECKSUM_SCALE = 4
+
+// the checksum of a row is the CRC32 of its values rendered as text the same way on both sides,
+// joined by ','. the target renders them with checksumColumn.expr, the merged csv with appendCanonical.
+type checksumColumn struct {
+	name     string
+	kind     csvrow.Kind
+	dataType string
+	scale    int            // decimals of decimal and float columns
+	loc      *time.Location // datetimes are parsed in the location of the loading sessions
+}
+
+// the columns of a table in the target, in order
+func (m *Migrator) checksumColumns(dbname string, table string) ([]checksumColumn, error) {
+	rows, err := m.db.Query("SELECT `COLUMN_NAME`, `DATA_TYPE`, `COLUMN_TYPE`, `NUMERIC_SCALE` FROM information_schema.`COLUMNS` WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY `ORDINAL_POSITION`;", dbname, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading schema of %s.%s: %w", dbname, table, err)
+	}
+	defer rows.Close()
+	var cols []checksumColumn
+	for rows.Next() {
+		var name, dataType, columnType string
+		var scale sql.NullInt64
+		if err := rows.Scan(&name, &dataType, &columnType, &scale); err != nil {
+			return nil, fmt.Errorf("failed reading schema of %s.%s: %w", dbname, table, err)
+		}
+		c := checksumColumn{name: name, kind: csvrow.KindOf(dataType, columnType), dataType: strings.ToLower(dataType), scale: int(scale.Int64), loc: m.loc}
+		if c.kind == csvrow.KindFloat && !scale.Valid {
+			c.scale = FLOAT_CHECKSUM_SCALE
+		}
+		cols = append(cols, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading schema of %s.%s: %w", dbname, table, err)
+	}
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("%s.%s doesn't exist in the target", dbname, table)
+	}
+	return cols, nil
+}
+
+// the SQL expression of the row checksum
+func rowChecksumExpr(cols []checksumColumn) string {
+	exprs := make([]string, len(cols))
+	for i, c := range cols {
+		exprs[i] = c.expr()
+	}
+	return "CRC32(CONCAT_WS(',', " + strings.Join(exprs, ", ") + "))"
+}
+
+func (c checksumColumn) expr() string {
+	switch c.kind {
+	case csvrow.KindFloat:
+		return fmt.Sprintf("CAST(`%s` AS DECIMAL(65,%d))", c.name, c.scale)
+	case csvrow.KindDatetime:
+		return fmt.Sprintf("DATE_FORMAT(`%s`, '%%Y-%%m-%%d %%H:%%i:%%s')", c.name)
+	}
+	return "`" + c.name + "`"
+}
+
+// append the field of a csv line the way the target renders the value loaded from it
+func (c checksumColumn) appendCanonical(dst []byte, f []byte) ([]byte, error) {
+	switch c.kind {
+	case csvrow.KindInt:
+		n, err := strconv.ParseInt(string(f), 10, 64)
+		if err != nil {
+			return dst, err
+		}
+		return strconv.AppendInt(dst, n, 10), nil
+	case csvrow.KindUint:
+		n, err := strconv.ParseUint(string(f), 10, 64)
+		if err != nil {
+			return dst, err
+		}
+		return strconv.AppendUint(dst, n, 10), nil
+	case csvrow.KindFloat:
+		v, err := strconv.ParseFloat(string(f), 64)
+		if err != nil {
+			return dst, err
+		}
+		// the server converts to DECIMAL from the shortest text of the double it stored
+		text := strconv.FormatFloat(v, 'f', -1, 64)
+		if c.dataType == "float" {
+			text = strconv.FormatFloat(float64(float32(v)), 'f', -1, 64)
+		}
+		rounded, ok := roundDecimal(text, c.scale)
+		if !ok {
+			return dst, errors.New("invalid syntax")
+		}
+		return append(dst, rounded...), nil
+	case csvrow.KindDatetime:
+		layout := csvrow.DATETIME_LAYOUT
+		if len(f) == len(csvrow.DATE_LAYOUT) {
+			layout = csvrow.DATE_LAYOUT
+		}
+		t, err := time.ParseInLocation(layout, string(f), c.loc)
+		if err != nil {
+			return dst, err
+		}
+		return t.AppendFormat(dst, csvrow.DATETIME_LAYOUT), nil
+	}
+	switch c.dataType {
+	case "decimal":
+		// stored with exactly its scale, rounded half up
+		if rounded, ok := roundDecimal(string(f), c.scale); ok {
+			return append(dst, rounded...), nil
+		}
+	case "char":
+		// trailing spaces are removed when a CHAR is read
+		return append(dst, bytes.TrimRight(f, " ")...), nil
+	}
+	return append(dst, f...), nil
+}
+
+// exponents beyond this can't be stored in a DECIMAL(65) anyway
+const MAX_DECIMAL_EXPONENT = 100
+
+// round the decimal text s half away from zero to scale decimals, the way a DECIMAL column stores it.
+// s may have an exponent ("1.5e3"). false if s isn't a decimal number.
+func roundDecimal(s string, scale int) (string, bool) {
+	neg := false
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		neg = s[0] == '-'
+		s = s[1:]
+	}
+	exp := 0
+	if e := strings.IndexAny(s, "eE"); e >= 0 {
+		n, err := strconv.Atoi(s[e+1:])
+		if err != nil || n < -MAX_DECIMAL_EXPONENT || n > MAX_DECIMAL_EXPONENT {
+			return "", false
+		}
+		s, exp = s[:e], n
+	}
+	intPart, frac := s, ""
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		intPart, frac = s[:dot], s[dot+1:]
+	}
+	if len(intPart)+len(frac) == 0 {
+		return "", false
+	}
+	for _, part := range []string{intPart, frac} {
+		for i := 0; i < len(part); i++ {
+			if part[i] < '0' || part[i] > '9' {
+				return "", false
+			}
+		}
+	}
+	if exp != 0 {
+		// move the decimal point
+		mantissa := intPart + frac
+		point := len(intPart) + exp
+		switch {
+		case point <= 0:
+			intPart, frac = "", strings.Repeat("0", -point)+mantissa
+		case point >= len(mantissa):
+			intPart, frac = mantissa+strings.Repeat("0", point-len(mantissa)), ""
+		default:
+			intPart, frac = mantissa[:point], mantissa[point:]
+		}
+	}
+	if intPart == "" {
+		intPart = "0"
+	}
+
+	digits := []byte(intPart)
+	for i := 0; i < scale; i++ {
+		if i < len(frac) {
+			digits = append(digits, frac[i])
+		} else {
+			digits = append(digits, '0')
+		}
+	}
+	if len(frac) > scale && frac[scale] >= '5' {
+		i := len(digits) - 1
+		for ; i >= 0 && digits[i] == '9'; i-- {
+			digits[i] = '0'
+		}
+		if i >= 0 {
+			digits[i]++
+		} else {
+			digits = append([]byte{'1'}, digits...)
+		}
+	}
+
+	intDigits := digits[:len(digits)-scale]
+	for len(intDigits) > 1 && intDigits[0] == '0' {
+		intDigits = intDigits[1:]
+	}
+	out := make([]byte, 0, len(digits)+2)
+	if neg && strings.Trim(string(digits), "0") != "" {
+		out = append(out, '-')
+	}
+	out = append(out, intDigits...)
+	if scale > 0 {
+		out = append(out, '.')
+		out = append(out, digits[len(digits)-scale:]...)
+	}
+	return string(out), true
+}
+
+// the checksum of a csv line, buf is reused from line to line
+func rowChecksum(cols []checksumColumn, line []byte, buf []byte) (uint32, []byte, error) {
+	line = bytes.TrimRight(line, "\r\n \t")
+	line = bytes.TrimLeft(line, " \t")
+	buf = buf[:0]
+	field := 0
+	for start := 0; ; field++ {
+		end := bytes.IndexByte(line[start:], ',')
+		if end < 0 {
+			end = len(line)
+		} else {
+			end += start
+		}
+		if field < len(cols) {
+			if field > 0 {
+				buf = append(buf, ',')
+			}
+			var err error
+			if buf, err = cols[field].appendCanonical(buf, line[start:end]); err != nil {
+				return 0, buf, &csvrow.FieldError{Field: field, Value: string(line[start:end]), Err: err}
+			}
+		}
+		if end == len(line) {
+			break
+		}
+		start = end + 1
+	}
+	if field+1 != len(cols) {
+		return 0, buf, &csvrow.FieldCountError{Expected: len(cols), Got: field + 1}
+	}
+	return crc32.ChecksumIEEE(buf), buf, nil
+}
+
+// true if column is the first column of an index of the table, so that a range of it can be
+// read without scanning the whole table
+func (m *Migrator) leadsAnIndex(dbname string, table string, column string) (bool, error) {
+	rows, err := m.db.Query(fmt.Sprintf("SHOW INDEXES IN `%s`.`%s`;", dbname, table))
+	if err != nil {
+		return false, fmt.Errorf("failed reading the indexes of %s.%s: %w", dbname, table, err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return false, fmt.Errorf("failed reading the indexes of %s.%s: %w", dbname, table, err)
+	}
+	dest := make([]interface{}, len(cols))
+	var discarded []byte
+	var seq int
+	var name string
+	for i := range dest {
+		dest[i] = &discarded
+		if cols[i] == "Seq_in_index" {
+			dest[i] = &seq
+		} else if cols[i] == "Column_name" {
+			dest[i] = &name
+		}
+	}
+	leads := false
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return false, fmt.Errorf("failed reading the indexes of %s.%s: %w", dbname, table, err)
+		}
+		if seq == 1 && strings.EqualFold(name, column) {
+			leads = true
+		}
+	}
+	return leads, rows.Err()
+}
@@ -0,0 +1,124 @@
+package migrator
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Emanatry/tdsql-migrate-go/csvrow"
+)
+
+func TestRoundDecimal(t *testing.T) {
+	tests := []struct {
+		s     string
+		scale int
+		want  string // "" if rejected
+	}{
+		{"1.23", 2, "1.23"},
+		{"1.2", 4, "1.2000"},
+		{"007.10", 2, "7.10"},
+		{".5", 1, "0.5"},
+		{"5.", 0, "5"},
+		{"+1", 2, "1.00"},
+		// halfway cases round away from zero
+		{"0.00005", 4, "0.0001"},
+		{"0.00004", 4, "0.0000"},
+		{"1.005", 2, "1.01"},
+		{"2.5", 0, "3"},
+		{"-2.5", 0, "-3"},
+		{"-0.00005", 4, "-0.0001"},
+		// negatives rounded to zero lose their sign
+		{"-0.00004", 4, "0.0000"},
+		{"-0", 2, "0.00"},
+		// carries
+		{"9.99995", 4, "10.0000"},
+		{"-9.99995", 4, "-10.0000"},
+		{"99.5", 0, "100"},
+		{"0.999", 2, "1.00"},
+		// exponents
+		{"1.5e3", 2, "1500.00"},
+		{"1.5E+3", 0, "1500"},
+		{"12345e-4", 2, "1.23"},
+		{"12355e-4", 2, "1.24"},
+		{"-5e-5", 4, "-0.0001"},
+		{"9.99995e1", 3, "100.000"},
+		{"1e0", 1, "1.0"},
+		{"0e5", 2, "0.00"},
+		// rejected
+		{"", 2, ""},
+		{"-", 2, ""},
+		{".", 2, ""},
+		{"abc", 2, ""},
+		{"1.2.3", 2, ""},
+		{"1,5", 2, ""},
+		{"1e", 2, ""},
+		{"e5", 2, ""},
+		{"1e1.5", 2, ""},
+		{"1e101", 2, ""},
+	}
+	for _, tt := range tests {
+		got, ok := roundDecimal(tt.s, tt.scale)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("roundDecimal(%q, %d) = %q, %v, want %q", tt.s, tt.scale, got, ok, tt.want)
+		}
+	}
+}
+
+func TestRowChecksum(t *testing.T) {
+	mixed := []checksumColumn{
+		{name: "id", kind: csvrow.KindUint, dataType: "bigint"},
+		{name: "a", kind: csvrow.KindFloat, dataType: "double", scale: FLOAT_CHECKSUM_SCALE},
+		{name: "b", kind: csvrow.KindBytes, dataType: "char"},
+		{name: "updated_at", kind: csvrow.KindDatetime, dataType: "datetime", loc: time.UTC},
+	}
+	float32Cols := []checksumColumn{
+		{name: "id", kind: csvrow.KindInt, dataType: "int"},
+		{name: "a", kind: csvrow.KindFloat, dataType: "float", scale: FLOAT_CHECKSUM_SCALE},
+		{name: "b", kind: csvrow.KindBytes, dataType: "varchar"},
+		{name: "updated_at", kind: csvrow.KindDatetime, dataType: "timestamp", loc: time.UTC},
+	}
+	decimalCols := []checksumColumn{
+		{name: "id", kind: csvrow.KindInt, dataType: "int"},
+		{name: "a", kind: csvrow.KindBytes, dataType: "decimal", scale: 2},
+		{name: "b", kind: csvrow.KindBytes, dataType: "decimal", scale: 2},
+		{name: "c", kind: csvrow.KindBytes, dataType: "decimal", scale: 2},
+	}
+	// want is what CONCAT_WS(',', ...) of rowChecksumExpr returns for the row loaded from line,
+	// sum is CRC32 of it as computed by the server
+	tests := []struct {
+		cols []checksumColumn
+		line string
+		want string
+		sum  uint32
+	}{
+		{mixed, "1,0.5,abc  ,2021-12-12\n", "1,0.5000,abc,2021-12-12 00:00:00", 2962723908},
+		{mixed, " 42,3.14159265,x,2021-12-12 00:00:00\r\n", "42,3.1416,x,2021-12-12 00:00:00", 724164389},
+		{float32Cols, "-0005,0.1,,2000-01-01 23:59:59", "-5,0.1000,,2000-01-01 23:59:59", 1385861797},
+		{decimalCols, "7,1.005,-1.995,1.5e3\n", "7,1.01,-2.00,1500.00", 2992105873},
+		{decimalCols, "0,-0.001,-0.005,0e5\n", "0,0.00,-0.01,0.00", 905160352},
+	}
+	var buf []byte
+	for _, tt := range tests {
+		sum, b, err := rowChecksum(tt.cols, []byte(tt.line), buf)
+		buf = b
+		if err != nil {
+			t.Errorf("rowChecksum(%q): %v", tt.line, err)
+			continue
+		}
+		if string(buf) != tt.want || sum != tt.sum {
+			t.Errorf("rowChecksum(%q) = %d of %q, want %d of %q", tt.line, sum, buf, tt.sum, tt.want)
+		}
+	}
+
+	var countErr *csvrow.FieldCountError
+	if _, _, err := rowChecksum(mixed, []byte("1,0.5,abc\n"), buf); !errors.As(err, &countErr) {
+		t.Errorf("a missing field: got %v, want a FieldCountError", err)
+	}
+	if _, _, err := rowChecksum(mixed, []byte("1,0.5,abc,2021-12-12,x\n"), buf); !errors.As(err, &countErr) {
+		t.Errorf("an extra field: got %v, want a FieldCountError", err)
+	}
+	var fieldErr *csvrow.FieldError
+	if _, _, err := rowChecksum(mixed, []byte("1,x,abc,2021-12-12\n"), buf); !errors.As(err, &fieldErr) || fieldErr.Field != 1 {
+		t.Errorf("an invalid float: got %v, want a FieldError of field 1", err)
+	}
+}
@@ -0,0 +1,97 @@
+package migrator
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// session variables set on every connection a worker checks out
+type SessionConfig struct {
+	DisableUniqueChecks     bool   // unique_checks = 0, secondary unique indexes are not checked while loading
+	DisableForeignKeyChecks bool   // foreign_key_checks = 0
+	DisableBinlog           bool   // sql_log_bin = 0, needs SUPER or SYSTEM_VARIABLES_ADMIN
+	TimeZone                string // time_zone, empty to keep the server's
+	LockWaitTimeout         int    // innodb_lock_wait_timeout in seconds, 0 to keep the server's
+}
+
+func (s SessionConfig) statements() []string {
+	var vars []string
+	if s.DisableUniqueChecks {
+		vars = append(vars, "unique_checks = 0")
+	}
+	if s.DisableForeignKeyChecks {
+		vars = append(vars, "foreign_key_checks = 0")
+	}
+	if s.DisableBinlog {
+		vars = append(vars, "sql_log_bin = 0")
+	}
+	if s.TimeZone != "" {
+		vars = append(vars, "time_zone = '"+strings.Replace(s.TimeZone, "'", "''", -1)+"'")
+	}
+	if s.LockWaitTimeout > 0 {
+		vars = append(vars, "innodb_lock_wait_timeout = "+strconv.Itoa(s.LockWaitTimeout))
+	}
+	if len(vars) == 0 {
+		return nil
+	}
+	return []string{"SET SESSION " + strings.Join(vars, ", ")}
+}
+
+// the location of a session time_zone: "+08:00", a named zone ("Asia/Shanghai"), or "" and "SYSTEM"
+// for the local time of this machine. the datetimes of the csv files are parsed in it and the driver
+// must format them back in it (see config), so that they reach the server as written.
+func SessionLocation(timeZone string) (*time.Location, error) {
+	if timeZone == "" || strings.EqualFold(timeZone, "SYSTEM") {
+		return time.Local, nil
+	}
+	if timeZone[0] == '+' || timeZone[0] == '-' {
+		hm := strings.SplitN(timeZone[1:], ":", 2)
+		if len(hm) == 2 {
+			h, err1 := strconv.Atoi(hm[0])
+			m, err2 := strconv.Atoi(hm[1])
+			if err1 == nil && err2 == nil && h >= 0 && h <= 14 && m >= 0 && m < 60 {
+				offset := h*3600 + m*60
+				if timeZone[0] == '-' {
+					offset = -offset
+				}
+				return time.FixedZone(timeZone, offset), nil
+			}
+		}
+		return nil, fmt.Errorf("invalid time zone offset %q, expected +hh:mm", timeZone)
+	}
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q: %w", timeZone, err)
+	}
+	return loc, nil
+}
+
+// hands out connections of the shared pool to the workers, configured with Settings.Session
+type connManager struct {
+	db      *sql.DB
+	session SessionConfig
+}
+
+func newConnManager(db *sql.DB, session SessionConfig) *connManager {
+	return &connManager{db: db, session: session}
+}
+
+// a dedicated connection for one worker, must be closed (returned to the pool) when done.
+// the session variables are set again on every checkout, as the pool may have replaced the connection.
+func (m *connManager) checkout(ctx context.Context) (*sql.Conn, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed connecting to target: %w", err)
+	}
+	for _, stmt := range m.session.statements() {
+		if _, err = conn.ExecContext(ctx, stmt); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed setting session variables [%s]: %w", stmt, err)
+		}
+	}
+	return conn, nil
+}
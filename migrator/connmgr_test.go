@@ -0,0 +1,115 @@
+package migrator
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSessionStatements(t *testing.T) {
+	tests := []struct {
+		name    string
+		session SessionConfig
+		want    []string
+	}{
+		{"nothing", SessionConfig{}, nil},
+		{"checks", SessionConfig{DisableUniqueChecks: true, DisableForeignKeyChecks: true},
+			[]string{"SET SESSION unique_checks = 0, foreign_key_checks = 0"}},
+		{"everything", SessionConfig{true, true, true, "+08:00", 600},
+			[]string{"SET SESSION unique_checks = 0, foreign_key_checks = 0, sql_log_bin = 0, time_zone = '+08:00', innodb_lock_wait_timeout = 600"}},
+		{"quoted time zone", SessionConfig{TimeZone: "it's"}, []string{"SET SESSION time_zone = 'it''s'"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.session.statements(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// a target that records the statements executed on each of its connections, and fails the ones
+// containing failOn
+type recordingConnector struct {
+	failOn string
+	conns  []*recordingConn
+}
+
+func (c *recordingConnector) Connect(context.Context) (driver.Conn, error) {
+	conn := &recordingConn{c: c}
+	c.conns = append(c.conns, conn)
+	return conn, nil
+}
+func (c *recordingConnector) Driver() driver.Driver { return nil }
+
+type recordingConn struct {
+	c      *recordingConnector
+	execs  []string
+	closed bool
+}
+
+func (*recordingConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("unexpected prepared statement")
+}
+func (conn *recordingConn) Close() error              { conn.closed = true; return nil }
+func (conn *recordingConn) Begin() (driver.Tx, error) { return conn, nil }
+func (*recordingConn) Commit() error                  { return nil }
+func (*recordingConn) Rollback() error                { return nil }
+
+func (conn *recordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	conn.execs = append(conn.execs, query)
+	if conn.c.failOn != "" && strings.Contains(query, conn.c.failOn) {
+		return nil, errors.New("access denied")
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func TestConnManagerCheckout(t *testing.T) {
+	connector := &recordingConnector{}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	m := &connManager{db: db, session: SessionConfig{DisableUniqueChecks: true, LockWaitTimeout: 10}}
+	want := []string{"SET SESSION unique_checks = 0, innodb_lock_wait_timeout = 10"}
+
+	// the pool hands the same connection out again, configured again
+	for i := 0; i < 2; i++ {
+		conn, err := m.checkout(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if len(connector.conns) != 1 {
+		t.Fatalf("%d connections opened, want 1", len(connector.conns))
+	}
+	if got := connector.conns[0].execs; !reflect.DeepEqual(got, append(want, want...)) {
+		t.Errorf("executed %q", got)
+	}
+}
+
+func TestConnManagerCheckoutFailed(t *testing.T) {
+	connector := &recordingConnector{failOn: "sql_log_bin"}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	m := &connManager{db: db, session: SessionConfig{DisableBinlog: true}}
+
+	conn, err := m.checkout(context.Background())
+	if err == nil {
+		conn.Close()
+		t.Fatal("checkout succeeded without the session variables")
+	}
+	if !strings.Contains(err.Error(), "sql_log_bin = 0") || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("unexpected error %v", err)
+	}
+	// the connection was given back to the pool instead of leaking, closing the pool closes it
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(connector.conns) != 1 || !connector.conns[0].closed {
+		t.Error("the unconfigured connection was not closed")
+	}
+}
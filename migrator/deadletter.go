@@ -0,0 +1,172 @@
+package migrator
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysql errors caused by the values of a row rather than by the batch or the connection, under a
+// strict sql_mode. the rows of a batch failing with one of them are inserted again one half at a time,
+// and the rows still rejected on their own go to the table's dead letter file.
+var rowMySQLErrors = map[uint16]bool{
+	1048: true, // ER_BAD_NULL_ERROR
+	1264: true, // ER_WARN_DATA_OUT_OF_RANGE
+	1265: true, // WARN_DATA_TRUNCATED
+	1292: true, // ER_TRUNCATED_WRONG_VALUE
+	1366: true, // ER_TRUNCATED_WRONG_VALUE_FOR_FIELD
+	1367: true, // ER_ILLEGAL_VALUE_FOR_TYPE
+	1406: true, // ER_DATA_TOO_LONG
+	1411: true, // ER_WRONG_VALUE_FOR_TYPE
+	1452: true, // ER_NO_REFERENCED_ROW_2
+	1690: true, // ER_DATA_OUT_OF_RANGE
+	3819: true, // ER_CHECK_CONSTRAINT_VIOLATED
+}
+
+func isRowError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && rowMySQLErrors[mysqlErr.Number]
+}
+
+// the message of the mysql error of a rejected row
+func rowErrorMessage(err error) string {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Error()
+	}
+	return err.Error()
+}
+
+// a row the target rejected, kept until the transaction it was left out of commits
+type rejectedRow struct {
+	line []byte // the line of the csv, without its line ending
+	err  string
+}
+
+// the dead letter file of a table: the rejected lines exactly as they were in the csv, each followed
+// by the error as one more, quoted, field
+type deadLetterFile struct {
+	path    string
+	columns []string
+	lock    sync.Mutex
+	count   int64 // rows written, including earlier runs, accessed atomically
+}
+
+// the dead letter file of a table, in the same layout as the checkpoints
+func (m *Migrator) deadLetterPath(src string, db string, table string) string {
+	return filepath.Join(m.settings.DeadLetterPath, src, db, table+".csv")
+}
+
+// open the dead letter file of a table. a table migrated from the start drops the file of an
+// earlier migration, a resumed one appends to it.
+func (m *Migrator) openDeadLetters(src string, db string, table string, columnNames []string, fresh bool) (*deadLetterFile, error) {
+	f := &deadLetterFile{path: m.deadLetterPath(src, db, table), columns: columnNames}
+	if fresh {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return f, nil
+	}
+	lines, err := countLines(f.path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed reading dead letter file: %w", err)
+	}
+	if lines > 0 {
+		f.count = lines - 1 // the header
+	}
+	return f, nil
+}
+
+func (f *deadLetterFile) rows() int64 {
+	return atomic.LoadInt64(&f.count)
+}
+
+// append rows to the file, creating it with a header first
+func (f *deadLetterFile) write(rows []rejectedRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	_, err := os.Stat(f.path)
+	header := os.IsNotExist(err)
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	var buf []byte
+	if header {
+		buf = append(buf, strings.Join(f.columns, ",")...)
+		buf = append(buf, ",error\n"...)
+	}
+	for _, row := range rows {
+		buf = append(buf, row.line...)
+		buf = append(buf, ",\""...)
+		buf = append(buf, strings.Replace(row.err, "\"", "\"\"", -1)...)
+		buf = append(buf, "\"\n"...)
+	}
+	if _, err = file.Write(buf); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	atomic.AddInt64(&f.count, int64(len(rows)))
+	return nil
+}
+
+// insert the rows [from, to) of a batch that failed with a row error, one half at a time down to
+// the rows the target rejects on their own, which are added to rejected.
+// fails once the rejected rows of the table would go over Settings.DeadLetterLimit.
+func (job *tableJob) insertIsolatingRejected(tx *sql.Tx, b *parsedBatch, from int, to int, err error, rejected *[]rejectedRow) (int64, error) {
+	if to-from == 1 {
+		limit := int64(job.m.settings.DeadLetterLimit)
+		if n := job.deadLetters.rows() + int64(len(*rejected)) + 1; n > limit {
+			return 0, fmt.Errorf("%d rows rejected by the target, more than the dead letter limit of %d: %w", n, limit, err)
+		}
+		line := bytes.TrimSuffix(bytes.TrimSuffix(b.line(from), []byte{'\n'}), []byte{'\r'})
+		*rejected = append(*rejected, rejectedRow{line: append([]byte(nil), line...), err: rowErrorMessage(err)})
+		return 0, nil
+	}
+	mid := from + (to-from)/2
+	var rowsAffected int64
+	for _, half := range [][2]int{{from, mid}, {mid, to}} {
+		n, err := job.insertRows(tx, b, half[0], half[1])
+		if isRowError(err) {
+			n, err = job.insertIsolatingRejected(tx, b, half[0], half[1], err, rejected)
+		}
+		if err != nil {
+			return rowsAffected, err
+		}
+		rowsAffected += n
+	}
+	return rowsAffected, nil
+}
+
+// insert the rows [from, to) of a batch on their own. a failed statement is rolled back by the
+// server without the rest of the transaction.
+// the rows are sent as literals: the halves have every possible size, each would need a statement
+// prepared for it.
+func (job *tableJob) insertRows(tx *sql.Tx, b *parsedBatch, from int, to int) (int64, error) {
+	res, err := tx.Exec(string(job.stmts.appendLiteralInsert(nil, b.data, from, to)))
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, _ := res.RowsAffected()
+	return rowsAffected, nil
+}
@@ -0,0 +1,165 @@
+package migrator
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Emanatry/tdsql-migrate-go/csvrow"
+	"github.com/go-sql-driver/mysql"
+)
+
+// a target that rejects every insert with a row containing a string starting with "bad", like a
+// strict server rejects a value too long for its column. it can't prepare statements.
+type rejectingConnector struct {
+	inserts int
+}
+
+var errTooLong = &mysql.MySQLError{Number: 1406, Message: `Data too long for column "name"`}
+
+func (c *rejectingConnector) Connect(context.Context) (driver.Conn, error) {
+	return rejectingConn{c}, nil
+}
+func (c *rejectingConnector) Driver() driver.Driver { return nil }
+
+type rejectingConn struct{ c *rejectingConnector }
+
+func (rejectingConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("unexpected prepared statement")
+}
+func (rejectingConn) Close() error              { return nil }
+func (rejectingConn) Begin() (driver.Tx, error) { return rejectingConn{}, nil }
+func (rejectingConn) Commit() error             { return nil }
+func (rejectingConn) Rollback() error           { return nil }
+
+func (conn rejectingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	values := query[strings.Index(query, " VALUES ")+len(" VALUES "):]
+	conn.c.inserts++
+	if strings.Contains(values, "'bad") {
+		return nil, errTooLong
+	}
+	return driver.RowsAffected(strings.Count(values, "),(") + 1), nil
+}
+
+// a batch of the lines of a table (id int, name varchar)
+func rejectingTestBatch(t *testing.T, lines []string) *parsedBatch {
+	t.Helper()
+	b := &parsedBatch{data: csvrow.NewBatch([]csvrow.Kind{csvrow.KindInt, csvrow.KindBytes}, time.UTC)}
+	for _, line := range lines {
+		if err := b.data.AppendLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		b.lines = append(b.lines, line...)
+		b.lineEnds = append(b.lineEnds, len(b.lines))
+		b.rows++
+	}
+	return b
+}
+
+func TestInsertIsolatingRejected(t *testing.T) {
+	lines := []string{"1,a\n", "2,bad\n", "3,c\n", "4,d\n", "5,bad \"x\"\r\n", "6,f\n", "7,g\n"}
+	tests := []struct {
+		name         string
+		limit        int
+		wantRejected []string
+		wantRows     int64
+		wantErr      bool
+	}{
+		{"rejected rows isolated", 10, []string{"2,bad", `5,bad "x"`}, 5, false},
+		{"over the limit", 1, nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			settings := DefaultSettings()
+			settings.DeadLetterLimit = tt.limit
+			settings.DeadLetterPath = dir
+			m := &Migrator{settings: settings}
+			columns := []string{"id", "name"}
+			deadLetters, err := m.openDeadLetters("src_a", "db1", "1", columns, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			job := &tableJob{m: m, columnNames: columns, stmts: newStmtCache(nil, "db1", "1", columns, CONFLICT_IGNORE, false), deadLetters: deadLetters}
+
+			connector := &rejectingConnector{}
+			db := sql.OpenDB(connector)
+			defer db.Close()
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+
+			b := rejectingTestBatch(t, lines)
+			var rejected []rejectedRow
+			rowsAffected, err := job.insertIsolatingRejected(tx, b, 0, b.rows, errTooLong, &rejected)
+			if tt.wantErr {
+				if !errors.Is(err, errTooLong) {
+					t.Fatalf("got %v, want the rejection over the limit", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, row := range rejected {
+				got = append(got, string(row.line))
+			}
+			if !reflect.DeepEqual(got, tt.wantRejected) || rowsAffected != tt.wantRows {
+				t.Fatalf("rejected %q with %d rows inserted, want %q with %d", got, rowsAffected, tt.wantRejected, tt.wantRows)
+			}
+			// the halves of 3 and 4 rows fail, then [0,1) [1,3) [1,2) [2,3) and [3,5) [3,4) [4,5) [5,7)
+			if connector.inserts != 10 {
+				t.Errorf("%d inserts, want 10", connector.inserts)
+			}
+		})
+	}
+}
+
+func TestDeadLetterFile(t *testing.T) {
+	settings := DefaultSettings()
+	settings.DeadLetterLimit = 10
+	settings.DeadLetterPath = t.TempDir()
+	m := &Migrator{settings: settings}
+	columns := []string{"id", "name"}
+	f, err := m.openDeadLetters("src_a", "db1", "1", columns, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the lines are kept as they are, even when they aren't valid csv
+	rows := []rejectedRow{{line: []byte(`2,bad "x`), err: errTooLong.Error()}, {line: []byte("5, bad,"), err: "too long"}}
+	if err := f.write(rows[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.write(rows[1:]); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(settings.DeadLetterPath, "src_a", "db1", "1.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "id,name,error\n" +
+		`2,bad "x,"Error 1406: Data too long for column ""name"""` + "\n" +
+		`5, bad,,"too long"` + "\n"
+	if string(content) != want {
+		t.Errorf("got\n%s\nwant\n%s", content, want)
+	}
+
+	// a resumed table counts the rows written before
+	resumed, err := m.openDeadLetters("src_a", "db1", "1", columns, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.rows() != 2 {
+		t.Errorf("resumed with %d rows, want 2", resumed.rows())
+	}
+}
@@ -1,7 +1,6 @@
 package migrator
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 	"strings"
@@ -9,7 +8,8 @@ import (
 	"github.com/Emanatry/tdsql-migrate-go/srcreader"
 )
 
-func checkAndCreatePKForDedup(db *sql.DB, srcdb *srcreader.SrcDatabase, tablename string, columnNames []string) error {
+func (m *Migrator) checkAndCreatePKForDedup(srcdb *srcreader.SrcDatabase, tablename string, columnNames []string) error {
+	db := m.db
 	// primary key detection
 	/*
 		> 如果有主键或者非空唯一索引，唯一索引相同的情况下，以行updated_at时间戳来判断是否覆盖数据，如果updated_at比原来的数据更新，那么覆盖数据；否则忽略数据。不存在主键相同，updated_at时间戳相同，但数据不同的情况。
@@ -21,9 +21,10 @@ func checkAndCreatePKForDedup(db *sql.DB, srcdb *srcreader.SrcDatabase, tablenam
 	if err != nil {
 		return errors.New("failed reading primary key: " + err.Error())
 	}
+	defer indres.Close()
 	cols, err := indres.Columns()
 	if err != nil {
-		panic(err)
+		return errors.New("failed reading the columns of the indexes: " + err.Error())
 	}
 	dest := make([]interface{}, len(cols)) // A temporary interface{} slice
 	var discardedBytes []byte
@@ -46,7 +47,7 @@ func checkAndCreatePKForDedup(db *sql.DB, srcdb *srcreader.SrcDatabase, tablenam
 			return errors.New("failed to scan while showing index: " + err.Error())
 		}
 		if !nonUnique {
-			fmt.Printf("found unique index for %s.%s: %s\n", srcdb.Name, tablename, keyName)
+			m.tableLog(srcdb, tablename, "").Infof("found unique index %s", keyName)
 			hasUniqueIndex = true
 			break
 		}
@@ -61,13 +62,13 @@ func checkAndCreatePKForDedup(db *sql.DB, srcdb *srcreader.SrcDatabase, tablenam
 	}
 	keyColumnsStr := strings.Join(columnNamesMinusUpdatedAt, ", ")
 	if !hasUniqueIndex { // add a temporary primary key of all columns for deduplication if no pre-existing unique key was found
-		fmt.Printf("* %s.%s doesn't have a unique key, creating one (%s) for deduplication purposes\n", srcdb.Name, tablename, keyColumnsStr)
+		m.tableLog(srcdb, tablename, "").Infof("no unique key, creating one (%s) for deduplication purposes", keyColumnsStr)
 		_, err = db.Exec(fmt.Sprintf("ALTER TABLE `%s`.`%s` ADD PRIMARY KEY (%s);", srcdb.Name, tablename, keyColumnsStr))
 		if err != nil {
 			return errors.New("failed adding temp primary key: " + err.Error())
 		}
 	} else {
-		fmt.Printf("* %s.%s has unique key.\n", srcdb.Name, tablename)
+		m.tableLog(srcdb, tablename, "").Infof("has a unique key")
 	}
 	return nil
 }
@@ -0,0 +1,370 @@
+package migrator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Emanatry/tdsql-migrate-go/csvrow"
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+)
+
+// kinds of RowDiff
+const (
+	DIFF_MISSING = "missing" // in the merged csv, not in the target
+	DIFF_EXTRA   = "extra"   // in the target, not in the merged csv
+	DIFF_CHANGED = "changed" // same key, different values
+)
+
+// a column of a changed row, the values rendered as in the checksums
+type ColumnDiff struct {
+	Column   string
+	Expected string // from the merged csv
+	Actual   string // in the target
+}
+
+// a row of a chunk that doesn't match between the merged csv and the target
+type RowDiff struct {
+	Kind    string
+	Key     string // "id=1, a=2.5000"
+	Line    int    // line of the merged csv, 0 for DIFF_EXTRA
+	Values  []string
+	Columns []ColumnDiff // DIFF_CHANGED only
+	// statements that make the target row match the merged csv, for the mysql client with any sql_mode
+	RepairSQL string
+}
+
+func (d RowDiff) String() string {
+	switch d.Kind {
+	case DIFF_MISSING:
+		return fmt.Sprintf("missing line %d %s: %s", d.Line, d.Key, strings.Join(d.Values, ","))
+	case DIFF_EXTRA:
+		return fmt.Sprintf("extra %s: %s", d.Key, strings.Join(d.Values, ","))
+	}
+	var cols []string
+	for _, c := range d.Columns {
+		cols = append(cols, fmt.Sprintf("%s: %q -> %q", c.Column, c.Expected, c.Actual))
+	}
+	return fmt.Sprintf("changed line %d %s: %s", d.Line, d.Key, strings.Join(cols, ", "))
+}
+
+// a row of either side, rendered the same way as for the checksums
+type diffRow struct {
+	key    uint64   // ordinal of the first column, see parseChunkKey
+	values []string // canonical values
+	raw    []string // the csv fields, nil for the target
+	line   int
+}
+
+// compare the rows of a mismatched chunk of c, from VerifyChecksums, one key of the first column at a
+// time: both sides are read in the order of the first column, and the rows of the same key are
+// matched on the key columns of the merged csv (see srcreader.SrcDatabase.KeyColumns).
+// onDiff is called for every row that differs, in key order.
+func (m *Migrator) DiffChunk(ctx context.Context, c TableChecksum, chunk ChunkChecksum, onDiff func(RowDiff) error) error {
+	if m.db == nil {
+		return errNoTarget
+	}
+	dba, dbb := m.sourceDatabases(c.Database)
+	if dba == nil {
+		return fmt.Errorf("no database %s in the sources", c.Database)
+	}
+	csvPath, ok := srcreader.MergedTablePath(dba, dbb, c.Table)
+	if !ok {
+		return fmt.Errorf("%s.%s hasn't been merged", c.Database, c.Table)
+	}
+	keyColumns, err := dba.KeyColumns(c.Table)
+	if err != nil {
+		return err
+	}
+	cols, err := m.checksumColumns(c.Database, c.Table)
+	if err != nil {
+		return err
+	}
+	key := cols[0]
+	if key.kind != csvrow.KindInt && key.kind != csvrow.KindUint {
+		return fmt.Errorf("can't diff %s.%s, its first column `%s` isn't an integer", c.Database, c.Table, key.name)
+	}
+	var upto uint64
+	if chunk.Upto != "" {
+		if upto, _, err = parseChunkKey(key.kind, []byte(chunk.Upto)); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(csvPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Seek(chunk.Start, io.SeekStart); err != nil {
+		return err
+	}
+	src := &csvRows{r: bufio.NewReaderSize(f, 1024*1024), path: csvPath, line: chunk.Line - 1, cols: cols, upto: upto, bounded: chunk.Upto != ""}
+
+	exprs := make([]string, len(cols))
+	for i, col := range cols {
+		exprs[i] = col.expr()
+	}
+	query := fmt.Sprintf("SELECT %s FROM `%s`.`%s`%s ORDER BY `%s`;", strings.Join(exprs, ", "), c.Database, c.Table, chunk.where(key.name), key.name)
+	// same session as the loaders, for the time_zone of TIMESTAMP values
+	conn, err := m.conns.checkout(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed reading %s.%s chunk %d: %w", c.Database, c.Table, chunk.Index, err)
+	}
+	defer rows.Close()
+	dst := &targetRows{rows: rows, cols: cols}
+
+	d := &differ{table: fmt.Sprintf("`%s`.`%s`", c.Database, c.Table), cols: cols, keyColumns: keyColumns, onDiff: onDiff}
+	a, err := src.next()
+	if err != nil {
+		return err
+	}
+	b, err := dst.next()
+	if err != nil {
+		return err
+	}
+	for a != nil || b != nil {
+		if ctx.Err() != nil {
+			return ErrInterrupted
+		}
+		var expected, actual []*diffRow
+		if a != nil && (b == nil || a.key <= b.key) {
+			if expected, a, err = group(a, src.next); err != nil {
+				return err
+			}
+		}
+		if b != nil && (len(expected) == 0 || b.key == expected[0].key) {
+			if actual, b, err = group(b, dst.next); err != nil {
+				return err
+			}
+		}
+		if err = d.compare(expected, actual); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the statements a repair script starts with: the time_zone and sql_mode of the loaders' sessions, as
+// the literals of RowDiff.RepairSQL are the values of the csv, read the same way the loaders' were
+func (m *Migrator) RepairSession(ctx context.Context) ([]string, error) {
+	if m.db == nil {
+		return nil, errNoTarget
+	}
+	var timeZone, sqlMode string
+	if err := m.queryRowSession(ctx, "SELECT @@session.time_zone, @@session.sql_mode;", &timeZone, &sqlMode); err != nil {
+		return nil, fmt.Errorf("failed reading the session's time_zone and sql_mode: %w", err)
+	}
+	return []string{
+		"SET SESSION time_zone = " + sqlLiteral(timeZone) + ";",
+		"SET SESSION sql_mode = " + sqlLiteral(sqlMode) + ";",
+	}, nil
+}
+
+// the source databases of both sources with that name
+func (m *Migrator) sourceDatabases(dbname string) (*srcreader.SrcDatabase, *srcreader.SrcDatabase) {
+	for i, dba := range m.srca.Databases {
+		if dba.Name == dbname {
+			return dba, m.srcb.Databases[i]
+		}
+	}
+	return nil, nil
+}
+
+// the rows with the same key as first, and the row after them
+func group(first *diffRow, next func() (*diffRow, error)) ([]*diffRow, *diffRow, error) {
+	rows := []*diffRow{first}
+	for {
+		row, err := next()
+		if err != nil || row == nil || row.key != first.key {
+			return rows, row, err
+		}
+		rows = append(rows, row)
+	}
+}
+
+// the lines of a chunk of the merged csv
+type csvRows struct {
+	r       *bufio.Reader
+	path    string
+	line    int
+	cols    []checksumColumn
+	upto    uint64
+	bounded bool
+	done    bool
+}
+
+func (s *csvRows) next() (*diffRow, error) {
+	for !s.done {
+		line, err := s.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		s.done = err == io.EOF
+		if len(line) > 0 {
+			s.line++
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		fields := bytes.Split(line, []byte{','})
+		if len(fields) != len(s.cols) {
+			return nil, fmt.Errorf("%s line %d: %w", s.path, s.line, &csvrow.FieldCountError{Expected: len(s.cols), Got: len(fields)})
+		}
+		row := &diffRow{line: s.line}
+		for i, f := range fields {
+			v, err := s.cols[i].appendCanonical(nil, f)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %w", s.path, s.line, &csvrow.FieldError{Field: i, Value: string(f), Err: err})
+			}
+			row.values = append(row.values, string(v))
+			row.raw = append(row.raw, string(f))
+		}
+		if row.key, _, err = parseChunkKey(s.cols[0].kind, fields[0]); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", s.path, s.line, err)
+		}
+		if s.bounded && row.key > s.upto { // the start of the next chunk
+			s.done = true
+			break
+		}
+		return row, nil
+	}
+	return nil, nil
+}
+
+// the rows of a chunk of the target, in the order of the first column
+type targetRows struct {
+	rows *sql.Rows
+	cols []checksumColumn
+}
+
+func (t *targetRows) next() (*diffRow, error) {
+	if !t.rows.Next() {
+		return nil, t.rows.Err()
+	}
+	values := make([]sql.NullString, len(t.cols))
+	dest := make([]interface{}, len(t.cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := t.rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	row := &diffRow{}
+	for _, v := range values {
+		row.values = append(row.values, v.String) // NULL as ""
+	}
+	var err error
+	if row.key, _, err = parseChunkKey(t.cols[0].kind, []byte(row.values[0])); err != nil {
+		return nil, fmt.Errorf("unexpected key %q in the target: %w", row.values[0], err)
+	}
+	return row, nil
+}
+
+type differ struct {
+	table      string
+	cols       []checksumColumn
+	keyColumns []int
+	onDiff     func(RowDiff) error
+}
+
+// compare the rows of the same key of the first column, either side can be empty
+func (d *differ) compare(expected []*diffRow, actual []*diffRow) error {
+	byKey := map[string][]*diffRow{}
+	for _, row := range actual {
+		k := d.key(row)
+		byKey[k] = append(byKey[k], row)
+	}
+	matched := map[*diffRow]bool{}
+	for _, row := range expected {
+		k := d.key(row)
+		candidates := byKey[k]
+		if len(candidates) == 0 {
+			err := d.onDiff(RowDiff{Kind: DIFF_MISSING, Key: k, Line: row.line, Values: row.raw, RepairSQL: d.insert(row)})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		target := candidates[0]
+		byKey[k] = candidates[1:]
+		matched[target] = true
+		var changed []ColumnDiff
+		for i, col := range d.cols {
+			if row.values[i] != target.values[i] {
+				changed = append(changed, ColumnDiff{Column: col.name, Expected: row.values[i], Actual: target.values[i]})
+			}
+		}
+		if len(changed) > 0 {
+			err := d.onDiff(RowDiff{Kind: DIFF_CHANGED, Key: k, Line: row.line, Values: row.raw, Columns: changed, RepairSQL: d.delete(target) + "\n" + d.insert(row)})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, row := range actual {
+		if matched[row] {
+			continue
+		}
+		if err := d.onDiff(RowDiff{Kind: DIFF_EXTRA, Key: d.key(row), Values: row.values, RepairSQL: d.delete(row)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// "id=1, a=2.5000"
+func (d *differ) key(row *diffRow) string {
+	parts := make([]string, len(d.keyColumns))
+	for i, c := range d.keyColumns {
+		parts[i] = d.cols[c].name + "=" + row.values[c]
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (d *differ) insert(row *diffRow) string {
+	names := make([]string, len(d.cols))
+	values := make([]string, len(d.cols))
+	for i, col := range d.cols {
+		names[i] = "`" + col.name + "`"
+		values[i] = sqlLiteral(row.raw[i])
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s);", d.table, strings.Join(names, ", "), strings.Join(values, ", "))
+}
+
+// the key columns are compared the way they are rendered, so that a float matches what was shown
+func (d *differ) delete(row *diffRow) string {
+	conds := make([]string, len(d.keyColumns))
+	for i, c := range d.keyColumns {
+		col := d.cols[c]
+		value := sqlLiteral(row.values[c])
+		if col.kind == csvrow.KindInt || col.kind == csvrow.KindUint {
+			value = row.values[c] // unquoted, a quoted big integer would be compared as a double
+		}
+		conds[i] = col.expr() + " = " + value
+	}
+	return fmt.Sprintf("DELETE FROM %s WHERE %s LIMIT 1;", d.table, strings.Join(conds, " AND "))
+}
+
+// a string literal that means the same with and without NO_BACKSLASH_ESCAPES:
+// quotes are doubled, and strings with backslashes or control characters are written in hex
+func sqlLiteral(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' || s[i] < 0x20 {
+			return "X'" + hex.EncodeToString([]byte(s)) + "'"
+		}
+	}
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
@@ -0,0 +1,154 @@
+package migrator
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Emanatry/tdsql-migrate-go/csvrow"
+)
+
+// a table (id int, a double, name varchar) deduplicated on (id, a)
+var diffTestColumns = []checksumColumn{
+	{name: "id", kind: csvrow.KindInt, dataType: "int"},
+	{name: "a", kind: csvrow.KindFloat, dataType: "double", scale: FLOAT_CHECKSUM_SCALE},
+	{name: "name", kind: csvrow.KindBytes, dataType: "varchar"},
+}
+
+// the rows of the merged csv content
+func csvDiffRows(t *testing.T, content string) []*diffRow {
+	t.Helper()
+	src := &csvRows{r: bufio.NewReader(strings.NewReader(content)), path: "1.csv", cols: diffTestColumns}
+	var rows []*diffRow
+	for {
+		row, err := src.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row == nil {
+			return rows
+		}
+		rows = append(rows, row)
+	}
+}
+
+// a row of the target, its values as the expressions of diffTestColumns render them
+func targetDiffRow(key uint64, values ...string) *diffRow {
+	return &diffRow{key: key, values: values}
+}
+
+func TestDifferCompare(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		actual   []*diffRow
+		want     []string // RowDiff.String() and RepairSQL of every diff
+	}{
+		{"same rows", "1,0.5,a\n1,1.5,b\n", []*diffRow{
+			targetDiffRow(1, "1", "1.5000", "b"),
+			targetDiffRow(1, "1", "0.5000", "a"),
+		}, nil},
+		{"missing row", "1,0.5,a\n1,1.5,it's\n", []*diffRow{
+			targetDiffRow(1, "1", "0.5000", "a"),
+		}, []string{
+			"missing line 2 id=1, a=1.5000: 1,1.5,it's",
+			"INSERT INTO `db1`.`1` (`id`, `a`, `name`) VALUES ('1', '1.5', 'it''s');",
+		}},
+		{"extra row", "1,0.5,a\n", []*diffRow{
+			targetDiffRow(1, "1", "0.5000", "a"),
+			targetDiffRow(1, "1", "2.0000", "x"),
+		}, []string{
+			"extra id=1, a=2.0000: 1,2.0000,x",
+			"DELETE FROM `db1`.`1` WHERE `id` = 1 AND CAST(`a` AS DECIMAL(65,4)) = '2.0000' LIMIT 1;",
+		}},
+		{"changed row", "1,0.5,a\n", []*diffRow{
+			targetDiffRow(1, "1", "0.5000", "b"),
+		}, []string{
+			`changed line 1 id=1, a=0.5000: name: "a" -> "b"`,
+			"DELETE FROM `db1`.`1` WHERE `id` = 1 AND CAST(`a` AS DECIMAL(65,4)) = '0.5000' LIMIT 1;\n" +
+				"INSERT INTO `db1`.`1` (`id`, `a`, `name`) VALUES ('1', '0.5', 'a');",
+		}},
+		{"duplicate keys matched one to one", "1,0.5,a\n1,0.5,b\n1,0.5,c\n", []*diffRow{
+			targetDiffRow(1, "1", "0.5000", "a"),
+			targetDiffRow(1, "1", "0.5000", "a"),
+		}, []string{
+			`changed line 2 id=1, a=0.5000: name: "b" -> "a"`,
+			"DELETE FROM `db1`.`1` WHERE `id` = 1 AND CAST(`a` AS DECIMAL(65,4)) = '0.5000' LIMIT 1;\n" +
+				"INSERT INTO `db1`.`1` (`id`, `a`, `name`) VALUES ('1', '0.5', 'b');",
+			"missing line 3 id=1, a=0.5000: 1,0.5,c",
+			"INSERT INTO `db1`.`1` (`id`, `a`, `name`) VALUES ('1', '0.5', 'c');",
+		}},
+		{"only in the csv", "2,1,a\n2,2,b\n", nil, []string{
+			"missing line 1 id=2, a=1.0000: 2,1,a",
+			"INSERT INTO `db1`.`1` (`id`, `a`, `name`) VALUES ('2', '1', 'a');",
+			"missing line 2 id=2, a=2.0000: 2,2,b",
+			"INSERT INTO `db1`.`1` (`id`, `a`, `name`) VALUES ('2', '2', 'b');",
+		}},
+		{"only in the target", "", []*diffRow{
+			targetDiffRow(3, "3", "0.0000", "a\\b"),
+		}, []string{
+			`extra id=3, a=0.0000: 3,0.0000,a\b`,
+			"DELETE FROM `db1`.`1` WHERE `id` = 3 AND CAST(`a` AS DECIMAL(65,4)) = '0.0000' LIMIT 1;",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			d := &differ{table: "`db1`.`1`", cols: diffTestColumns, keyColumns: []int{0, 1}, onDiff: func(diff RowDiff) error {
+				got = append(got, diff.String(), diff.RepairSQL)
+				return nil
+			}}
+			if err := d.compare(csvDiffRows(t, tt.expected), tt.actual); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestDifferDeleteQuoting(t *testing.T) {
+	cols := []checksumColumn{
+		{name: "id", kind: csvrow.KindUint, dataType: "bigint"},
+		{name: "n", kind: csvrow.KindInt, dataType: "int"},
+		{name: "f", kind: csvrow.KindFloat, dataType: "double", scale: FLOAT_CHECKSUM_SCALE},
+		{name: "s", kind: csvrow.KindBytes, dataType: "varchar"},
+	}
+	d := &differ{table: "`db1`.`1`", cols: cols, keyColumns: []int{0, 1, 2, 3}}
+	got := d.delete(targetDiffRow(1, "18446744073709551615", "-5", "1.5000", "12"))
+	// integers unquoted, a quoted big integer would be compared as a double
+	want := "DELETE FROM `db1`.`1` WHERE `id` = 18446744073709551615 AND `n` = -5 AND " +
+		"CAST(`f` AS DECIMAL(65,4)) = '1.5000' AND `s` = '12' LIMIT 1;"
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestSQLLiteral(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"", "''"},
+		{"abc", "'abc'"},
+		{"it's", "'it''s'"},
+		{"''", "''''''"},
+		{`"quoted"`, `'"quoted"'`},
+		{"中文", "'中文'"},
+		// the same with and without NO_BACKSLASH_ESCAPES
+		{`a\b`, "X'615c62'"},
+		{`\'`, "X'5c27'"},
+		{"a\tb", "X'610962'"},
+		{"line\n", "X'6c696e650a'"},
+		{"\x00", "X'00'"},
+		{"\x1f", "X'1f'"},
+		{"\x7f", "'\x7f'"},
+	}
+	for _, tt := range tests {
+		if got := sqlLiteral(tt.s); got != tt.want {
+			t.Errorf("sqlLiteral(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package migrator
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Emanatry/tdsql-migrate-go/logging"
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+)
+
+// phases of a table migration, reported in TableError
+const (
+	PhaseCreateTable   = "create_table"
+	PhasePresort       = "presort"
+	PhaseDetectColumns = "detect_columns"
+	PhaseCheckpoint    = "checkpoint"
+	PhaseLoad          = "load"
+	PhaseIndex         = "index"
+)
+
+// the failure of a single table
+type TableError struct {
+	Source   string
+	Database string
+	Table    string
+	Phase    string
+	Err      error
+}
+
+func (e *TableError) Error() string {
+	return fmt.Sprintf("%s %s.%s failed in phase %s: %s", e.Source, e.Database, e.Table, e.Phase, e.Err.Error())
+}
+
+func (e *TableError) Unwrap() error {
+	return e.Err
+}
+
+// tag err with the table and the phase it happened in.
+// ErrInterrupted and errors that are already tagged are returned as is.
+func newTableError(srcdb *srcreader.SrcDatabase, table string, phase string, err error) error {
+	if err == nil || errors.Is(err, ErrInterrupted) {
+		return err
+	}
+	var tableErr *TableError
+	if errors.As(err, &tableErr) {
+		return err
+	}
+	return &TableError{Source: srcdb.SrcName, Database: srcdb.Name, Table: table, Phase: phase, Err: err}
+}
+
+// when withRetry gives up on a tagged error, move the tag back to the outside so that the
+// table and phase are still found first.
+func liftTableError(err error) error {
+	var exhausted *retriesExhaustedError
+	var tableErr *TableError
+	if errors.As(err, &exhausted) && errors.As(exhausted.err, &tableErr) {
+		exhausted.err = tableErr.Err
+		tableErr.Err = exhausted
+		return tableErr
+	}
+	return err
+}
+
+// returned by Run, lists every table that failed.
+// errors.Is(err, ErrInterrupted) reports whether the run was also interrupted by a signal.
+type MigrationError struct {
+	Failed      []*TableError
+	Interrupted bool
+}
+
+func (e *MigrationError) Error() string {
+	var str strings.Builder
+	str.WriteString(fmt.Sprintf("%d table(s) failed", len(e.Failed)))
+	if e.Interrupted {
+		str.WriteString(" (migration interrupted)")
+	}
+	str.WriteString(":")
+	for _, tableErr := range e.Failed {
+		str.WriteString("\n - ")
+		str.WriteString(tableErr.Error())
+	}
+	return str.String()
+}
+
+func (e *MigrationError) Is(target error) bool {
+	return target == ErrInterrupted && e.Interrupted
+}
+
+// the outcome of a table in Run
+type TableResult struct {
+	Source   string
+	Database string
+	Table    string
+	State    string // StateFinished, StateFailed, or StateLoading / StatePending when stopped before finishing
+	Err      *TableError
+
+	// of this run, 0 for a table finished by an earlier run
+	Rows     int64 // rows affected
+	Lines    int64 // csv lines loaded
+	Duration time.Duration
+	Resumed  bool // continued from the checkpoints of an earlier run
+
+	// rows rejected by the target so far, including earlier runs, see Settings.DeadLetterLimit
+	DeadLetters    int64
+	DeadLetterFile string
+}
+
+type Result struct {
+	Tables      []TableResult
+	Interrupted bool
+}
+
+// number of tables in the given state
+func (r *Result) Count(state string) int {
+	n := 0
+	for _, t := range r.Tables {
+		if t.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+// collects the outcome of every table in a migration run
+type outcomes struct {
+	lock   sync.Mutex
+	log    *logging.Logger
+	tables []TableResult
+	failed []*TableError
+	skip   map[string]bool // tables that failed before loading started, e.g. in create_table
+}
+
+func newOutcomes(log *logging.Logger) *outcomes {
+	return &outcomes{log: log, skip: make(map[string]bool)}
+}
+
+// record the result of a table, job is nil if the table wasn't prepared
+func (o *outcomes) record(srcdb *srcreader.SrcDatabase, table string, phase string, err error, job *tableJob) TableResult {
+	r := TableResult{Source: srcdb.SrcName, Database: srcdb.Name, Table: table, State: StateFinished, Resumed: job == nil}
+	if job != nil {
+		r.Rows = atomic.LoadInt64(&job.totalRows)
+		r.Lines = atomic.LoadInt64(&job.totalLines)
+		r.Duration = time.Since(job.started)
+		r.Resumed = job.isResumed
+		if job.deadLetters != nil {
+			r.DeadLetters = job.deadLetters.rows()
+			r.DeadLetterFile = job.deadLetters.path
+		}
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrInterrupted):
+		r.State = StatePending
+		if job != nil {
+			r.State = StateLoading
+		}
+		r.Resumed = job != nil && job.isResumed
+	default:
+		var tableErr *TableError
+		if !errors.As(err, &tableErr) {
+			tableErr = &TableError{Source: srcdb.SrcName, Database: srcdb.Name, Table: table, Phase: phase, Err: err}
+		}
+		r.State = StateFailed
+		r.Err = tableErr
+		r.Resumed = job != nil && job.isResumed
+		o.failed = append(o.failed, tableErr)
+		o.log.With("source", tableErr.Source, "db", tableErr.Database, "table", tableErr.Table, "phase", tableErr.Phase).Errorf("table failed: %s", tableErr.Err.Error())
+	}
+	o.tables = append(o.tables, r)
+	return r
+}
+
+func (o *outcomes) skipTable(srcdb *srcreader.SrcDatabase, table string) {
+	o.lock.Lock()
+	o.skip[srcdb.Name+"."+table] = true
+	o.lock.Unlock()
+}
+
+func (o *outcomes) isSkipped(srcdb *srcreader.SrcDatabase, table string) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.skip[srcdb.Name+"."+table]
+}
+
+func (o *outcomes) result(interrupted bool) *Result {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return &Result{Tables: append([]TableResult(nil), o.tables...), Interrupted: interrupted}
+}
+
+// nil if every table succeeded, otherwise ErrInterrupted or a *MigrationError
+func (o *outcomes) err(interrupted bool) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.failed) == 0 {
+		if interrupted {
+			return ErrInterrupted
+		}
+		return nil
+	}
+	return &MigrationError{Failed: o.failed, Interrupted: interrupted}
+}
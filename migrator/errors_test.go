@@ -0,0 +1,107 @@
+package migrator
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Emanatry/tdsql-migrate-go/logging"
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+)
+
+func TestNewTableError(t *testing.T) {
+	srcdb := &srcreader.SrcDatabase{SrcName: "src_a", Name: "db1"}
+	cause := errors.New("duplicate column")
+	err := newTableError(srcdb, "1", PhaseDetectColumns, cause)
+	var tableErr *TableError
+	if !errors.As(err, &tableErr) || tableErr.Phase != PhaseDetectColumns || !errors.Is(err, cause) {
+		t.Fatalf("got %#v", err)
+	}
+	if err.Error() != "src_a db1.1 failed in phase detect_columns: duplicate column" {
+		t.Errorf("got %q", err.Error())
+	}
+
+	// the phase it was tagged with first is kept
+	wrapped := fmt.Errorf("loading: %w", err)
+	if again := newTableError(srcdb, "1", PhaseLoad, wrapped); again != wrapped {
+		t.Errorf("tagged again: %v", again)
+	}
+	if err := newTableError(srcdb, "1", PhaseLoad, ErrInterrupted); err != ErrInterrupted {
+		t.Errorf("interruption tagged: %v", err)
+	}
+	if err := newTableError(srcdb, "1", PhaseLoad, nil); err != nil {
+		t.Errorf("nil tagged: %v", err)
+	}
+}
+
+func TestMigrationError(t *testing.T) {
+	failed := []*TableError{
+		{Source: "src_a", Database: "db1", Table: "1", Phase: PhaseCreateTable, Err: errors.New("exists")},
+		{Source: "src_a", Database: "db2", Table: "3", Phase: PhaseLoad, Err: errors.New("gone away")},
+	}
+	err := &MigrationError{Failed: failed}
+	want := "2 table(s) failed:\n" +
+		" - src_a db1.1 failed in phase create_table: exists\n" +
+		" - src_a db2.3 failed in phase load: gone away"
+	if err.Error() != want {
+		t.Errorf("got\n%s\nwant\n%s", err.Error(), want)
+	}
+	if errors.Is(err, ErrInterrupted) {
+		t.Error("not interrupted, but Is(ErrInterrupted)")
+	}
+	err.Interrupted = true
+	if !errors.Is(err, ErrInterrupted) {
+		t.Error("interrupted, but not Is(ErrInterrupted)")
+	}
+}
+
+func TestOutcomes(t *testing.T) {
+	srcdb := &srcreader.SrcDatabase{SrcName: "src_a", Name: "db1"}
+	tests := []struct {
+		name        string
+		errs        []error // of tables 0, 1...
+		interrupted bool
+		failed      int
+		wantErr     error
+	}{
+		{"all finished", []error{nil, nil}, false, 0, nil},
+		{"interrupted", []error{nil, ErrInterrupted}, true, 0, ErrInterrupted},
+		{"failed", []error{errors.New("x"), nil, newTableError(srcdb, "2", PhaseIndex, errors.New("y"))}, false, 2, nil},
+		{"failed and interrupted", []error{errors.New("x"), ErrInterrupted}, true, 1, ErrInterrupted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOutcomes(logging.Discard())
+			for i, err := range tt.errs {
+				o.record(srcdb, fmt.Sprint(i), PhaseLoad, err, nil)
+			}
+			err := o.err(tt.interrupted)
+			var migrationErr *MigrationError
+			if tt.failed == 0 {
+				if err != tt.wantErr {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if !errors.As(err, &migrationErr) || len(migrationErr.Failed) != tt.failed {
+				t.Fatalf("got %v, want %d failed tables", err, tt.failed)
+			}
+			// untagged errors get the phase they were recorded in
+			if migrationErr.Failed[0].Phase != PhaseLoad || migrationErr.Failed[0].Table != "0" {
+				t.Errorf("first failure %+v", migrationErr.Failed[0])
+			}
+			if tt.failed > 1 && migrationErr.Failed[1].Phase != PhaseIndex {
+				t.Errorf("second failure %+v", migrationErr.Failed[1])
+			}
+			if errors.Is(err, ErrInterrupted) != (tt.wantErr == ErrInterrupted) {
+				t.Errorf("Is(ErrInterrupted) = %v", errors.Is(err, ErrInterrupted))
+			}
+		})
+	}
+
+	o := newOutcomes(logging.Discard())
+	o.skipTable(srcdb, "1")
+	if !o.isSkipped(srcdb, "1") || o.isSkipped(srcdb, "2") {
+		t.Error("skipped tables")
+	}
+}
@@ -0,0 +1,123 @@
+package migrator
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// remove the secondary (non-unique) index definitions from a CREATE TABLE statement, returns the
+// statement without them and the definitions removed, e.g. "KEY `idx_b` (`b`)".
+// primary, unique, fulltext and spatial keys are kept in place.
+func splitDeferredIndexes(sqlfile []byte) ([]byte, []string) {
+	lines := bytes.Split(sqlfile, []byte("\n"))
+	var kept [][]byte
+	var deferred []string
+	for _, line := range lines {
+		def := strings.TrimSuffix(strings.TrimSpace(string(line)), ",")
+		upper := strings.ToUpper(def)
+		if strings.HasPrefix(upper, "KEY ") || strings.HasPrefix(upper, "KEY(") ||
+			strings.HasPrefix(upper, "INDEX ") || strings.HasPrefix(upper, "INDEX(") {
+			deferred = append(deferred, def)
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if len(deferred) == 0 {
+		return sqlfile, nil
+	}
+	// the definition before the closing parenthesis can't keep its trailing comma
+	for i := 0; i+1 < len(kept); i++ {
+		if bytes.HasPrefix(bytes.TrimSpace(kept[i+1]), []byte(")")) {
+			kept[i] = bytes.TrimRight(kept[i], ", ")
+		}
+	}
+	return bytes.Join(kept, []byte("\n")), deferred
+}
+
+// the column names of an index definition, "KEY `idx` (`a`,`b`(10) DESC)" -> [a b]
+func indexColumns(def string) []string {
+	start := strings.Index(def, "(")
+	end := strings.LastIndex(def, ")")
+	if start < 0 || end <= start {
+		return nil
+	}
+	var cols []string
+	depth := 0
+	var col strings.Builder
+	for _, c := range def[start+1 : end] {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth > 0: // prefix length
+		case c == ',':
+			cols = append(cols, col.String())
+			col.Reset()
+		default:
+			col.WriteRune(c)
+		}
+	}
+	cols = append(cols, col.String())
+	for i, c := range cols {
+		c = strings.TrimSpace(c)
+		if strings.HasPrefix(c, "`") {
+			c = c[1:]
+			if q := strings.Index(c, "`"); q >= 0 {
+				c = c[:q]
+			}
+		} else if sp := strings.IndexAny(c, " \t"); sp >= 0 {
+			c = c[:sp] // ASC/DESC
+		}
+		cols[i] = strings.ToLower(c)
+	}
+	return cols
+}
+
+// the column lists of the existing non-unique indexes of a table, joined by ","
+func existingIndexes(db *sql.DB, dbname string, tablename string) (map[string]bool, error) {
+	rows, err := db.Query("SELECT `INDEX_NAME`, `COLUMN_NAME` FROM information_schema.`STATISTICS` WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND NON_UNIQUE = 1 ORDER BY `INDEX_NAME`, `SEQ_IN_INDEX`;", dbname, tablename)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading indexes of %s.%s: %w", dbname, tablename, err)
+	}
+	defer rows.Close()
+	columns := map[string][]string{}
+	for rows.Next() {
+		var index, column string
+		if err := rows.Scan(&index, &column); err != nil {
+			return nil, err
+		}
+		columns[index] = append(columns[index], strings.ToLower(column))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	existing := map[string]bool{}
+	for _, cols := range columns {
+		existing[strings.Join(cols, ",")] = true
+	}
+	return existing, nil
+}
+
+// add back the indexes deferred by createTable in a single ALTER TABLE.
+// indexes already there (a resumed run that stopped right after adding them) are skipped.
+func addDeferredIndexes(db *sql.DB, dbname string, tablename string, deferred []string) error {
+	existing, err := existingIndexes(db, dbname, tablename)
+	if err != nil {
+		return err
+	}
+	var adds []string
+	for _, def := range deferred {
+		if existing[strings.Join(indexColumns(def), ",")] {
+			continue
+		}
+		adds = append(adds, "ADD "+def)
+	}
+	if len(adds) == 0 {
+		return nil
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE `%s`.`%s` %s;", dbname, tablename, strings.Join(adds, ", ")))
+	return err
+}
@@ -0,0 +1,119 @@
+package migrator
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitDeferredIndexes(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		want     string
+		deferred []string
+	}{
+		{
+			name: "no secondary index",
+			sql: "CREATE TABLE `1` (\n" +
+				"  `id` bigint(20) unsigned NOT NULL,\n" +
+				"  `updated_at` datetime NOT NULL,\n" +
+				"  PRIMARY KEY (`id`)\n" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+			want: "CREATE TABLE `1` (\n" +
+				"  `id` bigint(20) unsigned NOT NULL,\n" +
+				"  `updated_at` datetime NOT NULL,\n" +
+				"  PRIMARY KEY (`id`)\n" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+		},
+		{
+			// the key of table 4 of the data set, the only definition left loses its trailing comma
+			name: "last definition",
+			sql: "CREATE TABLE `4` (\n" +
+				"  `id` bigint(20) unsigned NOT NULL,\n" +
+				"  `b` char(32) NOT NULL,\n" +
+				"  `updated_at` datetime NOT NULL DEFAULT '2021-12-12 00:00:00',\n" +
+				"  KEY (`id`,`b`)\n" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+			want: "CREATE TABLE `4` (\n" +
+				"  `id` bigint(20) unsigned NOT NULL,\n" +
+				"  `b` char(32) NOT NULL,\n" +
+				"  `updated_at` datetime NOT NULL DEFAULT '2021-12-12 00:00:00'\n" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+			deferred: []string{"KEY (`id`,`b`)"},
+		},
+		{
+			name: "primary, unique, fulltext and spatial keys stay",
+			sql: "CREATE TABLE `t` (\n" +
+				"  `id` int NOT NULL,\n" +
+				"  `a` int,\n" +
+				"  `b` text,\n" +
+				"  `g` geometry NOT NULL,\n" +
+				"  PRIMARY KEY (`id`),\n" +
+				"  KEY `idx_a` (`a`),\n" +
+				"  UNIQUE KEY `uk_a` (`a`),\n" +
+				"  index idx_b (b(10)),\n" +
+				"  FULLTEXT KEY `ft_b` (`b`),\n" +
+				"  SPATIAL KEY `sp_g` (`g`),\n" +
+				"  INDEX(`a`, `id` DESC)\n" +
+				")",
+			want: "CREATE TABLE `t` (\n" +
+				"  `id` int NOT NULL,\n" +
+				"  `a` int,\n" +
+				"  `b` text,\n" +
+				"  `g` geometry NOT NULL,\n" +
+				"  PRIMARY KEY (`id`),\n" +
+				"  UNIQUE KEY `uk_a` (`a`),\n" +
+				"  FULLTEXT KEY `ft_b` (`b`),\n" +
+				"  SPATIAL KEY `sp_g` (`g`)\n" +
+				")",
+			deferred: []string{"KEY `idx_a` (`a`)", "index idx_b (b(10))", "INDEX(`a`, `id` DESC)"},
+		},
+		{
+			name: "columns named like keys",
+			sql: "CREATE TABLE `t` (\n" +
+				"  `key` int,\n" +
+				"  keyword int,\n" +
+				"  `index` int,\n" +
+				"  KEY `k` (`key`)\n" +
+				")",
+			want: "CREATE TABLE `t` (\n" +
+				"  `key` int,\n" +
+				"  keyword int,\n" +
+				"  `index` int\n" +
+				")",
+			deferred: []string{"KEY `k` (`key`)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, deferred := splitDeferredIndexes([]byte(tt.sql))
+			if string(got) != tt.want {
+				t.Errorf("statement =\n%s\nwant\n%s", got, tt.want)
+			}
+			if !reflect.DeepEqual(deferred, tt.deferred) {
+				t.Errorf("deferred = %q, want %q", deferred, tt.deferred)
+			}
+		})
+	}
+}
+
+func TestIndexColumns(t *testing.T) {
+	tests := []struct {
+		def  string
+		want []string
+	}{
+		{"KEY (`id`,`b`)", []string{"id", "b"}},
+		{"KEY `idx` (`a`)", []string{"a"}},
+		{"KEY `idx` (`a`,`b`(10) DESC)", []string{"a", "b"}},
+		{"INDEX idx_c (c ASC, d)", []string{"c", "d"}},
+		{"INDEX(`A`, `Id` DESC)", []string{"a", "id"}},
+		{"KEY `idx` (`a`) USING BTREE", []string{"a"}},
+		{"KEY `idx` (`with space`, `b`(8))", []string{"with space", "b"}},
+		{"KEY `idx`", nil},
+	}
+	for _, tt := range tests {
+		if got := indexColumns(tt.def); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("indexColumns(%q) = %q, want %q", tt.def, got, tt.want)
+		}
+	}
+}
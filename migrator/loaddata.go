@@ -0,0 +1,86 @@
+package migrator
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// loader modes: multi-row prepared INSERTs, or LOAD DATA LOCAL INFILE streaming csv chunks
+const LOADER_INSERT = "insert"
+const LOADER_LOAD_DATA = "loaddata"
+
+// what to do with rows whose key already exists in the target: keep the existing row, replace it,
+// or keep the one with the latest updated_at (insert loader only)
+const CONFLICT_IGNORE = "ignore"
+const CONFLICT_REPLACE = "replace"
+const CONFLICT_NEWER = "newer"
+
+// bytes of csv sent by one LOAD DATA statement, each chunk is committed and checkpointed on its own
+const LOAD_DATA_CHUNK_SIZE = 8 * 1024 * 1024
+
+// unique name of every reader handler registered in the driver, whose registry is process wide
+var readerHandlerSeq int64
+
+// read up to LOAD_DATA_CHUNK_SIZE bytes of whole lines from seek, for LOAD DATA LOCAL INFILE
+func (job *tableJob) readLoadDataChunk(b *parsedBatch, csv *lineReader, seek int, end int) error {
+	chunk := &b.chunk
+	chunk.Reset()
+	for chunk.Len() < LOAD_DATA_CHUNK_SIZE && seek+b.bytes < end {
+		line, err := csv.next()
+		if err != nil {
+			return fmt.Errorf("failed reading csv from seek pos %d: %s", seek+b.bytes, err.Error())
+		}
+		if line == nil {
+			b.eof = true
+			break
+		}
+		chunk.Write(line)
+		if line[len(line)-1] != '\n' {
+			chunk.WriteByte('\n') // last line of the file
+		}
+		b.rows++
+		b.bytes += len(line)
+	}
+	b.seek = seek + b.bytes
+	return nil
+}
+
+// stream a chunk read by readLoadDataChunk through a reader handler, returns the rows affected.
+// the server needs local_infile=ON. note that with LOCAL, rows the target can't convert are loaded
+// with a warning instead of failing the statement.
+func (job *tableJob) execLoadDataChunk(begin func() (*sql.Tx, error), b *parsedBatch) (int64, error) {
+	tx, err := begin()
+	if err != nil {
+		return 0, err
+	}
+
+	name := fmt.Sprintf("migrate_%s_%s_%d", job.srcdba.Name, job.tablename, atomic.AddInt64(&readerHandlerSeq, 1))
+	data := b.chunk.Bytes()
+	mysql.RegisterReaderHandler(name, func() io.Reader {
+		return bytes.NewReader(data)
+	})
+	defer mysql.DeregisterReaderHandler(name)
+
+	conflict := "IGNORE"
+	if job.conflict == CONFLICT_REPLACE {
+		conflict = "REPLACE"
+	}
+	stmt := fmt.Sprintf("LOAD DATA LOCAL INFILE 'Reader::%s' %s INTO TABLE `%s`.`%s` CHARACTER SET utf8 FIELDS TERMINATED BY ',' LINES TERMINATED BY '\\n' (%s)",
+		name, conflict, job.srcdba.Name, job.tablename, strings.Join(quoteColumns(job.columnNames), ","))
+
+	execStartTime := time.Now()
+	res, err := tx.Exec(stmt)
+	job.m.reportBatch(time.Since(execStartTime))
+	if err != nil {
+		return 0, fmt.Errorf("failed load data seek %d source %s %s.%s: %w", b.seek-b.bytes, job.srcdba.SrcName, job.srcdba.Name, job.tablename, err)
+	}
+	rowsAffected, _ := res.RowsAffected()
+	return rowsAffected, nil
+}
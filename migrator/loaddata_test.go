@@ -0,0 +1,76 @@
+package migrator
+
+import (
+	"bufio"
+	"database/sql"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Emanatry/tdsql-migrate-go/logging"
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+)
+
+func TestReadLoadDataChunk(t *testing.T) {
+	csv := "1,a\n2,b\n3,c" // the last line of a file may have no newline
+	tests := []struct {
+		name      string
+		seek      int
+		end       int
+		wantRows  int
+		wantSeek  int
+		wantEOF   bool
+		wantChunk string
+	}{
+		{"whole file", 0, len(csv), 3, len(csv), false, "1,a\n2,b\n3,c\n"},
+		{"range end", 0, 8, 2, 8, false, "1,a\n2,b\n"},
+		{"from seek", 4, len(csv), 2, len(csv), false, "2,b\n3,c\n"},
+		{"nothing left", len(csv), len(csv) + 1, 0, len(csv), true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := &tableJob{srcdba: &srcreader.SrcDatabase{SrcName: "src_a", Name: "db1"}, tablename: "t", columnNames: []string{"id", "name"}}
+			r := &lineReader{r: bufio.NewReader(strings.NewReader(csv[tt.seek:]))}
+			b := &parsedBatch{}
+			b.chunk.WriteString("left over from the previous batch\n")
+			if err := job.readLoadDataChunk(b, r, tt.seek, tt.end); err != nil {
+				t.Fatal(err)
+			}
+			if b.rows != tt.wantRows || b.bytes != tt.wantSeek-tt.seek || b.seek != tt.wantSeek || b.eof != tt.wantEOF || b.chunk.String() != tt.wantChunk {
+				t.Errorf("got %d rows, %d bytes, seek %d, eof %v, chunk %q", b.rows, b.bytes, b.seek, b.eof, b.chunk.String())
+			}
+		})
+	}
+}
+
+func TestExecLoadDataChunk(t *testing.T) {
+	tests := []struct {
+		conflict string
+		wantStmt string
+	}{
+		{CONFLICT_IGNORE, "LOAD DATA LOCAL INFILE 'Reader::migrate_db1_t_N' IGNORE INTO TABLE `db1`.`t` CHARACTER SET utf8 FIELDS TERMINATED BY ',' LINES TERMINATED BY '\\n' (`id`,`order`)"},
+		{CONFLICT_REPLACE, "LOAD DATA LOCAL INFILE 'Reader::migrate_db1_t_N' REPLACE INTO TABLE `db1`.`t` CHARACTER SET utf8 FIELDS TERMINATED BY ',' LINES TERMINATED BY '\\n' (`id`,`order`)"},
+	}
+	handlerSeq := regexp.MustCompile(`_\d+'`)
+	for _, tt := range tests {
+		t.Run(tt.conflict, func(t *testing.T) {
+			connector := &recordingConnector{}
+			db := sql.OpenDB(connector)
+			defer db.Close()
+			job := &tableJob{m: &Migrator{settings: DefaultSettings(), log: logging.Discard()}, srcdba: &srcreader.SrcDatabase{SrcName: "src_a", Name: "db1"}, tablename: "t", columnNames: []string{"id", "order"}, conflict: tt.conflict}
+
+			b := &parsedBatch{rows: 1, bytes: 4, seek: 4}
+			b.chunk.WriteString("1,a\n")
+			if _, err := job.execLoadDataChunk(db.Begin, b); err != nil {
+				t.Fatal(err)
+			}
+			var execs []string
+			for _, conn := range connector.conns {
+				execs = append(execs, conn.execs...)
+			}
+			if len(execs) != 1 || handlerSeq.ReplaceAllString(execs[0], "_N'") != tt.wantStmt {
+				t.Errorf("executed %q, want %q", execs, tt.wantStmt)
+			}
+		})
+	}
+}
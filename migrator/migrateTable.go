@@ -3,55 +3,98 @@ package migrator
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	"io"
 	"os"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Emanatry/tdsql-migrate-go/csvrow"
+	"github.com/Emanatry/tdsql-migrate-go/logging"
 	"github.com/Emanatry/tdsql-migrate-go/srcreader"
 	"github.com/Emanatry/tdsql-migrate-go/stats"
 )
 
-func generateBatchInsertStmts(dbname string, tablename string, columnNames []string, batchSize int) string {
+func generateBatchInsertStmts(dbname string, tablename string, columnNames []string, batchSize int, conflict string) string {
 	var str strings.Builder
+	prefix, suffix := batchInsertStmtParts(dbname, tablename, columnNames, conflict)
 	valuesString := fmt.Sprintf("(?%s)", strings.Repeat(",?", len(columnNames)-1))
-	str.WriteString(fmt.Sprintf("INSERT INTO `%s`.`%s` (%s) VALUES %s", dbname, tablename, strings.Join(columnNames, ","), valuesString))
+	str.WriteString(prefix)
+	str.WriteString(valuesString)
 	for i := 0; i < batchSize-1; i++ {
 		str.WriteRune(',')
 		str.WriteString(valuesString)
 	}
-	str.WriteString(" ON DUPLICATE KEY UPDATE updated_at=updated_at") // ignore rows with duplicate key
+	str.WriteString(suffix)
 
 	return str.String()
 }
 
-const keyIdBString = ",\n  KEY (`id`,`b`)"
+// the column names in backquotes, so that a column named after a reserved word loads the same with both loaders
+func quoteColumns(columnNames []string) []string {
+	columns := make([]string, len(columnNames))
+	for i, name := range columnNames {
+		columns[i] = "`" + name + "`"
+	}
+	return columns
+}
+
+// what goes before and after the VALUES list of a batch insert
+func batchInsertStmtParts(dbname string, tablename string, columnNames []string, conflict string) (prefix string, suffix string) {
+	verb := "INSERT"
+	switch conflict {
+	case CONFLICT_REPLACE:
+		verb = "REPLACE"
+	case CONFLICT_NEWER:
+		// updated_at goes last, the assignments before it still see the old value
+		var assignments []string
+		for _, col := range quoteColumns(columnNames) {
+			if col != "`updated_at`" {
+				assignments = append(assignments, fmt.Sprintf("%s=IF(VALUES(`updated_at`)>`updated_at`,VALUES(%s),%s)", col, col, col))
+			}
+		}
+		assignments = append(assignments, "`updated_at`=GREATEST(`updated_at`,VALUES(`updated_at`))")
+		suffix = " ON DUPLICATE KEY UPDATE " + strings.Join(assignments, ",")
+	default:
+		suffix = " ON DUPLICATE KEY UPDATE `updated_at`=`updated_at`" // ignore rows with duplicate key
+	}
+	return fmt.Sprintf("%s INTO `%s`.`%s` (%s) VALUES ", verb, dbname, tablename, strings.Join(quoteColumns(columnNames), ",")), suffix
+}
 
-func createTable(srcdb *srcreader.SrcDatabase, tablename string, db *sql.DB) error {
+func tableExists(db *sql.DB, dbname string, tablename string) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM information_schema.`TABLES` WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?;", dbname, tablename).Scan(&n)
+	return n > 0, err
+}
+
+func (m *Migrator) createTable(srcdb *srcreader.SrcDatabase, tablename string) error {
+	log := m.tableLog(srcdb, tablename, PhaseCreateTable)
 	// create the database and table by importing .sqlfile file
 	sqlfile, err := srcdb.ReadSQL(tablename)
 	if err != nil {
 		return err
 	}
 
-	tx0, err := db.Begin()
+	tx0, err := m.db.Begin()
 	if err != nil {
 		return errors.New("failed creating transaction tx0: " + err.Error())
 	}
 
-	// for better performance in table 4, create the key after the migration finishes
-	// dirty hack to remove index from table 4
-	if bytes.Contains(sqlfile, []byte(keyIdBString)) {
-		fmt.Printf("* temporarilySuppressKeyIdB: %s.%s\n", srcdb.Name, tablename)
-		sqlfile = bytes.Replace(sqlfile, []byte(keyIdBString), []byte{}, -1)
+	// for better load performance, create the secondary indexes after the migration finishes
+	if m.settings.table(srcdb.Name, tablename).deferIndexes {
+		var deferred []string
+		sqlfile, deferred = splitDeferredIndexes(sqlfile)
+		if len(deferred) > 0 {
+			log.Infof("deferring indexes: %s", strings.Join(deferred, ", "))
+		}
 	}
 	// another dirty hack to add shard key (tdsql only)
 	if !bytes.Contains(sqlfile, []byte("PRIMARY KEY")) { // must have primary key to use shard key
-		fmt.Printf("* adding primary key(id,b,a) to %s.%s\n", srcdb.Name, tablename)
+		log.Infof("adding primary key(id,b,a)")
 		idx := bytes.Index(sqlfile, []byte(") ENGINE=InnoDB DEFAULT CHARSET=utf8"))
 		sqlfile = bytes.Join([][]byte{sqlfile[:idx], []byte(",\n  PRIMARY KEY(`id`,`b`,`a`)\n"), sqlfile[idx:]}, []byte{})
 	}
@@ -63,43 +106,58 @@ func createTable(srcdb *srcreader.SrcDatabase, tablename string, db *sql.DB) err
 		string(sqlfile),
 	}
 
-	fmt.Printf("=== %s %s.%s's table creation sql(after transformation):\n%s\n=== end table creation sql\n\n", srcdb.SrcName, srcdb.Name, tablename, sqlfile)
+	log.Debugf("table creation sql (after transformation):\n%s", sqlfile)
 
 	for _, stmt := range prepStmts {
 		_, err = tx0.Exec(stmt)
 		if err != nil {
+			tx0.Rollback()
 			return errors.New("failed creating database and table: executing\n" + stmt + "\nerror:" + err.Error())
 		}
 	}
+	// DDL commits implicitly, this returns the connection to the pool
+	if err = tx0.Commit(); err != nil {
+		return errors.New("failed commiting transaction tx0: " + err.Error())
+	}
 	return nil
 }
 
-func migrationStepDetectColumns(srcdba *srcreader.SrcDatabase, srcdbb *srcreader.SrcDatabase, tablename string, db *sql.DB) ([]string, error) {
+// the column names of the table and how their csv fields are converted, from their types
+func (m *Migrator) migrationStepDetectColumns(srcdba *srcreader.SrcDatabase, srcdbb *srcreader.SrcDatabase, tablename string) ([]string, []csvrow.Kind, error) {
 
 	// detect the schema of the table
-	rows, err := db.Query("SELECT `COLUMN_NAME` FROM information_schema.`COLUMNS` WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY `ORDINAL_POSITION`;", srcdba.Name, tablename)
+	rows, err := m.db.Query("SELECT `COLUMN_NAME`, `DATA_TYPE`, `COLUMN_TYPE` FROM information_schema.`COLUMNS` WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY `ORDINAL_POSITION`;", srcdba.Name, tablename)
 	if err != nil {
-		return nil, fmt.Errorf("failed reading schema of %s.%s: %s", srcdba.Name, tablename, err.Error())
+		return nil, nil, fmt.Errorf("failed reading schema of %s.%s: %w", srcdba.Name, tablename, err)
 	}
 
 	var columnNames []string
+	var columnKinds []csvrow.Kind
+	var described []string
 
 	for rows.Next() {
-		var columnName string
-		rows.Scan(&columnName)
+		var columnName, dataType, columnType string
+		rows.Scan(&columnName, &dataType, &columnType)
+		kind := csvrow.KindOf(dataType, columnType)
 		columnNames = append(columnNames, columnName)
+		columnKinds = append(columnKinds, kind)
+		described = append(described, columnName+":"+kind.String())
 	}
+	err = rows.Err()
 	rows.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed reading schema of %s.%s: %w", srcdba.Name, tablename, err)
+	}
 
-	fmt.Printf("columns of %s.%s: %v\n", srcdba.Name, tablename, columnNames)
-	return columnNames, nil
+	m.tableLog(srcdba, tablename, PhaseDetectColumns).Infof("columns: %v", described)
+	return columnNames, columnKinds, nil
 }
 
-func migrationStepInitMigrationLog(srcdba *srcreader.SrcDatabase, srcdbb *srcreader.SrcDatabase, tablename string, db *sql.DB, columnNames []string) error {
-	fmt.Printf("* fresh start %s %s.%s from seek %d\n", srcdba.SrcName, srcdba.Name, tablename, 0)
+func (m *Migrator) migrationStepInitMigrationLog(srcdba *srcreader.SrcDatabase, srcdbb *srcreader.SrcDatabase, tablename string, columnNames []string) error {
+	m.tableLog(srcdba, tablename, PhaseCheckpoint).Infof("fresh start from seek 0")
 	// create migration log & potentially create temp primary key
 
-	err := writeSeekMigrationLog(srcdba.SrcName, srcdba.Name, tablename, 0)
+	err := m.checkpoints.writeSeek(srcdba.SrcName, srcdba.Name, tablename, 0)
 	if err != nil {
 		return errors.New("failed creating migration log: " + err.Error())
 	}
@@ -107,229 +165,513 @@ func migrationStepInitMigrationLog(srcdba *srcreader.SrcDatabase, srcdbb *srcrea
 	return nil
 }
 
-// migrate one table from a source database
-// nodup: true if the data source has already been deduped and there's no need to do that while migrating.
-func MigrateTable(srcdba *srcreader.SrcDatabase, srcdbb *srcreader.SrcDatabase, tablename string, DSN string) error {
-	println("* migrate table " + tablename + " from database " + srcdba.Name)
-	var err error
+// a table being migrated, shared by the workers loading its ranges
+type tableJob struct {
+	m         *Migrator
+	srcdba    *srcreader.SrcDatabase
+	srcdbb    *srcreader.SrcDatabase
+	tablename string
+	started   time.Time
+	log       *logging.Logger // with the source, db and table
+
+	csvPath     string
+	csvSize     int64
+	columnNames []string
+	columnKinds []csvrow.Kind
+	ranges      []*csvRange // ranges that are not finished yet
+	rangeCount  int         // ranges planned, finished or not
+	batch       *batchSizer
+	stmts       *stmtCache
+	isResumed   bool
+	deadLetters *deadLetterFile // nil if a rejected row fails the table
+
+	loaderMode      string
+	conflict        string
+	commitInterval  int
+	deferredIndexes []string    // secondary indexes added back by finish
+	loads           *tableLoads // nil unless the table is loaded from both sources (DEDUP_SERVER)
+
+	// cancelled as soon as one range fails, so that the other ranges stop at their next commit
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock      sync.Mutex
+	remaining int   // ranges that haven't returned yet
+	err       error // first error of any range
+
+	totalRows  int64 // accessed atomically
+	totalLines int64 // accessed atomically
+	loaded     int64 // csv bytes committed, including earlier runs, accessed atomically
+}
+
+func (job *tableJob) progress(state string) TableProgress {
+	p := TableProgress{Source: job.srcdba.SrcName, Database: job.srcdba.Name, Table: job.tablename, State: state,
+		Ranges: job.rangeCount, Loaded: atomic.LoadInt64(&job.loaded), Total: job.csvSize}
+	if state == StateFinished {
+		p.Loaded = p.Total
+	}
+	return p
+}
+
+// the loads of a table from both sources with DEDUP_SERVER, shared by the work items and jobs of
+// the table. the last one to be done rebuilds the deferred indexes and marks the table as finished
+// for every source, so that the indexes aren't built while the other source is still inserting.
+type tableLoads struct {
+	sources   []*srcreader.SrcDatabase // the sources not finished in an earlier run
+	lock      sync.Mutex
+	remaining int
+	failed    bool
+}
+
+func newTableLoads(sources ...*srcreader.SrcDatabase) *tableLoads {
+	return &tableLoads{sources: sources, remaining: len(sources)}
+}
+
+// count down one source, returns true if it was the last one and none of them failed
+func (l *tableLoads) done(ok bool) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !ok {
+		l.failed = true
+	}
+	l.remaining--
+	return l.remaining == 0 && !l.failed
+}
+
+// a line aligned byte range [start, end) of the merged csv, loaded on its own connection with its own checkpoint
+type csvRange struct {
+	job   *tableJob
+	index int
+	start int
+	end   int
+	seek  int // position to resume from
+}
 
-	// create a dedicated sql.DB for every single table, bypassing the sql connection pool
-	db, err := sql.Open("mysql", DSN)
+// presort a table, detect its columns and plan its ranges, which are then loaded concurrently by
+// the workers of Run. returns a nil job if the table has already been migrated.
+// srcdbb is nil to load srcdba's own csv without merging, the rows are then deduplicated by the target (DEDUP_SERVER).
+// when ctx is cancelled, the batches already sent are committed and checkpointed before returning ErrInterrupted.
+// transient errors (deadlocks, lock wait timeouts, lost connections) are retried with a new connection,
+// resuming from the last checkpoint in the migration log.
+func (m *Migrator) prepareTable(ctx context.Context, srcdba *srcreader.SrcDatabase, srcdbb *srcreader.SrcDatabase, tablename string) (job *tableJob, err error) {
+	log := m.tableLog(srcdba, tablename, "")
+	log.Infof("migrating table")
+	phase := PhaseCheckpoint
+	defer func() {
+		err = newTableError(srcdba, tablename, phase, err)
+	}()
+
+	if ctx.Err() != nil {
+		return nil, ErrInterrupted
+	}
+
+	status, err := m.checkpoints.readSeek(srcdba.SrcName, srcdba.Name, tablename)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if status == -1 {
+		log.Infof("already finished")
+		return nil, nil
 	}
 
-	db.SetConnMaxIdleTime(-1)
-	db.SetConnMaxLifetime(-1)
-	db.SetMaxOpenConns(1)
-	db.SetMaxIdleConns(1)
-	db.Ping()
+	job = &tableJob{
+		m:         m,
+		srcdba:    srcdba,
+		srcdbb:    srcdbb,
+		tablename: tablename,
+		started:   time.Now(),
+		log:       log,
+		isResumed: status != -2,
+	}
+	job.ctx, job.cancel = context.WithCancel(ctx)
 
+	phase = PhaseLoad
 	sqlfile, err := srcdba.ReadSQL(tablename)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var temporarilySuppressKeyIdB = false
-	// dirty hack to remove index from table 4
-	if bytes.Contains(sqlfile, []byte(keyIdBString)) {
-		fmt.Printf("* !temporarilySuppressKeyIdB: %s.%s\n", srcdba.Name, tablename)
-		temporarilySuppressKeyIdB = true
+	settings := m.settings.table(srcdba.Name, tablename)
+	job.loaderMode = settings.loader
+	job.conflict = settings.conflict
+	job.commitInterval = settings.commitInterval
+	if job.loaderMode == LOADER_LOAD_DATA && job.conflict == CONFLICT_NEWER {
+		return nil, fmt.Errorf("on_conflict %s needs the %s loader", CONFLICT_NEWER, LOADER_INSERT)
+	}
+	if settings.deferIndexes {
+		_, job.deferredIndexes = splitDeferredIndexes(sqlfile)
 	}
 
 	/// ======= preparation =======
 
 	// sort and merge the two tables from source a and b
-	mergedCsvPath, err := srcreader.PresortAndMergeTable(srcdba, srcdbb, tablename)
+	phase = PhasePresort
+	if srcdbb == nil { // DEDUP_SERVER, the target merges the sources
+		job.csvPath = srcdba.TableDataFilePath(tablename)
+	} else {
+		job.csvPath, err = srcreader.PresortAndMergeTable(ctx, srcdba, srcdbb, tablename)
+	}
 	if err != nil {
-		return err
+		if ctx.Err() != nil {
+			return nil, ErrInterrupted
+		}
+		return nil, err
 	}
-
-	columnNames, err := migrationStepDetectColumns(srcdba, srcdbb, tablename, db)
+	fileinfo, err := os.Stat(job.csvPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	job.csvSize = fileinfo.Size()
 
-	seek, err := readSeekMigrationLog(srcdba.SrcName, srcdba.Name, tablename)
-	if err != nil {
+	phase = PhaseDetectColumns
+	err = m.withRetry(ctx, fmt.Sprintf("detecting columns of %s.%s", srcdba.Name, tablename), func() error {
+		job.columnNames, job.columnKinds, err = m.migrationStepDetectColumns(srcdba, srcdbb, tablename)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	if seek >= 0 {
-		fmt.Printf("* resuming %s %s.%s from seek %d\n", srcdba.SrcName, srcdba.Name, tablename, seek)
-	} else if seek == -1 {
-		fmt.Printf("* %s %s.%s already finished.\n", srcdba.SrcName, srcdba.Name, tablename)
-		return nil
+	job.batch = newBatchSizer(len(job.columnNames), settings.batchSize, m.limits.maxBatchBytes(), log.With("phase", PhaseLoad))
+	job.stmts = newStmtCache(m.db, srcdba.Name, tablename, job.columnNames, job.conflict, m.limits.noBackslashEscapes)
+	if job.loaderMode != LOADER_INSERT {
+		log.Infof("loading with %s", job.loaderMode)
+	} else if m.settings.DeadLetterLimit > 0 {
+		job.deadLetters, err = m.openDeadLetters(srcdba.SrcName, srcdba.Name, tablename, job.columnNames, status == -2)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	totalTableRowCount := 0
-	totalLines := 0
-	isResumed := true
+	phase = PhaseCheckpoint
+	if status == -2 { // first time migrating the table
+		err := m.migrationStepInitMigrationLog(srcdba, srcdbb, tablename, job.columnNames)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = job.planRanges(status); err != nil {
+		return nil, err
+	}
+	job.remaining = len(job.ranges)
+	return job, nil
+}
 
-	if seek == -2 { // first time migrating the table
-		seek = 0
-		isResumed = false
-		err := migrationStepInitMigrationLog(srcdba, srcdbb, tablename, db, columnNames)
+// load one range, retrying transient errors from the range's last checkpoint
+func (job *tableJob) loadRange(r *csvRange) error {
+	what := fmt.Sprintf("loading %s %s.%s range %d", job.srcdba.SrcName, job.srcdba.Name, job.tablename, r.index)
+	return liftTableError(job.m.withRetry(job.ctx, what, func() error {
+		return job.loadRangeOnce(r)
+	}))
+}
+
+// record the result of a range, returns true when it was the last range of the table to return
+func (job *tableJob) rangeDone(err error) bool {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if err != nil && !errors.Is(err, ErrInterrupted) && job.err == nil {
+		job.err = err
+		job.cancel() // stop the other ranges
+	}
+	job.remaining--
+	return job.remaining == 0
+}
+
+// called once every range has returned: rebuilds the deferred index and marks the table as finished.
+// with DEDUP_SERVER only the last source of the table to be loaded does, see tableLoads.
+// returns the first error of the ranges, or ErrInterrupted if they were stopped.
+func (job *tableJob) finish(ctx context.Context) (err error) {
+	defer job.cancel()
+	if job.stmts != nil {
+		job.stmts.close()
+	}
+	if job.err == nil && job.ctx.Err() != nil {
+		job.err = ErrInterrupted
+	}
+	if job.loads != nil && !job.loads.done(job.err == nil) {
+		if job.err == nil {
+			// every range is checkpointed as loaded, a resumed run goes straight to finish
+			job.log.Infof("loaded, %d rows affected, %d csv lines (resumed: %v), the other source finishes the table",
+				atomic.LoadInt64(&job.totalRows), atomic.LoadInt64(&job.totalLines), job.isResumed)
+		}
+		return job.err
+	}
+	if job.err != nil {
+		return job.err
+	}
+	m, srcdba, tablename := job.m, job.srcdba, job.tablename
+	phase := PhaseIndex
+	defer func() {
+		err = newTableError(srcdba, tablename, phase, err)
+	}()
+
+	if len(job.deferredIndexes) > 0 {
+		job.log.With("phase", PhaseIndex).Infof("adding back indexes")
+		t1 := time.Now()
+		err := m.withRetry(ctx, fmt.Sprintf("adding back indexes of %s.%s", srcdba.Name, tablename), func() error {
+			return addDeferredIndexes(m.db, srcdba.Name, tablename, job.deferredIndexes)
+		})
 		if err != nil {
-			return err
+			return errors.New("failed adding back indexes: " + err.Error())
 		}
+		job.log.With("phase", PhaseIndex).Infof("rebuilt indexes in %.1f secs", time.Since(t1).Seconds())
 	}
 
-	/// ======= migration =======
+	// only marked as finished after the index is back, so that a resumed run doesn't skip it
+	phase = PhaseCheckpoint
+	sources := []*srcreader.SrcDatabase{srcdba}
+	if job.loads != nil {
+		sources = job.loads.sources
+	}
+	for _, srcdb := range sources {
+		err = m.checkpoints.writeSeek(srcdb.SrcName, srcdb.Name, tablename, -1)
+		if err != nil {
+			return fmt.Errorf("failed marking %s %s.%s as finished: %s", srcdb.SrcName, srcdb.Name, tablename, err.Error())
+		}
+	}
+
+	job.log.Infof("finished, %d rows affected, %d csv lines (resumed: %v)", atomic.LoadInt64(&job.totalRows), atomic.LoadInt64(&job.totalLines), job.isResumed)
+	return nil
+}
+
+// errors returned are tagged with the phase they happened in, see TableError
+func (job *tableJob) loadRangeOnce(r *csvRange) (err error) {
+	ctx, m, srcdba, tablename := job.ctx, job.m, job.srcdba, job.tablename
+	log := job.log.With("phase", PhaseLoad, "range", r.index)
+	defer func() {
+		err = newTableError(srcdba, tablename, PhaseLoad, err)
+	}()
 
-	csvfile, err := os.Open(mergedCsvPath)
+	if ctx.Err() != nil {
+		return ErrInterrupted
+	}
+
+	// a dedicated connection for the range, the batches of a commit group run in one transaction on it
+	conn, err := m.conns.checkout(ctx)
 	if err != nil {
+		if ctx.Err() != nil {
+			return ErrInterrupted
+		}
 		return err
 	}
-	if seek != 0 {
-		csvfile.Seek(int64(seek), 0)
+	defer conn.Close()
+	var tx *sql.Tx
+	defer func() {
+		if tx != nil {
+			tx.Rollback() // uncommitted batches are redone from the checkpoint
+		}
+	}()
+
+	// the checkpoint may have moved since the range was planned if this is a retry
+	seek, err := m.checkpoints.readRangeSeek(srcdba.SrcName, srcdba.Name, tablename, r.index)
+	if err != nil {
+		return err
+	}
+	if seek == -1 {
+		return nil
+	}
+	if seek == -2 {
+		seek = r.start
+	}
+	if seek > r.start {
+		log.Infof("resuming from seek %d", seek)
 	}
 
-	fileinfo, err := csvfile.Stat()
+	/// ======= migration =======
+
+	csvfile, err := os.Open(job.csvPath)
 	if err != nil {
 		return err
 	}
-	csvsize := fileinfo.Size()
+	defer csvfile.Close()
+	if _, err = csvfile.Seek(int64(seek), 0); err != nil {
+		return err
+	}
 
-	csv := bufio.NewReader(csvfile)
+	csv := &lineReader{r: bufio.NewReader(csvfile)}
 
 	lastSeek := seek
+	committedSeek := seek
 
-	// sql statement in string form for a full BatchSize batch insert.
-	fullBatchInsertSqlStmtsStr := generateBatchInsertStmts(srcdba.Name, tablename, columnNames, BATCH_SIZE)
-	fullBatchInsertSqlStmts, err := db.Prepare(fullBatchInsertSqlStmtsStr)
-	if err != nil {
-		return errors.New("failed preparing insert statement: " + err.Error())
+	// not bound to ctx: an interrupt lets the in-flight batch finish and commit
+	begin := func() (*sql.Tx, error) {
+		if tx == nil {
+			t, err := conn.BeginTx(context.Background(), nil)
+			if err != nil {
+				return nil, fmt.Errorf("failed beginning transaction: %w", err)
+			}
+			tx = t
+		}
+		return tx, nil
 	}
+	commitInterval := job.commitInterval
+	if job.loaderMode == LOADER_LOAD_DATA {
+		commitInterval = 1 // every chunk is already a large transaction
+	}
+
+	// the next batches are read and converted while the current one is being sent
+	stop := make(chan struct{})
+	defer close(stop)
+	batches := job.produceBatches(csv, seek, r.end, stop)
+
+	var rejected []rejectedRow // of the uncommitted batches, written once they're committed
 
 	batchCounter := 0
 	// batch insert
 	for {
 		batchStartTime := time.Now()
-		// create a transaction for this batch of data
 
-		// generate the batch insert sql statement
-		var stmt *sql.Stmt
-		isFullBatch := true
-		var batchData []interface{}
-		for rowCount := 0; rowCount < BATCH_SIZE; rowCount++ {
-			line, err := csv.ReadBytes('\n')
-			if err == io.EOF {
-				// table finished, part of the last batch
-
-				// prepare a shorter batch insert statement just for the last batch
-				stmt, err = db.Prepare(generateBatchInsertStmts(srcdba.Name, tablename, columnNames, rowCount))
-				if err != nil {
-					return errors.New("failed preparing insert statement: " + err.Error())
-				}
-
-				isFullBatch = false
-				seek = -1
-				break
-			}
-			if err != nil {
-				return fmt.Errorf("failed reading csv from seek pos %d: %s", seek, err.Error())
-			}
-			totalLines++
-			data := strings.Split(strings.TrimSpace(string(line)), ",")
-			for i := 0; i < len(columnNames); i++ {
-				// convert input data into their corresponding native types
-				var converted interface{}
-				var err error
-				switch i {
-				case 0: // bigint unsigned
-					converted, err = strconv.ParseUint(data[i], 10, 64)
-				case 1: // float/double
-					// always treat it as 64-bit, despite having both float and double as input data.
-					converted, err = strconv.ParseFloat(data[i], 64)
-				case 2: // char(32)
-					// it actually costs more to transmit binary and UNHEX it at the other end
-					// so here we just transmit the raw string data
-					converted, err = data[i], nil
-				case 3: // datetime
-					converted, err = time.ParseInLocation("2006-01-02 15:04:05", data[i], time.Local)
-				}
-				if err != nil {
-					return fmt.Errorf("failed converting input data [%s]: %s", data[i], err)
-				}
-				// fmt.Printf("[%+v]\n", converted)
-				batchData = append(batchData, converted)
-			}
-			seek += len(line)
+		b := <-batches
+		if b.err != nil {
+			return b.err
 		}
-
-		if isFullBatch {
-			stmt = fullBatchInsertSqlStmts
+		var rowsAffected int64
+		if b.rows > 0 {
+			if job.loaderMode == LOADER_LOAD_DATA {
+				rowsAffected, err = job.execLoadDataChunk(begin, b)
+			} else {
+				rowsAffected, err = job.execInsertBatch(begin, b, &rejected)
+			}
 			if err != nil {
-				return errors.New("failed preparing insert statement: " + err.Error())
+				return err
 			}
 		}
-
-		res, err := stmt.Exec(batchData...) // insert one batch of data
-		if err != nil {
-			return fmt.Errorf("failed exec batch seek %d source %s %s.%s: %s", seek, srcdba.SrcName, srcdba.Name, tablename, err.Error())
-		}
-		if !isFullBatch {
-			stmt.Close() // failing to close this will lead to a connection leak
-		}
+		seek = b.seek
+		rowCount := b.rows
+		finished := seek >= r.end || b.eof
+		b.release() // sent, the buffers can take the next batch
 
 		batchCounter++
-		if batchCounter >= COMMIT_INTERVAL || seek == -1 {
+		interrupted := ctx.Err() != nil && !finished
+		if batchCounter >= commitInterval || finished || interrupted {
 			batchCounter = 0
-			_, err = db.Exec("COMMIT")
-			if err != nil {
-				return errors.New("failed commiting batches: " + err.Error())
+			if tx != nil {
+				err = tx.Commit()
+				tx = nil
+				if err != nil {
+					return fmt.Errorf("failed commiting batches: %w", err)
+				}
+			}
+			if len(rejected) > 0 {
+				if err = job.deadLetters.write(rejected); err != nil {
+					return fmt.Errorf("failed writing dead letter file %s: %w", job.deadLetters.path, err)
+				}
+				rejected = rejected[:0]
 			}
 			stats.ReportCommit()
-			err = writeSeekMigrationLog(srcdba.SrcName, srcdba.Name, tablename, seek)
+			checkpoint := seek
+			if finished {
+				checkpoint = -1
+			}
+			err = m.checkpoints.writeRangeSeek(srcdba.SrcName, srcdba.Name, tablename, r.index, checkpoint)
 			if err != nil {
-				return fmt.Errorf("failed updating migration log for source %s %s.%s, new seek = %d: %s", srcdba.SrcName, srcdba.Name, tablename, seek, err.Error())
+				return fmt.Errorf("failed updating migration log for source %s %s.%s range %d, new seek = %d: %s", srcdba.SrcName, srcdba.Name, tablename, r.index, checkpoint, err.Error())
+			}
+			atomic.AddInt64(&job.loaded, int64(seek-committedSeek))
+			committedSeek = seek
+			if !finished {
+				m.progress(job.progress(StateLoading))
 			}
 		}
 
-		rowsAffected, _ := res.RowsAffected()
-
-		if !stats.DevSuppressLog {
+		if m.settings.LogBatches && log.Enabled(logging.LEVEL_DEBUG) {
 			speed := float32(seek-lastSeek) / float32(time.Since(batchStartTime).Milliseconds()) * 1000 / 1024
-			fmt.Printf("batchok %s %s.%s, new seek = (%.2f%%) %d, rows = %d, %.2fKB/s (%.2fs)\n", srcdba.SrcName, srcdba.Name, tablename, float64(seek)/float64(csvsize)*100, seek, rowsAffected, speed, time.Since(batchStartTime).Seconds())
+			log.Debugf("batchok, new seek = (%.2f%%) %d, rows = %d, %.2fKB/s (%.2fs)", float64(seek-r.start)/float64(r.end-r.start)*100, seek, rowsAffected, speed, time.Since(batchStartTime).Seconds())
 		}
 
-		totalTableRowCount += int(rowsAffected)
-		stats.ReportBytesMigrated(seek - lastSeek)
+		atomic.AddInt64(&job.totalRows, rowsAffected)
+		atomic.AddInt64(&job.totalLines, int64(rowCount))
+		m.reportBytes(seek - lastSeek)
 
 		lastSeek = seek
 
-		if seek == -1 {
-			if temporarilySuppressKeyIdB { // add back KEY(`id`,`b`)
-				fmt.Printf("* adding back key id_b for %s.%s\n", srcdba.Name, tablename)
-				t1 := time.Now()
-				var err error = nil
-				for err == nil || strings.Contains(err.Error(), "Lock wait timeout exceeded") {
-					_, err = db.Exec(fmt.Sprintf("ALTER TABLE `%s`.`%s` ADD INDEX (`id`,`b`);", srcdba.Name, tablename))
-					if err == nil {
-						break
-					}
-					fmt.Println("retry......")
-				}
-				if err != nil {
-					return errors.New("failed adding back KEY(`id`,`b`): " + err.Error())
-				}
-				fmt.Printf("* rebuilt key id_b for %s.%s in %.1f secs.\n", srcdba.Name, tablename, time.Since(t1).Seconds())
-			}
-			break
+		if interrupted {
+			log.Infof("interrupted, checkpoint saved at seek %d", seek)
+			return ErrInterrupted
 		}
-	}
 
-	// commit again, just to be safe
-	_, err = db.Exec("COMMIT")
-	if err != nil {
-		return errors.New("failed commiting last batches: " + err.Error())
+		if finished {
+			break
+		}
 	}
 
-	fullBatchInsertSqlStmts.Close()
-
-	db.Close()
-
-	fmt.Printf("* finished table db %s table %s, totalRowAffected %d, csvlines: %d (resumed: %v)\n", srcdba.Name, tablename, totalTableRowCount, totalLines, isResumed)
+	return nil
+}
 
+// read one batch of lines from seek and convert them for a multi-row prepared INSERT into b.rows,
+// bounded by the table's batch size and max_allowed_packet
+func (job *tableJob) readInsertBatch(b *parsedBatch, csv *lineReader, seek int, end int) error {
+	maxRows, maxBytes := job.batch.limits()
+	b.data.Reset()
+	batchBytes := 0
+	for b.data.Rows() < maxRows && seek+b.bytes < end {
+		line, err := csv.next()
+		if err != nil {
+			return fmt.Errorf("failed reading csv from seek pos %d: %s", seek+b.bytes, err.Error())
+		}
+		if line == nil {
+			b.eof = true
+			break
+		}
+		if b.data.Rows() > 0 && batchBytes+job.batch.rowBytes(line) > maxBytes {
+			csv.unread(line) // goes into the next batch
+			break
+		}
+		batchBytes += job.batch.rowBytes(line)
+		if err = b.data.AppendLine(line); err != nil {
+			return fmt.Errorf("seek pos %d: %w", seek+b.bytes, err)
+		}
+		if job.deadLetters != nil {
+			b.lines = append(b.lines, line...)
+			b.lineEnds = append(b.lineEnds, len(b.lines))
+		}
+		b.bytes += len(line)
+	}
+	b.rows = b.data.Rows()
+	b.seek = seek + b.bytes
+	if job.m.settings.Interpolate && b.rows > 0 {
+		b.sql = job.stmts.appendLiteralInsert(b.sql[:0], b.data, 0, b.rows)
+	}
 	return nil
 }
+
+// insert a batch read by readInsertBatch, returns the rows affected.
+// with dead letters, the rows the target rejects are left out and added to rejected.
+func (job *tableJob) execInsertBatch(begin func() (*sql.Tx, error), b *parsedBatch, rejected *[]rejectedRow) (int64, error) {
+	tx, err := begin()
+	if err != nil {
+		return 0, err
+	}
+	var res sql.Result
+	var latency time.Duration
+	if job.m.settings.Interpolate {
+		execStartTime := time.Now()
+		res, err = tx.Exec(string(b.sql)) // insert one batch of data, as literals
+		latency = time.Since(execStartTime)
+	} else {
+		var stmt *sql.Stmt
+		stmt, err = job.stmts.get(context.Background(), tx, b.rows)
+		if err != nil {
+			return 0, err
+		}
+		execStartTime := time.Now()
+		res, err = stmt.Exec(b.data.Args()...) // insert one batch of data
+		latency = time.Since(execStartTime)
+	}
+	job.m.reportBatch(latency)
+	if err != nil {
+		err = fmt.Errorf("failed exec batch seek %d source %s %s.%s: %w", b.seek-b.bytes, job.srcdba.SrcName, job.srcdba.Name, job.tablename, err)
+		if job.deadLetters == nil || !isRowError(err) {
+			return 0, err
+		}
+		before := len(*rejected)
+		rowsAffected, err := job.insertIsolatingRejected(tx, b, 0, b.rows, err, rejected)
+		if err != nil {
+			return 0, err
+		}
+		job.log.With("phase", PhaseLoad).Warnf("%d of %d rows of the batch at seek %d rejected by the target, see %s", len(*rejected)-before, b.rows, b.seek-b.bytes, job.deadLetters.path)
+		return rowsAffected, nil
+	}
+	job.batch.observe(b.rows, latency)
+	rowsAffected, _ := res.RowsAffected()
+	return rowsAffected, nil
+}
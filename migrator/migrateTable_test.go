@@ -0,0 +1,59 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/Emanatry/tdsql-migrate-go/logging"
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+)
+
+func TestFinishBothSources(t *testing.T) {
+	srca := &srcreader.SrcDatabase{SrcName: "src_a", Name: "db1"}
+	srcb := &srcreader.SrcDatabase{SrcName: "src_b", Name: "db1"}
+	tests := []struct {
+		name      string
+		sources   []*srcreader.SrcDatabase // unfinished at the start of the run
+		errs      []error                  // of the jobs in the order they finish
+		wantFinal map[string]int
+	}{
+		{"both loaded", []*srcreader.SrcDatabase{srca, srcb}, []error{nil, nil}, map[string]int{"src_a": -1, "src_b": -1}},
+		{"first failed", []*srcreader.SrcDatabase{srca, srcb}, []error{errors.New("boom"), nil}, map[string]int{"src_a": -2, "src_b": -2}},
+		{"last failed", []*srcreader.SrcDatabase{srca, srcb}, []error{nil, errors.New("boom")}, map[string]int{"src_a": -2, "src_b": -2}},
+		{"interrupted", []*srcreader.SrcDatabase{srca, srcb}, []error{nil, ErrInterrupted}, map[string]int{"src_a": -2, "src_b": -2}},
+		// src_a was finished by an earlier run, src_b alone finishes the table
+		{"other source finished earlier", []*srcreader.SrcDatabase{srcb}, []error{nil}, map[string]int{"src_a": -2, "src_b": -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Migrator{settings: DefaultSettings(), log: logging.Discard(), checkpoints: migrationLog{root: filepath.Join(t.TempDir(), "migration_log")}}
+			loads := newTableLoads(tt.sources...)
+			var jobs []*tableJob
+			for i, srcdb := range tt.sources {
+				job := &tableJob{m: m, srcdba: srcdb, tablename: "1", log: logging.Discard(), loads: loads, err: tt.errs[i]}
+				job.ctx, job.cancel = context.WithCancel(context.Background())
+				jobs = append(jobs, job)
+			}
+			for i, job := range jobs {
+				if err := job.finish(context.Background()); !errors.Is(err, tt.errs[i]) {
+					t.Fatalf("finish of %s = %v, want %v", job.srcdba.SrcName, err, tt.errs[i])
+				}
+				if i < len(jobs)-1 {
+					// the indexes mustn't be built while the other source is still loading
+					for _, srcdb := range tt.sources {
+						if seek, _ := m.checkpoints.readSeek(srcdb.SrcName, srcdb.Name, "1"); seek == -1 {
+							t.Fatalf("%s marked finished before the last source was loaded", srcdb.SrcName)
+						}
+					}
+				}
+			}
+			for src, want := range tt.wantFinal {
+				if seek, _ := m.checkpoints.readSeek(src, "db1", "1"); seek != want {
+					t.Errorf("seek of %s = %d, want %d", src, seek, want)
+				}
+			}
+		})
+	}
+}
@@ -1,40 +1,125 @@
 package migrator
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
+
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
 )
 
-const migrationLogRoot = "./migration_log"
+// the checkpoints of the tables, files under root/<src>/<db>/<table>/
+type migrationLog struct {
+	root string
+}
 
-// return value: -3: error, -2: not started, -1: finished, any other non-negative number: continue from this position
-func readSeekMigrationLog(src string, db string, table string) (seek int, err error) {
-	logdir := strings.Join([]string{migrationLogRoot, src, db, table}, "/")
-	err = os.MkdirAll(logdir, 0755)
+func (l migrationLog) dir(src string, db string, table string) string {
+	return strings.Join([]string{l.root, src, db, table}, "/")
+}
+
+// returns os.ErrNotExist if the file hasn't been written yet
+func (l migrationLog) readFile(src string, db string, table string, name string) (string, error) {
+	logdir := l.dir(src, db, table)
+	data, err := ioutil.ReadFile(logdir + "/" + name)
 	if err != nil {
-		return -1, err
+		return "", err
 	}
-	seekdata, err := ioutil.ReadFile(logdir + "/seek.txt")
+	return string(data), nil
+}
+
+func (l migrationLog) writeFile(src string, db string, table string, name string, content string) error {
+	logdir := l.dir(src, db, table)
+	err := os.MkdirAll(logdir, 0755)
+	if err != nil {
+		return err
+	}
+	// write to a temp file and rename it, so that a kill in the middle never leaves a truncated log
+	tmpfile := logdir + "/" + name + ".tmp"
+	err = ioutil.WriteFile(tmpfile, []byte(content), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, logdir+"/"+name)
+}
+
+// return value: -3: error, -2: not started, -1: finished, any other non-negative number: continue from this position
+func (l migrationLog) readSeek(src string, db string, table string) (seek int, err error) {
+	return l.readSeekFile(src, db, table, "seek.txt")
+}
+
+func (l migrationLog) writeSeek(src string, db string, table string, newseek int) error {
+	return l.writeFile(src, db, table, "seek.txt", strconv.Itoa(newseek))
+}
+
+// checkpoint of one byte range of the merged csv, same return values as readSeek
+func (l migrationLog) readRangeSeek(src string, db string, table string, rangeIndex int) (seek int, err error) {
+	return l.readSeekFile(src, db, table, fmt.Sprintf("range_%d.txt", rangeIndex))
+}
+
+func (l migrationLog) writeRangeSeek(src string, db string, table string, rangeIndex int, newseek int) error {
+	return l.writeFile(src, db, table, fmt.Sprintf("range_%d.txt", rangeIndex), strconv.Itoa(newseek))
+}
+
+func (l migrationLog) readSeekFile(src string, db string, table string, name string) (seek int, err error) {
+	seekdata, err := l.readFile(src, db, table, name)
 	if os.IsNotExist(err) {
 		return -2, nil
 	}
 	if err != nil {
-		return -1, err
+		return -3, err
 	}
-	return strconv.Atoi(string(seekdata))
+	return strconv.Atoi(seekdata)
 }
 
-func writeSeekMigrationLog(src string, db string, table string, newseek int) error {
-	logdir := strings.Join([]string{migrationLogRoot, src, db, table}, "/")
-	err := os.MkdirAll(logdir, 0755)
-	if err != nil {
-		return err
+// the byte offsets splitting the merged csv into ranges, nil if the table hasn't been planned yet.
+// the plan is saved so that a resumed migration uses the same ranges as their checkpoints.
+func (l migrationLog) readRangePlan(src string, db string, table string) ([]int, error) {
+	plan, err := l.readFile(src, db, table, "ranges.txt")
+	if os.IsNotExist(err) {
+		return nil, nil
 	}
-	err = ioutil.WriteFile(logdir+"/seek.txt", []byte(strconv.Itoa(newseek)), 0755) // could fail if killed?
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var boundaries []int
+	for _, field := range strings.Fields(plan) {
+		b, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("corrupted range plan [%s]: %s", plan, err.Error())
+		}
+		boundaries = append(boundaries, b)
+	}
+	return boundaries, nil
+}
+
+func (l migrationLog) writeRangePlan(src string, db string, table string, boundaries []int) error {
+	fields := make([]string, len(boundaries))
+	for i, b := range boundaries {
+		fields[i] = strconv.Itoa(b)
+	}
+	return l.writeFile(src, db, table, "ranges.txt", strings.Join(fields, " "))
+}
+
+// remove the checkpoints and dead letter files of every table of the sources, of both sources, so
+// that they're migrated again from the start. those of other tables are kept.
+func (m *Migrator) ResetCheckpoints() error {
+	for _, src := range []*srcreader.Source{m.srca, m.srcb} {
+		for _, srcdb := range src.Databases {
+			for _, table := range srcdb.Tables {
+				if err := os.RemoveAll(m.checkpoints.dir(srcdb.SrcName, srcdb.Name, table)); err != nil {
+					return err
+				}
+				if m.settings.DeadLetterPath == "" {
+					continue
+				}
+				err := os.Remove(m.deadLetterPath(srcdb.SrcName, srcdb.Name, table))
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
 	}
 	return nil
 }
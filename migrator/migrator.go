@@ -1,117 +1,355 @@
 package migrator
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/Emanatry/tdsql-migrate-go/semaphore"
+	"github.com/Emanatry/tdsql-migrate-go/logging"
 	"github.com/Emanatry/tdsql-migrate-go/srcreader"
 )
 
-const BATCH_SIZE = 2000
-const CONCURRENT_MIGRATE_DATABASES = 7
-const CONCURRENT_MIGRATE_TABLES = 1
-const COMMIT_INTERVAL = 40
+// returned when the migration was stopped by a cancelled context (SIGINT/SIGTERM).
+// everything committed so far has been checkpointed in the migration log, rerun to resume.
+var ErrInterrupted = errors.New("migration interrupted")
 
-// prepare the target instance, create `meta_migration`, etc.
-func PrepareTargetDB(db *sql.DB) {
-	println("preparing target db environment")
+var errNoTarget = errors.New("no target database, set Options.DB or Options.Connector")
 
-	prep, err := ioutil.ReadFile("./sql/prepare.sql")
-	if err != nil {
-		panic("failed reading prepare.sql: " + err.Error())
+// where a Migrator writes what it's doing, *log.Logger and *logging.Logger are ones.
+// a *logging.Logger gets every line with its level and the source, db, table and phase as fields,
+// any other Logger gets them all as text, batch lines included.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+type Options struct {
+	// the target: an open pool, or a connector the Migrator opens its own pool with (closed by Close).
+	// Plan and Status work without one. the driver must format times in the location of
+	// Settings.Session.TimeZone (mysql.Config.Loc, see SessionLocation), datetimes are sent as written.
+	DB        *sql.DB
+	Connector driver.Connector
+
+	// the two sources, with the same databases and tables (see srcreader.Source.Filter)
+	SourceA *srcreader.Source
+	SourceB *srcreader.Source
+
+	Settings Settings
+
+	// nothing is logged if nil
+	Logger Logger
+
+	// called when a table is prepared, checkpointed, finished or failed during Run, from the
+	// goroutines of the workers
+	OnProgress func(TableProgress)
+
+	// the target may already have tables of an earlier run, only the missing ones are created.
+	// otherwise a table that already exists fails in PhaseCreateTable.
+	Resume bool
+}
+
+// a migration of two sources into a target, created with New
+type Migrator struct {
+	db         *sql.DB
+	ownDB      bool // opened from Options.Connector
+	srca       *srcreader.Source
+	srcb       *srcreader.Source
+	settings   Settings
+	log        *logging.Logger
+	onProgress func(TableProgress)
+	resume     bool
+
+	checkpoints migrationLog
+	conns       *connManager
+	loc         *time.Location // of Settings.Session.TimeZone
+	limits      serverLimits
+	meter       meter
+}
+
+func New(opts Options) (*Migrator, error) {
+	if opts.SourceA == nil || opts.SourceB == nil {
+		return nil, errors.New("both sources are needed")
+	}
+	if len(opts.SourceA.Databases) != len(opts.SourceB.Databases) {
+		return nil, fmt.Errorf("%s has %d databases, %s has %d", opts.SourceA.SrcName, len(opts.SourceA.Databases), opts.SourceB.SrcName, len(opts.SourceB.Databases))
+	}
+	for i, dba := range opts.SourceA.Databases {
+		dbb := opts.SourceB.Databases[i]
+		if dba.Name != dbb.Name || len(dba.Tables) != len(dbb.Tables) {
+			return nil, fmt.Errorf("the databases of %s and %s don't match: %s and %s", opts.SourceA.SrcName, opts.SourceB.SrcName, dba.Name, dbb.Name)
+		}
+	}
+	settings := opts.Settings
+	if err := settings.validate(); err != nil {
+		return nil, fmt.Errorf("invalid settings: %w", err)
+	}
+	// copied so that the caller can't change them in the middle of a run
+	caps := map[string]int{}
+	for k, v := range settings.DatabaseConcurrencyCaps {
+		caps[k] = v
+	}
+	tables := map[string]TableOverride{}
+	for k, v := range settings.Tables {
+		tables[k] = v
 	}
+	settings.DatabaseConcurrencyCaps, settings.Tables = caps, tables
 
-	stmts := strings.Split(string(prep), ";")
+	m := &Migrator{
+		db:          opts.DB,
+		srca:        opts.SourceA,
+		srcb:        opts.SourceB,
+		settings:    settings,
+		onProgress:  opts.OnProgress,
+		resume:      opts.Resume,
+		checkpoints: migrationLog{root: settings.CheckpointPath},
+		limits:      defaultServerLimits,
+	}
+	m.loc, _ = SessionLocation(settings.Session.TimeZone) // validated above
+	switch l := opts.Logger.(type) {
+	case nil:
+		m.log = logging.Discard()
+	case *logging.Logger:
+		m.log = l
+	default:
+		m.log = logging.NewPrintf(l.Printf, logging.LEVEL_DEBUG)
+	}
+	if m.db == nil && opts.Connector != nil {
+		m.db = sql.OpenDB(opts.Connector)
+		m.ownDB = true
+	}
+	if m.db != nil {
+		m.conns = newConnManager(m.db, settings.Session)
+	}
+	return m, nil
+}
+
+// close the pool opened from Options.Connector, a pool passed in Options.DB is left open
+func (m *Migrator) Close() error {
+	if m.ownDB {
+		return m.db.Close()
+	}
+	return nil
+}
+
+// the logger of a table, phase is left out if empty
+func (m *Migrator) tableLog(srcdb *srcreader.SrcDatabase, table string, phase string) *logging.Logger {
+	log := m.log.With("source", srcdb.SrcName, "db", srcdb.Name, "table", table)
+	if phase != "" {
+		log = log.With("phase", phase)
+	}
+	return log
+}
+
+func (m *Migrator) progress(p TableProgress) {
+	if m.onProgress != nil {
+		m.onProgress(p)
+	}
+}
 
-	totalRowsAffected := 0
+// prepare the target instance, create `meta_migration`, etc.
+func (m *Migrator) prepareTarget(ctx context.Context) error {
+	m.log.Infof("preparing target db environment")
 
-	tx, err := db.Begin()
+	tx, err := m.db.BeginTx(ctx, nil)
 	if err != nil {
-		panic("failed creating transaction " + err.Error())
+		return fmt.Errorf("failed creating transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	for _, v := range stmts {
+	totalRowsAffected := int64(0)
+	for _, stmt := range strings.Split(prepareSQL, ";") {
 		// skip empty lines
-		if len(strings.TrimSpace(v)) == 0 {
+		if len(strings.TrimSpace(stmt)) == 0 {
 			continue
 		}
-		result, err := tx.Exec(v + ";")
+		result, err := tx.Exec(stmt + ";")
 		if err != nil {
-			panic("failed executing prepare.sql: " + err.Error())
+			return fmt.Errorf("failed executing prepare.sql: %w", err)
 		}
 		rowsAffected, err := result.RowsAffected()
 		if err != nil {
-			panic("failed getting rowsAffected: " + err.Error())
+			return fmt.Errorf("failed getting rowsAffected: %w", err)
 		}
-		totalRowsAffected += int(rowsAffected)
+		totalRowsAffected += rowsAffected
 	}
 
 	if err := tx.Commit(); err != nil {
-		panic("failed commiting transaction: " + err.Error())
+		return fmt.Errorf("failed commiting transaction: %w", err)
 	}
-
-	fmt.Printf("prepare.sql finished. totalRowsAffected: %d\n", totalRowsAffected)
+	m.log.Infof("prepare.sql finished, %d rows affected", totalRowsAffected)
+	return nil
 }
 
-// migrate a whole data source
-func MigrateSource(srca *srcreader.Source, srcb *srcreader.Source, db *sql.DB, DSN string, doCreateTable bool) error {
-	println("========== starting migration job for source " + srca.SrcName)
+// migrate every table of the sources.
+// a failing table doesn't stop the others unless FailFast is set, the returned error is
+// nil, ErrInterrupted, or a *MigrationError listing every table that failed. the result has the
+// outcome of every table either way, unless the target couldn't be prepared at all.
+func (m *Migrator) Run(ctx context.Context) (*Result, error) {
+	if m.db == nil {
+		return nil, errNoTarget
+	}
+	m.log.Infof("starting migration of %s and %s", m.srca.SrcName, m.srcb.SrcName)
+	if err := m.prepareTarget(ctx); err != nil {
+		return nil, err
+	}
+
+	interruptCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := newOutcomes(m.log)
+	onFailure := func() {
+		if m.settings.FailFast {
+			m.log.Errorf("fail fast: stopping all other tables")
+			cancel()
+		}
+	}
+
+	// every worker checks out its own connection from db
+	if stmts := m.conns.session.statements(); len(stmts) > 0 {
+		m.log.Infof("session settings of the workers: %s", strings.Join(stmts, "; "))
+	}
+
+	err := m.withRetry(ctx, "reading server limits", m.detectServerLimits)
+	if err != nil {
+		m.log.Warnf("%s, assuming max_allowed_packet = %d", err.Error(), m.limits.maxAllowedPacket)
+	}
+
+	// create all the tables for all the databases first, a resumed run only creates the missing ones
+	for _, srcdb := range m.srca.Databases {
+		for _, table := range srcdb.Tables {
+			if m.resume {
+				if exists, err := tableExists(m.db, srcdb.Name, table); err != nil || exists {
+					continue // if it can't be checked, loading it reports the problem
+				}
+			}
+			err := m.createTable(srcdb, table)
+			if err != nil {
+				m.record(results, srcdb, table, PhaseCreateTable, err, nil)
+				results.skipTable(srcdb, table)
+				if m.settings.FailFast {
+					return results.result(false), results.err(false)
+				}
+			}
+		}
+	}
 
-	if doCreateTable { // create all the tables for all the databases first
-		for _, srcdb := range srca.Databases {
-			for _, table := range srcdb.Tables {
-				err := createTable(srcdb, table, db)
-				if err != nil {
-					return err
+	var items []*workItem
+	for i, dba := range m.srca.Databases {
+		dbb := m.srcb.Databases[i]
+		for _, table := range dba.Tables {
+			if results.isSkipped(dba, table) {
+				continue
+			}
+			if m.settings.Dedup == DEDUP_SERVER { // each source on its own, with its own checkpoints
+				itema := &workItem{srcdba: dba, table: table, size: dba.TableDataSize(table)}
+				itemb := &workItem{srcdba: dbb, table: table, size: dbb.TableDataSize(table)}
+				// the sources finished in an earlier run are only reported, the others share the rest of the table
+				var unfinished []*workItem
+				var sources []*srcreader.SrcDatabase
+				for _, item := range []*workItem{itema, itemb} {
+					if status, _ := m.checkpoints.readSeek(item.srcdba.SrcName, item.srcdba.Name, table); status != -1 {
+						unfinished = append(unfinished, item)
+						sources = append(sources, item.srcdba)
+					}
 				}
+				loads := newTableLoads(sources...)
+				for _, item := range unfinished {
+					item.loads = loads
+				}
+				items = append(items, itema, itemb)
+				continue
 			}
+			items = append(items, &workItem{srcdba: dba, srcdbb: dbb, table: table, size: dba.TableDataSize(table) + dbb.TableDataSize(table)})
 		}
 	}
+	sched := newScheduler(ctx, items, &m.settings)
+	sched.printQueue(m.log)
+
+	workers := m.settings.ConcurrentWorkers
+	if m.settings.Adaptive {
+		workers = ADAPTIVE_MAX_WORKERS
+		go newConcurrencyController(sched, &m.meter, m.log).run(ctx)
+	}
 
-	rateLimitingSemaphore := semaphore.New(CONCURRENT_MIGRATE_DATABASES)
 	var wg sync.WaitGroup
-	for i, dba := range srca.Databases {
+	for w := 0; w < workers; w++ {
 		wg.Add(1)
-		rateLimitingSemaphore.Acquire()
-		go func(dba *srcreader.SrcDatabase, i int) {
-			if err := MigrateDatabase(dba, srcb.Databases[i], DSN); err != nil {
-				panic(fmt.Errorf("error while migrating database [%s] from source %s:\n%s", dba.Name, dba.SrcName, err))
-			}
-			rateLimitingSemaphore.Release()
+		go func() {
 			defer wg.Done()
-		}(dba, i)
+			for item := sched.next(); item != nil; item = sched.next() {
+				m.runWorkItem(ctx, sched, item, results, onFailure)
+				sched.done(item)
+			}
+		}()
 	}
 	wg.Wait()
-	return nil
-}
 
-// migrate one database of a data source
-func MigrateDatabase(srcdba *srcreader.SrcDatabase, srcdbb *srcreader.SrcDatabase, DSN string) error {
-	println("======= migrate database [" + srcdba.Name + "]")
-	c := make(chan error)
-	migrate := func(table string) {
-		if err := MigrateTable(srcdba, srcdbb, table, DSN); err != nil {
-			c <- fmt.Errorf("error while migrating table [%s]:\n%s", table, err)
+	// tables and ranges that never got to run because of a shutdown still have to be accounted for
+	for _, item := range sched.drain() {
+		if item.rng == nil {
+			m.record(results, item.srcdba, item.table, PhaseLoad, ErrInterrupted, nil)
+		} else if item.rng.job.rangeDone(ErrInterrupted) {
+			m.record(results, item.srcdba, item.table, PhaseLoad, item.rng.job.finish(ctx), item.rng.job)
 		}
-		c <- nil
 	}
-	// shift these around to migrate multiple tables concurrently
-	concurrentTables := 0
 
-	for i := range srcdba.Tables {
-		go migrate(srcdba.Tables[i])
-		concurrentTables++
-		for concurrentTables >= CONCURRENT_MIGRATE_TABLES {
-			err := <-c
-			if err != nil {
-				return err
+	interrupted := interruptCtx.Err() != nil
+	return results.result(interrupted), results.err(interrupted)
+}
+
+// record the outcome of a table and report it to OnProgress, returns true if the table failed
+func (m *Migrator) record(results *outcomes, srcdb *srcreader.SrcDatabase, table string, phase string, err error, job *tableJob) bool {
+	r := results.record(srcdb, table, phase, err, job)
+	p := TableProgress{Source: r.Source, Database: r.Database, Table: r.Table, State: r.State}
+	if job != nil {
+		p = job.progress(r.State)
+	}
+	if r.Err != nil {
+		p.Err = r.Err
+	}
+	m.progress(p)
+	return r.State == StateFailed
+}
+
+// a table item is prepared and its ranges are added back to the scheduler,
+// whoever loads the last range of a table finishes it and records its outcome.
+func (m *Migrator) runWorkItem(ctx context.Context, sched *scheduler, item *workItem, results *outcomes, onFailure func()) {
+	if item.rng == nil {
+		job, err := m.prepareTable(ctx, item.srcdba, item.srcdbb, item.table)
+		if err != nil && item.loads != nil {
+			item.loads.done(false) // the other source's load can't finish the table either
+		}
+		if err != nil || job == nil {
+			if m.record(results, item.srcdba, item.table, PhaseLoad, err, job) {
+				onFailure()
+			}
+			return
+		}
+		job.loads = item.loads
+		m.progress(job.progress(StateLoading))
+		var rangeItems []*workItem
+		for _, r := range job.ranges {
+			rangeItems = append(rangeItems, &workItem{srcdba: item.srcdba, srcdbb: item.srcdbb, table: item.table, size: int64(r.end - r.seek), rng: r})
+		}
+		if len(rangeItems) == 0 { // every range was already loaded in a previous run
+			if m.record(results, item.srcdba, item.table, PhaseLoad, job.finish(ctx), job) {
+				onFailure()
 			}
-			concurrentTables--
+			return
+		}
+		sched.add(rangeItems...)
+		return
+	}
+
+	job := item.rng.job
+	if job.rangeDone(job.loadRange(item.rng)) {
+		if m.record(results, item.srcdba, item.table, PhaseLoad, job.finish(ctx), job) {
+			onFailure()
 		}
 	}
-	return nil
 }
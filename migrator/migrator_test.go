@@ -0,0 +1,187 @@
+package migrator
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+)
+
+const migratorTestSQL = "CREATE TABLE `1` (\n" +
+	"  `id` bigint(20) unsigned NOT NULL,\n" +
+	"  `b` char(32) NOT NULL,\n" +
+	"  PRIMARY KEY (`id`),\n" +
+	"  KEY `idx_b` (`b`)\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8"
+
+// the sources src_a and src_b of the tables db1.1 and db1.2, with csvs of the given sizes
+func newTestSources(t *testing.T, sizes map[string]int) (*srcreader.Source, *srcreader.Source) {
+	t.Helper()
+	dir := t.TempDir()
+	for _, src := range []string{"src_a", "src_b"} {
+		if err := os.MkdirAll(filepath.Join(dir, src, "db1"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, table := range []string{"1", "2"} {
+			base := filepath.Join(dir, src, "db1", table)
+			if err := ioutil.WriteFile(base+".sql", []byte(migratorTestSQL), 0644); err != nil {
+				t.Fatal(err)
+			}
+			csv := strings.Repeat("x", sizes[src+"."+table])
+			if err := ioutil.WriteFile(base+".csv", []byte(csv), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	srca, err := srcreader.Open(filepath.Join(dir, "src_a"), "src_a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcb, err := srcreader.Open(filepath.Join(dir, "src_b"), "src_b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srca, srcb
+}
+
+func TestNew(t *testing.T) {
+	srca, srcb := newTestSources(t, nil)
+	other, _ := newTestSources(t, nil)
+	other.Databases[0].Name = "db2"
+	invalid := DefaultSettings()
+	invalid.Loader = "copy"
+
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr string
+	}{
+		{"one source", Options{SourceA: srca, Settings: DefaultSettings()}, "both sources are needed"},
+		{"other databases", Options{SourceA: srca, SourceB: other, Settings: DefaultSettings()}, "don't match"},
+		{"invalid settings", Options{SourceA: srca, SourceB: srcb, Settings: invalid}, `unknown loader "copy"`},
+		// Plan and Status need no target
+		{"no target", Options{SourceA: srca, SourceB: srcb, Settings: DefaultSettings()}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(tt.opts)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := m.Close(); err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("New() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// the overrides are copied, changing them after New doesn't change the migration
+func TestNewCopiesSettings(t *testing.T) {
+	srca, srcb := newTestSources(t, nil)
+	settings := DefaultSettings()
+	settings.Tables["db1.1"] = TableOverride{BatchSize: 500}
+	m, err := New(Options{SourceA: srca, SourceB: srcb, Settings: settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.Tables["db1.1"] = TableOverride{BatchSize: 100}
+	if got := m.settings.table("db1", "1").batchSize; got != 500 {
+		t.Errorf("batch size = %d, want 500", got)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	srca, srcb := newTestSources(t, map[string]int{"src_a.1": 100, "src_b.1": 60, "src_a.2": 10, "src_b.2": 10})
+	noDefer := false
+	settings := DefaultSettings()
+	settings.RangesPerTable = 4
+	settings.MinRangeSize = 40
+	settings.Tables["db1.2"] = TableOverride{Loader: LOADER_LOAD_DATA, DeferIndexes: &noDefer}
+
+	tests := []struct {
+		dedup string
+		want  []TablePlan
+	}{
+		{DEDUP_LOCAL, []TablePlan{
+			// not merged yet, ranged as if the merged csv had every row of both
+			{Sources: []string{"src_a", "src_b"}, Database: "db1", Table: "1", Size: 160, Ranges: 4,
+				BatchSize: 2000, CommitInterval: 40, Loader: LOADER_INSERT, OnConflict: CONFLICT_IGNORE, DeferredIndexes: []string{"KEY `idx_b` (`b`)"}},
+			{Sources: []string{"src_a", "src_b"}, Database: "db1", Table: "2", Size: 20, Ranges: 1,
+				BatchSize: 2000, CommitInterval: 40, Loader: LOADER_LOAD_DATA, OnConflict: CONFLICT_IGNORE},
+		}},
+		{DEDUP_SERVER, []TablePlan{
+			{Sources: []string{"src_a", "src_b"}, Database: "db1", Table: "1", Size: 160, Ranges: 3,
+				BatchSize: 2000, CommitInterval: 40, Loader: LOADER_INSERT, OnConflict: CONFLICT_NEWER, DeferredIndexes: []string{"KEY `idx_b` (`b`)"}},
+			{Sources: []string{"src_a", "src_b"}, Database: "db1", Table: "2", Size: 20, Ranges: 2,
+				BatchSize: 2000, CommitInterval: 40, Loader: LOADER_LOAD_DATA, OnConflict: CONFLICT_NEWER},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dedup, func(t *testing.T) {
+			settings.Dedup = tt.dedup
+			m, err := New(Options{SourceA: srca, SourceB: srcb, Settings: settings})
+			if err != nil {
+				t.Fatal(err)
+			}
+			plans, err := m.Plan(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(plans, tt.want) {
+				t.Errorf("Plan() = %+v\nwant %+v", plans, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	srca, srcb := newTestSources(t, nil)
+	settings := DefaultSettings()
+	settings.CheckpointPath = filepath.Join(t.TempDir(), "migration_log")
+	m, err := New(Options{SourceA: srca, SourceB: srcb, Settings: settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := m.checkpoints
+	// table 1 halfway: range 0 finished, range 1 at 150 of [100, 200)
+	cp.writeSeek("src_a", "db1", "1", 0)
+	cp.writeRangePlan("src_a", "db1", "1", []int{0, 100, 200})
+	cp.writeRangeSeek("src_a", "db1", "1", 0, -1)
+	cp.writeRangeSeek("src_a", "db1", "1", 1, 150)
+	// table 2 finished, the ranges of the last run may not have been marked
+	cp.writeSeek("src_a", "db1", "2", -1)
+	cp.writeRangePlan("src_a", "db1", "2", []int{0, 80})
+
+	progress, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TableProgress{
+		{Source: "src_a", Database: "db1", Table: "1", State: StateLoading, Ranges: 2, Loaded: 150, Total: 200},
+		{Source: "src_a", Database: "db1", Table: "2", State: StateFinished, Ranges: 1, Loaded: 80, Total: 80},
+	}
+	if !reflect.DeepEqual(progress, want) {
+		t.Errorf("Status() = %+v\nwant %+v", progress, want)
+	}
+
+	// each source on its own with DEDUP_SERVER, src_b hasn't started
+	m.settings.Dedup = DEDUP_SERVER
+	progress, err = m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(progress) != 4 || progress[1] != (TableProgress{Source: "src_b", Database: "db1", Table: "1", State: StatePending}) {
+		t.Errorf("Status() = %+v, want a pending src_b entry after each src_a entry", progress)
+	}
+}
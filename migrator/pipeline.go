@@ -0,0 +1,90 @@
+package migrator
+
+import (
+	"bytes"
+
+	"github.com/Emanatry/tdsql-migrate-go/csvrow"
+)
+
+// batches read and converted ahead of the one being sent, per range
+const PIPELINE_DEPTH = 2
+
+// a batch read from the csv, ready to be sent.
+// its buffers are reused for another batch once it's released.
+type parsedBatch struct {
+	rows  int  // csv lines
+	bytes int  // csv bytes
+	eof   bool // reached the end of the csv
+	seek  int  // csv position right after the batch, the checkpoint once it's committed
+
+	data  *csvrow.Batch // insert mode
+	sql   []byte        // insert mode with InterpolateParams
+	chunk bytes.Buffer  // loaddata mode
+
+	// the csv lines of the rows of data, kept when rejected rows go to a dead letter file
+	lines    []byte
+	lineEnds []int
+
+	err  error
+	free chan *parsedBatch
+}
+
+// the csv line of row i of data
+func (b *parsedBatch) line(i int) []byte {
+	start := 0
+	if i > 0 {
+		start = b.lineEnds[i-1]
+	}
+	return b.lines[start:b.lineEnds[i]]
+}
+
+// hand the buffers back to the producer, once the batch has been sent
+func (b *parsedBatch) release() {
+	select {
+	case b.free <- b:
+	default:
+	}
+}
+
+// read and convert the batches of [seek, end) in the background, so that the cpu work overlaps the
+// round trips of the batches before. the last batch sent has eof set or reaches end, or carries an error.
+// batches read ahead are simply dropped when stop is closed, the checkpoints follow what was sent.
+func (job *tableJob) produceBatches(csv *lineReader, seek int, end int, stop <-chan struct{}) <-chan *parsedBatch {
+	out := make(chan *parsedBatch, PIPELINE_DEPTH)
+	// one batch being read, PIPELINE_DEPTH queued and one being sent
+	free := make(chan *parsedBatch, PIPELINE_DEPTH+2)
+	for i := 0; i < PIPELINE_DEPTH+2; i++ {
+		b := &parsedBatch{free: free}
+		if job.loaderMode != LOADER_LOAD_DATA {
+			b.data = csvrow.NewBatch(job.columnKinds, job.m.loc)
+		}
+		free <- b
+	}
+	go func() {
+		for {
+			var b *parsedBatch
+			select {
+			case b = <-free:
+			case <-stop:
+				return
+			}
+			b.rows, b.bytes, b.eof, b.err = 0, 0, false, nil
+			b.lines, b.lineEnds = b.lines[:0], b.lineEnds[:0]
+			if job.loaderMode == LOADER_LOAD_DATA {
+				b.err = job.readLoadDataChunk(b, csv, seek, end)
+			} else {
+				b.err = job.readInsertBatch(b, csv, seek, end)
+			}
+			select {
+			case out <- b:
+			case <-stop:
+				return
+			}
+			if b.err != nil || b.eof || b.seek >= end {
+				return
+			}
+			seek = b.seek
+		}
+	}()
+	return out
+}
@@ -0,0 +1,128 @@
+package migrator
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Emanatry/tdsql-migrate-go/csvrow"
+	"github.com/Emanatry/tdsql-migrate-go/logging"
+)
+
+// lines of the 4 column test table, all of the same length
+func pipelineTestCSV(lines int) string {
+	var csv strings.Builder
+	for i := 1; i <= lines; i++ {
+		fmt.Fprintf(&csv, "%05d,%05d.5,abcdef,2021-12-12 00:00:00\n", i, i)
+	}
+	return csv.String()
+}
+
+func newPipelineTestJob() *tableJob {
+	job := &tableJob{m: &Migrator{settings: DefaultSettings(), log: logging.Discard(), loc: time.Local}, tablename: "t", columnNames: []string{"id", "a", "b", "updated_at"}, loaderMode: LOADER_INSERT}
+	job.columnKinds = []csvrow.Kind{csvrow.KindUint, csvrow.KindFloat, csvrow.KindBytes, csvrow.KindDatetime}
+	// the smallest batches, so that a few lines make several of them
+	job.batch = newBatchSizer(len(job.columnNames), batchSizeBuckets[0], defaultServerLimits.maxBatchBytes(), logging.Discard())
+	return job
+}
+
+// counts the bytes the producer has taken from the csv
+type countingReader struct {
+	r *strings.Reader
+	n int64 // accessed atomically
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func TestProduceBatches(t *testing.T) {
+	csv := pipelineTestCSV(120)
+	lineLen := len(csv) / 120
+	rows, _ := newPipelineTestJob().batch.limits()
+	tests := []struct {
+		name     string
+		seek     int
+		end      int
+		wantRows []int
+		wantEOF  bool
+	}{
+		{"whole file", 0, len(csv), []int{rows, rows, 120 - 2*rows}, false},
+		{"range", 10 * lineLen, 70 * lineLen, []int{rows, 60 - rows}, false},
+		// the end of the last range is past the file, the end is found by reading it
+		{"past the end", 100 * lineLen, len(csv) + 1, []int{20}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stop := make(chan struct{})
+			defer close(stop)
+			csvReader := &lineReader{r: bufio.NewReader(strings.NewReader(csv[tt.seek:]))}
+			batches := newPipelineTestJob().produceBatches(csvReader, tt.seek, tt.end, stop)
+
+			seek := tt.seek
+			for i, wantRows := range tt.wantRows {
+				b := <-batches
+				if b.err != nil {
+					t.Fatal(b.err)
+				}
+				args := b.data.Args()
+				if firstID := uint64(seek/lineLen + 1); *args[0].(*uint64) != firstID {
+					t.Fatalf("batch %d starts at id %v, want %d", i, *args[0].(*uint64), firstID)
+				}
+				seek += wantRows * lineLen
+				if b.rows != wantRows || b.seek != seek || len(args) != wantRows*4 {
+					t.Fatalf("batch %d: %d rows, %d args up to %d, want %d rows up to %d", i, b.rows, len(args), b.seek, wantRows, seek)
+				}
+				last := i == len(tt.wantRows)-1
+				if b.eof != (last && tt.wantEOF) {
+					t.Fatalf("batch %d: eof %v", i, b.eof)
+				}
+				b.release()
+			}
+			select {
+			case b := <-batches:
+				t.Fatalf("unexpected batch after the end: %+v", b)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestProduceBatchesError(t *testing.T) {
+	csv := pipelineTestCSV(10) + "x,00001.5,abcdef,2021-12-12 00:00:00\n" + pipelineTestCSV(10)
+	stop := make(chan struct{})
+	defer close(stop)
+	batches := newPipelineTestJob().produceBatches(&lineReader{r: bufio.NewReader(strings.NewReader(csv))}, 0, len(csv), stop)
+
+	b := <-batches
+	if b.err == nil || !strings.Contains(b.err.Error(), "seek pos 410") {
+		t.Fatalf("got %+v, want the conversion error", b)
+	}
+	select {
+	case b := <-batches:
+		t.Fatalf("unexpected batch after an error: %+v", b)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestProduceBatchesStop(t *testing.T) {
+	csv := pipelineTestCSV(10000)
+	r := &countingReader{r: strings.NewReader(csv)}
+	stop := make(chan struct{})
+	batches := newPipelineTestJob().produceBatches(&lineReader{r: bufio.NewReader(r)}, 0, len(csv), stop)
+
+	<-batches
+	close(stop)
+	// the producer reads no more than its free batches, then gives up on the stop
+	time.Sleep(50 * time.Millisecond)
+	read := atomic.LoadInt64(&r.n)
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt64(&r.n) != read || read >= int64(len(csv)) {
+		t.Errorf("the producer kept reading after the stop: %d of %d bytes", atomic.LoadInt64(&r.n), len(csv))
+	}
+}
@@ -0,0 +1,68 @@
+package migrator
+
+import (
+	"context"
+	"os"
+
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+)
+
+// what a migration would do with a table, without touching the target
+type TablePlan struct {
+	Sources  []string // the sources loaded into the table, merged first unless DEDUP_SERVER
+	Database string
+	Table    string
+	Size     int64 // bytes of the source csv files
+	Merged   bool  // the merged csv is ready, Ranges is then exact
+	Ranges   int
+
+	BatchSize       int
+	CommitInterval  int
+	Loader          string
+	OnConflict      string
+	DeferredIndexes []string
+}
+
+// the plan of every table of the sources, with the settings of the Migrator
+func (m *Migrator) Plan(ctx context.Context) ([]TablePlan, error) {
+	var plans []TablePlan
+	for i, dba := range m.srca.Databases {
+		dbb := m.srcb.Databases[i]
+		for _, table := range dba.Tables {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			settings := m.settings.table(dba.Name, table)
+			p := TablePlan{
+				Sources:        []string{dba.SrcName, dbb.SrcName},
+				Database:       dba.Name,
+				Table:          table,
+				Size:           dba.TableDataSize(table) + dbb.TableDataSize(table),
+				BatchSize:      settings.batchSize,
+				CommitInterval: settings.commitInterval,
+				Loader:         settings.loader,
+				OnConflict:     settings.conflict,
+			}
+			if m.settings.Dedup == DEDUP_SERVER {
+				// each source's csv is split on its own
+				p.Ranges = m.settings.rangeCount(dba.TableDataSize(table)) + m.settings.rangeCount(dbb.TableDataSize(table))
+			} else if csvPath, ok := srcreader.MergedTablePath(dba, dbb, table); ok {
+				p.Merged = true
+				if info, err := os.Stat(csvPath); err == nil {
+					p.Ranges = m.settings.rangeCount(info.Size())
+				}
+			} else {
+				p.Ranges = m.settings.rangeCount(p.Size) // the merged csv is at most the size of both
+			}
+			if settings.deferIndexes {
+				sqlfile, err := dba.ReadSQL(table)
+				if err != nil {
+					return nil, err
+				}
+				_, p.DeferredIndexes = splitDeferredIndexes(sqlfile)
+			}
+			plans = append(plans, p)
+		}
+	}
+	return plans, nil
+}
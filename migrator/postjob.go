@@ -1,14 +1,17 @@
 package migrator
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 )
 
 // run after all databases and tables from all sources are fully migrated
-func PostJob(db *sql.DB) error {
-	println("* postjob started")
+func (m *Migrator) PostJob() error {
+	if m.db == nil {
+		return errNoTarget
+	}
+	db := m.db
+	m.log.Infof("postjob started")
 
 	tx0, err := db.Begin()
 	if err != nil {
@@ -32,7 +35,7 @@ func PostJob(db *sql.DB) error {
 
 	for i, dbname := range dbnames {
 		tablename := tablenames[i]
-		fmt.Printf("* removing temp_prikey of %s.%s from migration_log\n", dbname, tablename)
+		m.log.With("db", dbname, "table", tablename).Infof("removing temp_prikey from migration_log")
 		_, err = db.Exec("UPDATE meta_migration.migration_log SET temp_prikey = 0 WHERE dbname = ? AND tablename = ?;", dbname, tablename)
 		if err != nil {
 			return fmt.Errorf("postjob failed updating migration log for %s.%s after removing temp_prikey: %s", dbname, tablename, err.Error())
@@ -47,33 +50,37 @@ func PostJob(db *sql.DB) error {
 	// DDL statement triggers a implicit commit, so should do it after updating meta_migration
 	// HOWEVER, bad thing could happen if the program is stopped right now, and might result in extra primary keys not being deleted.
 
-	fmt.Printf("=== all temp_prikeys has been committed into migration_log\n")
-	fmt.Printf("=== start actually dropping primary keys.\n") // if the program stops right now, primary keys might not have been dropped yet.
+	m.log.Infof("all temp_prikeys has been committed into migration_log")
+	m.log.Infof("start actually dropping primary keys") // if the program stops right now, primary keys might not have been dropped yet.
 	// TODO: potential solution: use a log locally to record if each temp primary key has actually been dropped yet.
 
 	for i, dbname := range dbnames {
 		tablename := tablenames[i]
-		fmt.Printf("* removing temp prikey from %s.%s\n", dbname, tablename)
+		m.log.With("db", dbname, "table", tablename).Infof("removing temp prikey")
 		_, err = db.Exec(fmt.Sprintf("ALTER TABLE `%s`.`%s` DROP PRIMARY KEY;", dbname, tablename))
 		if err != nil {
 			// return fmt.Errorf("postjob failed dropping temp primary key for %s.%s: %s", dbname, tablename, err.Error())
-			fmt.Printf("error: postjob failed dropping temp primary key for %s.%s: %s\n", dbname, tablename, err.Error())
+			m.log.With("db", dbname, "table", tablename).Errorf("postjob failed dropping temp primary key: %s", err.Error())
 			// this error has been temporarily softened so that it would not cause a panic at the very last stage of the operation
 		}
 	}
 
-	println("* postjob finished")
+	m.log.Infof("postjob finished")
 	return nil
 }
 
-func PostJobDropMetaMigration(db *sql.DB) error {
-	println("* postjob started drop meta_migration")
+// drop the bookkeeping of the migration in the target
+func (m *Migrator) DropMetaMigration() error {
+	if m.db == nil {
+		return errNoTarget
+	}
+	m.log.Infof("postjob started drop meta_migration")
 
-	_, err := db.Exec("DROP DATABASE meta_migration;")
+	_, err := m.db.Exec("DROP DATABASE meta_migration;")
 	if err != nil {
 		return err
 	}
 
-	println("* postjob drop meta_migration finished")
+	m.log.Infof("postjob drop meta_migration finished")
 	return nil
 }
@@ -0,0 +1,13 @@
+package migrator
+
+// creates `meta_migration` in the target, compiled in so that the binary runs from any directory
+const prepareSQL = "CREATE DATABASE IF NOT EXISTS `meta_migration`;\n" +
+	"USE `meta_migration`;\n" +
+	"CREATE TABLE IF NOT EXISTS `migration_log` (\n" +
+	"  `dbname` varchar(255) NOT NULL,\n" +
+	"  `tablename` varchar(255) NOT NULL,\n" +
+	"  `src` varchar(255) NOT NULL,\n" +
+	"  `seek` bigint(32) NOT NULL,\n" +
+	"  `temp_prikey` int(16) NOT NULL,\n" +
+	"  PRIMARY KEY (`dbname`,`tablename`,`src`)\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8 shardkey=noshardkey_allset;\n"
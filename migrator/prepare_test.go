@@ -0,0 +1,28 @@
+package migrator
+
+import (
+	"strings"
+	"testing"
+)
+
+// PrepareTargetDB sends the statements of prepareSQL one by one
+func TestPrepareSQL(t *testing.T) {
+	var stmts []string
+	for _, stmt := range strings.Split(prepareSQL, ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+	want := []string{"CREATE DATABASE IF NOT EXISTS `meta_migration`", "USE `meta_migration`", "CREATE TABLE IF NOT EXISTS `migration_log` ("}
+	if len(stmts) != len(want) {
+		t.Fatalf("%d statements, want %d: %q", len(stmts), len(want), stmts)
+	}
+	for i := range want {
+		if !strings.HasPrefix(stmts[i], want[i]) {
+			t.Errorf("statement %d = %q, want %q...", i, stmts[i], want[i])
+		}
+	}
+	if !strings.HasSuffix(stmts[2], "shardkey=noshardkey_allset") {
+		t.Errorf("migration_log isn't created unsharded: %q", stmts[2])
+	}
+}
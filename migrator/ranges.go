@@ -0,0 +1,87 @@
+package migrator
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// split the merged csv of a table into line aligned byte ranges, or load the plan of a previous run.
+// status is the table's seek.txt: -2 for a fresh start, or the seek of a run from before ranges existed.
+func (job *tableJob) planRanges(status int) error {
+	m, src, dbname, tablename := job.m, job.srcdba.SrcName, job.srcdba.Name, job.tablename
+	boundaries, err := m.checkpoints.readRangePlan(src, dbname, tablename)
+	if err != nil {
+		return err
+	}
+	if boundaries == nil {
+		if status > 0 {
+			// resumed from a single seek, keep loading it as one range
+			boundaries = []int{0, int(job.csvSize)}
+			if err = m.checkpoints.writeRangeSeek(src, dbname, tablename, 0, status); err != nil {
+				return err
+			}
+		} else {
+			boundaries, err = splitCsv(job.csvPath, int(job.csvSize), m.settings.rangeCount(job.csvSize))
+			if err != nil {
+				return err
+			}
+		}
+		if err = m.checkpoints.writeRangePlan(src, dbname, tablename, boundaries); err != nil {
+			return err
+		}
+		job.log.Infof("split into %d range(s): %v", len(boundaries)-1, boundaries)
+	}
+
+	job.rangeCount = len(boundaries) - 1
+	for i := 0; i+1 < len(boundaries); i++ {
+		seek, err := m.checkpoints.readRangeSeek(src, dbname, tablename, i)
+		if err != nil {
+			return err
+		}
+		if seek == -1 {
+			job.loaded += int64(boundaries[i+1] - boundaries[i])
+			continue
+		}
+		if seek == -2 {
+			seek = boundaries[i]
+		}
+		job.loaded += int64(seek - boundaries[i])
+		job.ranges = append(job.ranges, &csvRange{job: job, index: i, start: boundaries[i], end: boundaries[i+1], seek: seek})
+	}
+	return nil
+}
+
+// returns the boundaries of n ranges [b0, b1), [b1, b2)..., each one starting at the beginning of a line.
+// fewer ranges are returned if some of them would be empty.
+func splitCsv(path string, size int, n int) ([]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	boundaries := []int{0}
+	for i := 1; i < n; i++ {
+		pos := size / n * i
+		if pos <= boundaries[len(boundaries)-1] {
+			continue
+		}
+		// move forward to the start of the next line
+		if _, err = f.Seek(int64(pos-1), 0); err != nil {
+			return nil, err
+		}
+		line, err := bufio.NewReader(f).ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		pos += len(line) - 1
+		if pos >= size {
+			break
+		}
+		if pos > boundaries[len(boundaries)-1] {
+			boundaries = append(boundaries, pos)
+		}
+	}
+	return append(boundaries, size), nil
+}
@@ -0,0 +1,200 @@
+package migrator
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Emanatry/tdsql-migrate-go/logging"
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+)
+
+func writeCsv(t *testing.T, dir string, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "1.csv")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// every boundary but the last has to be the start of a line
+func checkLineAligned(t *testing.T, content string, boundaries []int) {
+	t.Helper()
+	if boundaries[0] != 0 || boundaries[len(boundaries)-1] != len(content) {
+		t.Fatalf("boundaries %v don't cover [0, %d)", boundaries, len(content))
+	}
+	for i := 1; i < len(boundaries); i++ {
+		if boundaries[i] <= boundaries[i-1] {
+			t.Fatalf("boundaries %v aren't increasing", boundaries)
+		}
+		if i < len(boundaries)-1 && content[boundaries[i]-1] != '\n' {
+			t.Fatalf("boundary %d of %v isn't at the start of a line", boundaries[i], boundaries)
+		}
+	}
+}
+
+func TestSplitCsv(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		n       int
+		want    []int
+	}{
+		{"one range", "1,a\n2,b\n", 1, []int{0, 8}},
+		// 4 lines of 4 bytes, the split point 8 is the start of a line
+		{"split right after a newline", "1,a\n2,b\n3,c\n4,d\n", 2, []int{0, 8, 16}},
+		// 16/3 = 5, moved forward to 8, 10 to 12
+		{"split inside lines", "1,a\n2,b\n3,c\n4,d\n", 3, []int{0, 8, 12, 16}},
+		{"no trailing newline", "1,a\n2,b\n3,c\n4,d", 2, []int{0, 8, 15}},
+		// the second split point lands in the last line, which has no newline
+		{"split in a last line without newline", "1,a\n2,bbbbbbbbbbb", 2, []int{0, 17}},
+		{"one long line", "1,aaaaaaaaaaaaaaaaaaaa\n", 4, []int{0, 23}},
+		{"more ranges than lines", "1,a\n2,b\n", 8, []int{0, 4, 8}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeCsv(t, t.TempDir(), tt.content)
+			got, err := splitCsv(path, len(tt.content), tt.n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitCsv(%q, %d) = %v, want %v", tt.content, tt.n, got, tt.want)
+			}
+			checkLineAligned(t, tt.content, got)
+		})
+	}
+}
+
+func TestSplitCsvLineAligned(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 1000; i++ {
+		b.WriteString(strings.Repeat("x", i%37))
+		b.WriteString(",1\n")
+	}
+	content := b.String()
+	path := writeCsv(t, t.TempDir(), content)
+	for n := 1; n <= 64; n++ {
+		got, err := splitCsv(path, len(content), n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got)-1 > n {
+			t.Fatalf("splitCsv into %d ranges returned %d", n, len(got)-1)
+		}
+		checkLineAligned(t, content, got)
+	}
+}
+
+func newRangeTestJob(t *testing.T, content string, settings Settings) *tableJob {
+	t.Helper()
+	dir := t.TempDir()
+	m := &Migrator{settings: settings, log: logging.Discard(), checkpoints: migrationLog{root: filepath.Join(dir, "migration_log")}}
+	return &tableJob{
+		m:         m,
+		srcdba:    &srcreader.SrcDatabase{SrcName: "src_a", Name: "db1"},
+		tablename: "1",
+		csvPath:   writeCsv(t, dir, content),
+		csvSize:   int64(len(content)),
+		log:       logging.Discard(),
+	}
+}
+
+func rangeBounds(job *tableJob) [][3]int {
+	var got [][3]int
+	for _, r := range job.ranges {
+		got = append(got, [3]int{r.start, r.end, r.seek})
+	}
+	return got
+}
+
+func TestPlanRanges(t *testing.T) {
+	content := "1,a\n2,b\n3,c\n4,d\n"
+
+	t.Run("smaller than MinRangeSize", func(t *testing.T) {
+		settings := DefaultSettings()
+		settings.RangesPerTable = 4
+		settings.MinRangeSize = 1024
+		job := newRangeTestJob(t, content, settings)
+		if err := job.planRanges(-2); err != nil {
+			t.Fatal(err)
+		}
+		if want := [][3]int{{0, 16, 0}}; job.rangeCount != 1 || !reflect.DeepEqual(rangeBounds(job), want) {
+			t.Errorf("ranges = %v (count %d), want %v", rangeBounds(job), job.rangeCount, want)
+		}
+		if job.loaded != 0 {
+			t.Errorf("loaded = %d, want 0", job.loaded)
+		}
+	})
+
+	t.Run("split and saved", func(t *testing.T) {
+		settings := DefaultSettings()
+		settings.RangesPerTable = 2
+		settings.MinRangeSize = 8
+		job := newRangeTestJob(t, content, settings)
+		if err := job.planRanges(-2); err != nil {
+			t.Fatal(err)
+		}
+		if want := [][3]int{{0, 8, 0}, {8, 16, 8}}; !reflect.DeepEqual(rangeBounds(job), want) {
+			t.Errorf("ranges = %v, want %v", rangeBounds(job), want)
+		}
+		plan, err := job.m.checkpoints.readRangePlan("src_a", "db1", "1")
+		if err != nil || !reflect.DeepEqual(plan, []int{0, 8, 16}) {
+			t.Errorf("saved plan = %v, %v, want [0 8 16]", plan, err)
+		}
+	})
+
+	t.Run("resumed from the saved plan", func(t *testing.T) {
+		settings := DefaultSettings()
+		settings.RangesPerTable = 2
+		settings.MinRangeSize = 8
+		job := newRangeTestJob(t, content, settings)
+		cp := job.m.checkpoints
+		if err := cp.writeRangePlan("src_a", "db1", "1", []int{0, 8, 16}); err != nil {
+			t.Fatal(err)
+		}
+		cp.writeRangeSeek("src_a", "db1", "1", 0, -1)
+		cp.writeRangeSeek("src_a", "db1", "1", 1, 12)
+		// a different MinRangeSize mustn't change the ranges of the checkpoints
+		job.m.settings.MinRangeSize = 1
+		if err := job.planRanges(12); err != nil {
+			t.Fatal(err)
+		}
+		if want := [][3]int{{8, 16, 12}}; job.rangeCount != 2 || !reflect.DeepEqual(rangeBounds(job), want) {
+			t.Errorf("ranges = %v (count %d), want %v", rangeBounds(job), job.rangeCount, want)
+		}
+		if job.loaded != 12 {
+			t.Errorf("loaded = %d, want 12", job.loaded)
+		}
+	})
+
+	t.Run("resumed from a migration_log of a single seek", func(t *testing.T) {
+		settings := DefaultSettings()
+		settings.RangesPerTable = 4
+		settings.MinRangeSize = 1
+		job := newRangeTestJob(t, content, settings)
+		// the seek.txt of a run from before ranges existed, 3 lines loaded
+		if err := job.m.checkpoints.writeSeek("src_a", "db1", "1", 12); err != nil {
+			t.Fatal(err)
+		}
+		if err := job.planRanges(12); err != nil {
+			t.Fatal(err)
+		}
+		if want := [][3]int{{0, 16, 12}}; job.rangeCount != 1 || !reflect.DeepEqual(rangeBounds(job), want) {
+			t.Errorf("ranges = %v (count %d), want %v", rangeBounds(job), job.rangeCount, want)
+		}
+		if job.loaded != 12 {
+			t.Errorf("loaded = %d, want 12", job.loaded)
+		}
+		cp := job.m.checkpoints
+		if plan, _ := cp.readRangePlan("src_a", "db1", "1"); !reflect.DeepEqual(plan, []int{0, 16}) {
+			t.Errorf("saved plan = %v, want [0 16]", plan)
+		}
+		if seek, _ := cp.readRangeSeek("src_a", "db1", "1", 0); seek != 12 {
+			t.Errorf("range 0 checkpoint = %d, want 12", seek)
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package migrator
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/Emanatry/tdsql-migrate-go/stats"
+	"github.com/go-sql-driver/mysql"
+)
+
+const RETRY_MAX_ATTEMPTS = 8
+const RETRY_BASE_DELAY = 500 * time.Millisecond
+const RETRY_MAX_DELAY = 30 * time.Second
+
+// mysql error numbers that are worth retrying, and the reason reported in stats.
+// TDSQL proxy hiccups (set switching, proxy restart) usually surface as one of the
+// connection errors below; add proxy specific numbers here if we ever see them.
+var retryableMySQLErrors = map[uint16]string{
+	1040: "too_many_connections", // ER_CON_COUNT_ERROR
+	1053: "server_shutdown",      // ER_SERVER_SHUTDOWN
+	1158: "net_error",            // ER_NET_READ_ERROR
+	1159: "net_error",            // ER_NET_READ_INTERRUPTED
+	1160: "net_error",            // ER_NET_ERROR_ON_WRITE
+	1161: "net_error",            // ER_NET_WRITE_INTERRUPTED
+	1205: "lock_wait_timeout",    // ER_LOCK_WAIT_TIMEOUT
+	1213: "deadlock",             // ER_LOCK_DEADLOCK
+	1927: "connection_killed",    // ER_CONNECTION_KILLED
+	2006: "server_gone",          // CR_SERVER_GONE_ERROR
+	2013: "connection_lost",      // CR_SERVER_LOST
+}
+
+// returned by withRetry when it gives up, so that an outer withRetry won't retry it again
+type retriesExhaustedError struct {
+	what     string
+	attempts int
+	err      error
+}
+
+func (e *retriesExhaustedError) Error() string {
+	return fmt.Sprintf("giving up %s after %d attempts: %s", e.what, e.attempts, e.err.Error())
+}
+
+func (e *retriesExhaustedError) Unwrap() error {
+	return e.err
+}
+
+// classify an error returned by the driver.
+// retryable errors are transient, the work since the last commit is lost and has to be redone from the last checkpoint.
+func classifyError(err error) (retryable bool, reason string) {
+	if err == nil {
+		return false, ""
+	}
+	var exhausted *retriesExhaustedError
+	if errors.As(err, &exhausted) {
+		return false, ""
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		reason, ok := retryableMySQLErrors[mysqlErr.Number]
+		return ok, reason
+	}
+	if errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true, "connection_lost"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true, "net_error"
+	}
+	return false, ""
+}
+
+// exponential backoff with equal jitter: half the delay plus a random part of the other half,
+// so that a retry never comes right after the failure. attempt starts from 1
+func retryDelay(attempt int) time.Duration {
+	delay := RETRY_MAX_DELAY
+	if attempt < 16 {
+		if d := RETRY_BASE_DELAY << uint(attempt-1); d < delay {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// wait for d, returns false if ctx is cancelled first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// run fn until it succeeds, fails with a non-retryable error, or RETRY_MAX_ATTEMPTS is reached.
+// fn must be safe to run again from the start, e.g. by resuming from the last checkpoint.
+func (m *Migrator) withRetry(ctx context.Context, what string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		retryable, reason := classifyError(err)
+		if !retryable {
+			return err
+		}
+		if attempt >= RETRY_MAX_ATTEMPTS {
+			return &retriesExhaustedError{what, attempt, err}
+		}
+		delay := retryDelay(attempt)
+		stats.ReportRetry(reason)
+		m.reportRetry()
+		m.log.Warnf("retry %d/%d %s in %.1fs (%s): %s", attempt, RETRY_MAX_ATTEMPTS-1, what, delay.Seconds(), reason, err.Error())
+		if !sleepContext(ctx, delay) {
+			return ErrInterrupted
+		}
+	}
+}
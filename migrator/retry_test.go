@@ -0,0 +1,78 @@
+package migrator
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+		reason    string
+	}{
+		{"nil", nil, false, ""},
+		{"plain", errors.New("boom"), false, ""},
+		{"too many connections", &mysql.MySQLError{Number: 1040}, true, "too_many_connections"},
+		{"server shutdown", &mysql.MySQLError{Number: 1053}, true, "server_shutdown"},
+		{"net read", &mysql.MySQLError{Number: 1158}, true, "net_error"},
+		{"net write interrupted", &mysql.MySQLError{Number: 1161}, true, "net_error"},
+		{"lock wait timeout", &mysql.MySQLError{Number: 1205}, true, "lock_wait_timeout"},
+		{"deadlock", &mysql.MySQLError{Number: 1213}, true, "deadlock"},
+		{"connection killed", &mysql.MySQLError{Number: 1927}, true, "connection_killed"},
+		{"server gone", &mysql.MySQLError{Number: 2006}, true, "server_gone"},
+		{"server lost", &mysql.MySQLError{Number: 2013}, true, "connection_lost"},
+		{"duplicate key", &mysql.MySQLError{Number: 1062}, false, ""},
+		{"data too long", &mysql.MySQLError{Number: 1406}, false, ""},
+		{"wrapped mysql", fmt.Errorf("failed inserting: %w", &mysql.MySQLError{Number: 1213}), true, "deadlock"},
+		{"invalid conn", mysql.ErrInvalidConn, true, "connection_lost"},
+		{"bad conn", driver.ErrBadConn, true, "connection_lost"},
+		{"eof", io.EOF, true, "connection_lost"},
+		{"unexpected eof", fmt.Errorf("reading: %w", io.ErrUnexpectedEOF), true, "connection_lost"},
+		{"reset", &net.OpError{Op: "read", Err: syscall.ECONNRESET}, true, "connection_lost"},
+		{"refused", syscall.ECONNREFUSED, true, "connection_lost"},
+		{"pipe", syscall.EPIPE, true, "connection_lost"},
+		{"net timeout", &net.DNSError{IsTimeout: true}, true, "net_error"},
+		{"exhausted", &retriesExhaustedError{"x", 8, &mysql.MySQLError{Number: 1213}}, false, ""},
+		{"wrapped exhausted", fmt.Errorf("table 1: %w", &retriesExhaustedError{"x", 8, io.EOF}), false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retryable, reason := classifyError(tt.err)
+			if retryable != tt.retryable || reason != tt.reason {
+				t.Errorf("classifyError(%v) = %v, %q, want %v, %q", tt.err, retryable, reason, tt.retryable, tt.reason)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempt := 1; attempt <= 40; attempt++ {
+		full := RETRY_MAX_DELAY
+		if attempt < 16 {
+			if d := RETRY_BASE_DELAY << uint(attempt-1); d < full {
+				full = d
+			}
+		}
+		for i := 0; i < 100; i++ {
+			d := retryDelay(attempt)
+			if d < full/2 || d > full {
+				t.Fatalf("retryDelay(%d) = %v, want between %v and %v", attempt, d, full/2, full)
+			}
+		}
+	}
+	if d := retryDelay(1); d > RETRY_BASE_DELAY {
+		t.Errorf("retryDelay(1) = %v, want at most %v", d, RETRY_BASE_DELAY)
+	}
+	if d := retryDelay(100); d < RETRY_MAX_DELAY/2 || d > RETRY_MAX_DELAY {
+		t.Errorf("retryDelay(100) = %v, want capped at %v", d, RETRY_MAX_DELAY)
+	}
+}
@@ -0,0 +1,160 @@
+package migrator
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/Emanatry/tdsql-migrate-go/logging"
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+	"github.com/Emanatry/tdsql-migrate-go/stats"
+)
+
+// a table waiting to be prepared, or one range of a prepared table waiting to be loaded
+type workItem struct {
+	srcdba *srcreader.SrcDatabase
+	srcdbb *srcreader.SrcDatabase
+	table  string
+	size   int64       // estimated from the size of the input csv files, or the bytes left in the range
+	rng    *csvRange   // nil for a table item
+	loads  *tableLoads // of a table item with DEDUP_SERVER, see tableLoads
+}
+
+// whether a table item can be prepared without waiting for its presort.
+// with DEDUP_SERVER the items have no srcdbb, each source's own csv is loaded as is.
+func (item *workItem) ready() bool {
+	return item.srcdbb == nil || srcreader.IsTableMerged(item.srcdba, item.srcdbb, item.table)
+}
+
+// hands out work items to the workers of Run.
+// ranges of tables already started come first, then tables whose presort output is ready, then the
+// largest tables, so that a huge table doesn't end up being started last; databases can be capped
+// with Settings.DatabaseConcurrencyCaps.
+type scheduler struct {
+	ctx      context.Context
+	settings *Settings
+	lock     sync.Mutex
+	cond     *sync.Cond
+	pending  []*workItem
+	running  map[string]int // number of running items per database
+	active   int            // number of running items, which may still add new items
+	limit    int            // max number of running items, adjusted by the concurrency controller
+}
+
+// the scheduler stops handing out items once ctx is cancelled
+func newScheduler(ctx context.Context, items []*workItem, settings *Settings) *scheduler {
+	s := &scheduler{
+		ctx:      ctx,
+		settings: settings,
+		running:  make(map[string]int),
+		limit:    settings.ConcurrentWorkers,
+	}
+	stats.SetGauge("workers", strconv.Itoa(s.limit))
+	s.cond = sync.NewCond(&s.lock)
+	s.add(items...)
+	go func() { // wake up the waiters on shutdown
+		<-ctx.Done()
+		s.lock.Lock()
+		s.cond.Broadcast()
+		s.lock.Unlock()
+	}()
+	return s
+}
+
+func (s *scheduler) add(items ...*workItem) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pending = append(s.pending, items...)
+	sort.SliceStable(s.pending, func(i, j int) bool {
+		if (s.pending[i].rng != nil) != (s.pending[j].rng != nil) {
+			return s.pending[i].rng != nil
+		}
+		return s.pending[i].size > s.pending[j].size
+	})
+	s.cond.Broadcast()
+}
+
+// index of the item to run next, -1 if every pending item is blocked by its database cap
+func (s *scheduler) pick() int {
+	best := -1
+	for i, item := range s.pending {
+		if c := s.settings.databaseConcurrencyCap(item.srcdba.Name); c > 0 && s.running[item.srcdba.Name] >= c {
+			continue
+		}
+		// pending is sorted by kind and size, so the first ready item is the largest range or ready table
+		if item.rng != nil || item.ready() {
+			return i
+		}
+		if best == -1 {
+			best = i
+		}
+	}
+	return best
+}
+
+// blocks until an item can be run, returns nil when the scheduler's ctx is cancelled or there's
+// nothing left, which includes no running item that could add more
+func (s *scheduler) next() *workItem {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for {
+		if s.ctx.Err() != nil || (len(s.pending) == 0 && s.active == 0) {
+			return nil
+		}
+		if s.active >= s.limit {
+			s.cond.Wait()
+			continue
+		}
+		if i := s.pick(); i >= 0 {
+			item := s.pending[i]
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			s.running[item.srcdba.Name]++
+			s.active++
+			return item
+		}
+		s.cond.Wait()
+	}
+}
+
+// mark an item returned by next as finished
+func (s *scheduler) done(item *workItem) {
+	s.lock.Lock()
+	s.running[item.srcdba.Name]--
+	s.active--
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
+
+func (s *scheduler) setLimit(limit int) {
+	s.lock.Lock()
+	s.limit = limit
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	stats.SetGauge("workers", strconv.Itoa(limit))
+}
+
+// the current limit and the number of running items
+func (s *scheduler) getLimit() (limit int, active int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.limit, s.active
+}
+
+// remove and return every pending item, used to account for the items left after a shutdown
+func (s *scheduler) drain() []*workItem {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	items := s.pending
+	s.pending = nil
+	return items
+}
+
+func (s *scheduler) printQueue(log *logging.Logger) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	log.Infof("%d table(s) scheduled, largest first", len(s.pending))
+	for _, item := range s.pending {
+		log.With("source", item.srcdba.SrcName, "db", item.srcdba.Name, "table", item.table).Infof("scheduled, %.1f MB (ready: %v)", float64(item.size)/1024/1024, item.ready())
+	}
+}
@@ -0,0 +1,216 @@
+package migrator
+
+import (
+	"errors"
+	"fmt"
+)
+
+// everything that shapes a migration, see DefaultSettings for the defaults
+type Settings struct {
+	// rows per insert batch to start from, and batches per transaction.
+	// they can be overridden per database and per table, see Tables.
+	BatchSize      int
+	CommitInterval int
+
+	// number of tables (or ranges of tables) migrated at the same time, across all databases.
+	// the starting point when Adaptive is on
+	ConcurrentWorkers int
+	// grow or shrink the number of active workers based on the live throughput
+	Adaptive bool
+
+	// large tables are split into up to RangesPerTable byte ranges of at least MinRangeSize bytes,
+	// loaded concurrently by different workers
+	RangesPerTable int
+	MinRangeSize   int64
+
+	// max workers on the same database at the same time, 0 for no limit, and per database overrides
+	ConcurrentTablesPerDatabase int
+	DatabaseConcurrencyCaps     map[string]int
+
+	// stop all other tables as soon as one table fails, instead of migrating everything else first
+	FailFast bool
+
+	Dedup      string // DEDUP_LOCAL or DEDUP_SERVER
+	Loader     string // LOADER_INSERT or LOADER_LOAD_DATA
+	OnConflict string // CONFLICT_IGNORE, CONFLICT_REPLACE or CONFLICT_NEWER
+
+	// create the secondary (non-unique) indexes of a table after its rows are loaded, instead of
+	// maintaining them row by row. they are added back in one ALTER TABLE once the table is finished.
+	// on by default for every secondary index of every table, not only the KEY(id,b) of table 4 that
+	// used to be deferred.
+	DeferIndexes bool
+
+	// send the batches as one INSERT with literal values instead of server-side prepared statements,
+	// for proxies where preparing statements with thousands of placeholders is slow or unsupported
+	Interpolate bool
+
+	// per database ("db") and per table ("db.table") overrides
+	Tables map[string]TableOverride
+
+	// session variables of the loading connections
+	Session SessionConfig
+
+	// dir of the checkpoints, a rerun with the same dir resumes from them
+	CheckpointPath string
+
+	// rows the target rejects under a strict sql_mode (too long, out of range, invalid date...) are
+	// isolated from their batch and written with the error to <DeadLetterPath>/<src>/<db>/<table>.csv,
+	// the rest of the table is loaded. a table fails once more than DeadLetterLimit of its rows are
+	// rejected, 0 (the default) fails it on the first one. insert loader only, it can't be set with
+	// LOADER_LOAD_DATA for any table.
+	DeadLetterLimit int
+	DeadLetterPath  string
+
+	// log a line for every batch sent
+	LogBatches bool
+}
+
+func DefaultSettings() Settings {
+	return Settings{
+		BatchSize:         2000,
+		CommitInterval:    40,
+		ConcurrentWorkers: 7,
+		Adaptive:          true,
+		RangesPerTable:    4,
+		MinRangeSize:      32 * 1024 * 1024,
+
+		DatabaseConcurrencyCaps: map[string]int{},
+
+		Dedup:        DEDUP_LOCAL,
+		Loader:       LOADER_INSERT,
+		OnConflict:   CONFLICT_IGNORE,
+		DeferIndexes: true,
+		Tables:       map[string]TableOverride{},
+
+		Session: SessionConfig{
+			DisableUniqueChecks:     true,
+			DisableForeignKeyChecks: true,
+		},
+
+		CheckpointPath:  "./migration_log",
+		DeadLetterLimit: 0,
+		DeadLetterPath:  "./dead_letter",
+		LogBatches:      true,
+	}
+}
+
+// the settings a migration can't run with, the config package reports them in more detail
+func (s *Settings) validate() error {
+	switch {
+	case s.BatchSize < MIN_BATCH_SIZE || s.BatchSize > MAX_BATCH_SIZE:
+		return fmt.Errorf("batch size must be between %d and %d, got %d", MIN_BATCH_SIZE, MAX_BATCH_SIZE, s.BatchSize)
+	case s.CommitInterval < 1:
+		return fmt.Errorf("commit interval must be at least 1, got %d", s.CommitInterval)
+	case s.ConcurrentWorkers < 1:
+		return fmt.Errorf("concurrent workers must be at least 1, got %d", s.ConcurrentWorkers)
+	case s.Adaptive && s.ConcurrentWorkers > ADAPTIVE_MAX_WORKERS:
+		return fmt.Errorf("concurrent workers must be at most %d when adaptive, got %d", ADAPTIVE_MAX_WORKERS, s.ConcurrentWorkers)
+	case s.RangesPerTable < 1 || s.MinRangeSize < 1:
+		return errors.New("ranges per table and min range size must be positive")
+	case s.Dedup != DEDUP_LOCAL && s.Dedup != DEDUP_SERVER:
+		return fmt.Errorf("unknown dedup mode %q", s.Dedup)
+	case s.Loader != LOADER_INSERT && s.Loader != LOADER_LOAD_DATA:
+		return fmt.Errorf("unknown loader %q", s.Loader)
+	case s.OnConflict != CONFLICT_IGNORE && s.OnConflict != CONFLICT_REPLACE && s.OnConflict != CONFLICT_NEWER:
+		return fmt.Errorf("unknown conflict policy %q", s.OnConflict)
+	case s.CheckpointPath == "":
+		return errors.New("no checkpoint path")
+	case s.DeadLetterLimit < 0:
+		return fmt.Errorf("dead letter limit must not be negative, got %d", s.DeadLetterLimit)
+	case s.DeadLetterLimit > 0 && s.DeadLetterPath == "":
+		return errors.New("no dead letter path")
+	}
+	if s.DeadLetterLimit > 0 {
+		if s.Loader == LOADER_LOAD_DATA {
+			return errors.New("dead letters need the insert loader")
+		}
+		for key, o := range s.Tables {
+			if o.Loader == LOADER_LOAD_DATA {
+				return fmt.Errorf("dead letters need the insert loader, %s uses %s", key, o.Loader)
+			}
+		}
+	}
+	if _, err := SessionLocation(s.Session.TimeZone); err != nil {
+		return err
+	}
+	return nil
+}
+
+// settings of a database ("db") or of a table ("db.table"), zero values inherit.
+// a table's entry takes precedence over its database's, which takes precedence over the global settings.
+type TableOverride struct {
+	BatchSize      int    `json:"batch_size,omitempty"`
+	CommitInterval int    `json:"commit_interval,omitempty"`
+	Loader         string `json:"loader,omitempty"`      // LOADER_INSERT or LOADER_LOAD_DATA
+	OnConflict     string `json:"on_conflict,omitempty"` // CONFLICT_IGNORE, CONFLICT_REPLACE or CONFLICT_NEWER
+	DeferIndexes   *bool  `json:"defer_indexes,omitempty"`
+}
+
+// the effective settings of a table
+type tableSettings struct {
+	batchSize      int
+	commitInterval int
+	loader         string
+	conflict       string
+	deferIndexes   bool
+}
+
+func (s *Settings) table(dbname string, tablename string) tableSettings {
+	t := tableSettings{
+		batchSize:      s.BatchSize,
+		commitInterval: s.CommitInterval,
+		loader:         s.Loader,
+		conflict:       s.OnConflict,
+		deferIndexes:   s.DeferIndexes,
+	}
+	for _, key := range []string{dbname, dbname + "." + tablename} {
+		o, ok := s.Tables[key]
+		if !ok {
+			continue
+		}
+		if o.BatchSize > 0 {
+			t.batchSize = o.BatchSize
+		}
+		if o.CommitInterval > 0 {
+			t.commitInterval = o.CommitInterval
+		}
+		if o.Loader != "" {
+			t.loader = o.Loader
+		}
+		if o.OnConflict != "" {
+			t.conflict = o.OnConflict
+		}
+		if o.DeferIndexes != nil {
+			t.deferIndexes = *o.DeferIndexes
+		}
+	}
+	if s.Dedup == DEDUP_SERVER {
+		t.conflict = CONFLICT_NEWER // the rows of the other source may already be there
+	}
+	return t
+}
+
+// max number of tables of a database migrated at the same time, 0 for no limit
+func (s *Settings) databaseConcurrencyCap(dbname string) int {
+	if c, ok := s.DatabaseConcurrencyCaps[dbname]; ok {
+		return c
+	}
+	return s.ConcurrentTablesPerDatabase
+}
+
+// number of ranges to split a merged csv of the given size into
+func (s *Settings) rangeCount(size int64) int {
+	n := int(size / s.MinRangeSize)
+	if n > s.RangesPerTable {
+		n = s.RangesPerTable
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// where the rows of the two sources are deduplicated: merged locally by sortmerge before loading,
+// or each source loaded on its own and merged by the target, keeping the latest updated_at
+const DEDUP_LOCAL = "local"
+const DEDUP_SERVER = "server"
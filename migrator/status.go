@@ -0,0 +1,81 @@
+package migrator
+
+import (
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+)
+
+// states of a table in the migration log
+const (
+	StatePending  = "pending"
+	StateLoading  = "loading"
+	StateFinished = "finished"
+	StateFailed   = "failed" // only reported by Run, the checkpoints don't record failures
+)
+
+// progress of a table, read from the checkpoints of the migration log, or reported by Run as it goes
+type TableProgress struct {
+	Source   string
+	Database string
+	Table    string
+	State    string
+	Ranges   int   // ranges planned, 0 before the table is prepared
+	Loaded   int64 // csv bytes committed
+	Total    int64 // csv bytes to load, 0 before the table is prepared
+	Err      error // StateFailed only
+}
+
+// the progress of every table of the sources, from the checkpoints:
+// one entry per table keyed by the first source, or one per source and table with DEDUP_SERVER.
+func (m *Migrator) Status() ([]TableProgress, error) {
+	var progress []TableProgress
+	for i, dba := range m.srca.Databases {
+		dbs := []*srcreader.SrcDatabase{dba}
+		if m.settings.Dedup == DEDUP_SERVER {
+			dbs = append(dbs, m.srcb.Databases[i])
+		}
+		for _, table := range dba.Tables {
+			for _, srcdb := range dbs {
+				p, err := m.tableProgress(srcdb, table)
+				if err != nil {
+					return nil, err
+				}
+				progress = append(progress, p)
+			}
+		}
+	}
+	return progress, nil
+}
+
+func (m *Migrator) tableProgress(srcdb *srcreader.SrcDatabase, table string) (TableProgress, error) {
+	p := TableProgress{Source: srcdb.SrcName, Database: srcdb.Name, Table: table, State: StatePending}
+	status, err := m.checkpoints.readSeek(srcdb.SrcName, srcdb.Name, table)
+	if err != nil {
+		return p, err
+	}
+	if status == -2 {
+		return p, nil
+	}
+	p.State = StateLoading
+	if status == -1 {
+		p.State = StateFinished
+	}
+	boundaries, err := m.checkpoints.readRangePlan(srcdb.SrcName, srcdb.Name, table)
+	if err != nil || boundaries == nil {
+		return p, err
+	}
+	p.Ranges = len(boundaries) - 1
+	p.Total = int64(boundaries[len(boundaries)-1] - boundaries[0])
+	for i := 0; i+1 < len(boundaries); i++ {
+		seek, err := m.checkpoints.readRangeSeek(srcdb.SrcName, srcdb.Name, table, i)
+		if err != nil {
+			return p, err
+		}
+		switch {
+		case seek == -1 || status == -1:
+			p.Loaded += int64(boundaries[i+1] - boundaries[i])
+		case seek >= 0:
+			p.Loaded += int64(seek - boundaries[i])
+		}
+	}
+	return p, nil
+}
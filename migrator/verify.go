@@ -0,0 +1,305 @@
+package migrator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Emanatry/tdsql-migrate-go/csvrow"
+	"github.com/Emanatry/tdsql-migrate-go/srcreader"
+)
+
+// rows of a table in the target against the rows expected from the sources
+type TableCount struct {
+	Database string
+	Table    string
+	Expected int64 // lines of the merged csv, -1 if unknown (not merged, or DEDUP_SERVER)
+	Actual   int64
+}
+
+func (c TableCount) OK() bool {
+	return c.Expected < 0 || c.Expected == c.Actual
+}
+
+// count the rows of every table of the sources in the target
+func (m *Migrator) CountRows(ctx context.Context) ([]TableCount, error) {
+	if m.db == nil {
+		return nil, errNoTarget
+	}
+	var counts []TableCount
+	for i, dba := range m.srca.Databases {
+		dbb := m.srcb.Databases[i]
+		for _, table := range dba.Tables {
+			c := TableCount{Database: dba.Name, Table: table, Expected: -1}
+			if csvPath, ok := srcreader.MergedTablePath(dba, dbb, table); ok && m.settings.Dedup == DEDUP_LOCAL {
+				lines, err := countLines(csvPath)
+				if err != nil {
+					return nil, err
+				}
+				c.Expected = lines
+			}
+			err := m.queryRowSession(ctx, fmt.Sprintf("SELECT COUNT(*) FROM `%s`.`%s`;", dba.Name, table), &c.Actual)
+			if err != nil {
+				return nil, fmt.Errorf("failed counting rows of %s.%s: %w", dba.Name, table, err)
+			}
+			counts = append(counts, c)
+		}
+	}
+	return counts, nil
+}
+
+// run a query returning one row on a connection set up like the ones of the loaders, so that
+// TIMESTAMP values are rendered in the time_zone they were loaded in
+func (m *Migrator) queryRowSession(ctx context.Context, query string, dest ...interface{}) error {
+	conn, err := m.conns.checkout(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.QueryRowContext(ctx, query).Scan(dest...)
+}
+
+// number of lines of a file, a last line without '\n' included
+func countLines(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var lines int64
+	last := byte('\n')
+	buf := make([]byte, 1024*1024)
+	for {
+		n, err := f.Read(buf)
+		for _, c := range buf[:n] {
+			if c == '\n' {
+				lines++
+			}
+		}
+		if n > 0 {
+			last = buf[n-1]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if last != '\n' {
+		lines++
+	}
+	return lines, nil
+}
+
+// a chunk of a table: the rows whose leading key column is in (After, Upto], "" for no bound
+type ChunkChecksum struct {
+	Index      int
+	After      string
+	Upto       string
+	Start      int64  // byte offset of the chunk in the merged csv
+	Line       int    // line of the merged csv the chunk starts at
+	Rows       int64  // lines of the merged csv
+	TargetRows int64  // rows in the target
+	Sum        uint64 // sum of the CRC32 of the rows of the merged csv
+	TargetSum  uint64 // same in the target
+}
+
+func (c ChunkChecksum) OK() bool {
+	return c.Rows == c.TargetRows && c.Sum == c.TargetSum
+}
+
+// the checksums of a table in the target against the merged csv
+type TableChecksum struct {
+	Database string
+	Table    string
+	// the column the chunks are ranges of, "" if the table was checked as one chunk because its
+	// first column isn't an integer leading an index
+	KeyColumn string
+	// false without a merged csv (not merged yet, or DEDUP_SERVER): the table is count only, just
+	// TargetRows is known and nothing is compared
+	Checked    bool
+	Rows       int64
+	TargetRows int64
+	Chunks     int
+	Mismatches []ChunkChecksum
+	Err        error // the table couldn't be checked
+}
+
+func (c TableChecksum) OK() bool {
+	return c.Err == nil && len(c.Mismatches) == 0 && (!c.Checked || c.Rows == c.TargetRows)
+}
+
+// compare every table of the sources in the target with its merged csv: the row counts, and the
+// checksums of chunks of about chunkRows rows. the checksum of a chunk is the sum of the CRC32 of
+// its rows, so the order the target returns them in doesn't matter.
+// a table that can't be checked has its Err set, the error is only for a cancelled ctx.
+func (m *Migrator) VerifyChecksums(ctx context.Context, chunkRows int) ([]TableChecksum, error) {
+	if m.db == nil {
+		return nil, errNoTarget
+	}
+	if chunkRows < 1 {
+		return nil, fmt.Errorf("chunk rows must be at least 1, got %d", chunkRows)
+	}
+	var checksums []TableChecksum
+	for i, dba := range m.srca.Databases {
+		dbb := m.srcb.Databases[i]
+		for _, table := range dba.Tables {
+			if ctx.Err() != nil {
+				return checksums, ErrInterrupted
+			}
+			c := TableChecksum{Database: dba.Name, Table: table}
+			if csvPath, ok := srcreader.MergedTablePath(dba, dbb, table); ok && m.settings.Dedup == DEDUP_LOCAL {
+				c.Checked = true
+				c.Err = m.checksumTable(ctx, &c, csvPath, chunkRows)
+			} else {
+				c.Err = m.withRetry(ctx, "counting rows of "+dba.Name+"."+table, func() error {
+					return m.queryRowSession(ctx, fmt.Sprintf("SELECT COUNT(*) FROM `%s`.`%s`;", dba.Name, table), &c.TargetRows)
+				})
+			}
+			if ctx.Err() != nil {
+				return checksums, ErrInterrupted
+			}
+			if c.Err != nil {
+				m.tableLog(dba, table, "").Warnf("failed verifying: %s", c.Err.Error())
+			} else if c.Checked {
+				m.tableLog(dba, table, "").Infof("verified %d rows in %d chunk(s), %d mismatched", c.Rows, c.Chunks, len(c.Mismatches))
+			} else {
+				m.tableLog(dba, table, "").Infof("count only, %d rows in the target: no merged csv to checksum against", c.TargetRows)
+			}
+			checksums = append(checksums, c)
+		}
+	}
+	return checksums, nil
+}
+
+// stream the merged csv of a table, cutting it into chunks at changes of the leading key, and
+// compare each chunk with the same key range of the target
+func (m *Migrator) checksumTable(ctx context.Context, c *TableChecksum, csvPath string, chunkRows int) error {
+	cols, err := m.checksumColumns(c.Database, c.Table)
+	if err != nil {
+		return err
+	}
+	key := cols[0]
+	if key.kind == csvrow.KindInt || key.kind == csvrow.KindUint {
+		indexed, err := m.leadsAnIndex(c.Database, c.Table, key.name)
+		if err != nil {
+			return err
+		}
+		if indexed {
+			c.KeyColumn = key.name
+		}
+	}
+	if c.KeyColumn == "" {
+		m.log.With("db", c.Database, "table", c.Table).Infof("checked as one chunk, `%s` isn't an integer leading an index", key.name)
+	}
+
+	f, err := os.Open(csvPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 1024*1024)
+
+	query := fmt.Sprintf("SELECT COUNT(*), CAST(COALESCE(SUM(%s), 0) AS UNSIGNED) FROM `%s`.`%s`", rowChecksumExpr(cols), c.Database, c.Table)
+	chunk := ChunkChecksum{Line: 1}
+	// the next chunk starts at the given offset and line
+	flush := func(upto string, start int64, line int) error {
+		chunk.Upto = upto
+		q := query + chunk.where(c.KeyColumn)
+		what := fmt.Sprintf("checksumming %s.%s chunk %d", c.Database, c.Table, chunk.Index)
+		err := m.withRetry(ctx, what, func() error {
+			return m.queryRowSession(ctx, q+";", &chunk.TargetRows, &chunk.TargetSum)
+		})
+		if err != nil {
+			return fmt.Errorf("failed %s: %w", what, err)
+		}
+		c.Chunks++
+		c.Rows += chunk.Rows
+		c.TargetRows += chunk.TargetRows
+		if !chunk.OK() {
+			c.Mismatches = append(c.Mismatches, chunk)
+		}
+		chunk = ChunkChecksum{Index: chunk.Index + 1, After: upto, Start: start, Line: line}
+		return nil
+	}
+
+	var buf []byte
+	var lastKey uint64
+	var lastKeyText string
+	lineNumber := 0
+	offset := int64(0)
+	for {
+		line, readErr := r.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		lineStart := offset
+		offset += int64(len(line))
+		if len(line) > 0 {
+			lineNumber++
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			if c.KeyColumn != "" {
+				k, text, err := parseChunkKey(key.kind, line)
+				if err != nil {
+					return fmt.Errorf("%s line %d: %w", csvPath, lineNumber, err)
+				}
+				if chunk.Rows+c.Rows > 0 && k < lastKey {
+					return fmt.Errorf("%s line %d: the merged csv isn't sorted by `%s`", csvPath, lineNumber, key.name)
+				}
+				if chunk.Rows >= int64(chunkRows) && k != lastKey {
+					if err := flush(lastKeyText, lineStart, lineNumber); err != nil {
+						return err
+					}
+				}
+				lastKey, lastKeyText = k, text
+			}
+			var sum uint32
+			if sum, buf, err = rowChecksum(cols, line, buf); err != nil {
+				return fmt.Errorf("%s line %d: %w", csvPath, lineNumber, err)
+			}
+			chunk.Rows++
+			chunk.Sum += uint64(sum)
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	// the last chunk has no upper bound, rows of the target past the end of the csv are counted in it
+	return flush("", offset, lineNumber+1)
+}
+
+// the WHERE clause of the key range of the chunk, empty for a table checked as one chunk
+func (c ChunkChecksum) where(keyColumn string) string {
+	var conds []string
+	if c.After != "" {
+		conds = append(conds, fmt.Sprintf("`%s` > %s", keyColumn, c.After))
+	}
+	if c.Upto != "" {
+		conds = append(conds, fmt.Sprintf("`%s` <= %s", keyColumn, c.Upto))
+	}
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+// the leading key of a csv line, as a number ordered like the key and as canonical text
+func parseChunkKey(kind csvrow.Kind, line []byte) (uint64, string, error) {
+	f := bytes.TrimSpace(line)
+	if i := bytes.IndexByte(f, ','); i >= 0 {
+		f = f[:i]
+	}
+	if kind == csvrow.KindUint {
+		n, err := strconv.ParseUint(string(f), 10, 64)
+		return n, strconv.FormatUint(n, 10), err
+	}
+	n, err := strconv.ParseInt(string(f), 10, 64)
+	return uint64(n) ^ 1<<63, strconv.FormatInt(n, 10), err
+}
@@ -1,30 +1,136 @@
 package semaphore
 
 import (
+	"container/list"
+	"context"
 	"sync"
 )
 
+// weighted semaphore. waiters are served in FIFO order: a large waiter at the head of the queue
+// blocks smaller ones behind it, so it can't be starved by a stream of small acquisitions.
 type Semaphore struct {
-	val  int
-	cond *sync.Cond
+	size    int
+	cur     int // permits in use
+	lock    sync.Mutex
+	waiters list.List // of *waiter
+}
+
+type waiter struct {
+	n     int
+	ready chan struct{} // closed when the permits have been handed to the waiter
 }
 
 func New(val int) *Semaphore {
-	return &Semaphore{val, sync.NewCond(&sync.Mutex{})}
+	return &Semaphore{size: val}
 }
 
+// acquire one permit, blocking until it's available
 func (s *Semaphore) Acquire() {
-	s.cond.L.Lock()
-	for !(s.val > 0) {
-		s.cond.Wait()
+	s.AcquireContext(context.Background(), 1)
+}
+
+// acquire n permits, blocking until they are available or ctx is done.
+// returns ctx.Err() without holding any permit if ctx is done first.
+// asking for more permits than the size of the semaphore blocks until ctx is done.
+func (s *Semaphore) AcquireContext(ctx context.Context, n int) error {
+	s.lock.Lock()
+	if s.size-s.cur >= n && s.waiters.Len() == 0 {
+		s.cur += n
+		s.lock.Unlock()
+		return nil
+	}
+	if n > s.size {
+		s.lock.Unlock()
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	w := &waiter{n: n, ready: make(chan struct{})}
+	elem := s.waiters.PushBack(w)
+	s.lock.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.lock.Lock()
+		select {
+		case <-w.ready:
+			// acquired just after ctx was done, give the permits back
+			s.cur -= n
+			s.notifyWaiters()
+		default:
+			isFront := s.waiters.Front() == elem
+			s.waiters.Remove(elem)
+			if isFront && s.size > s.cur {
+				// the waiters behind may fit now that this one is gone
+				s.notifyWaiters()
+			}
+		}
+		s.lock.Unlock()
+		return ctx.Err()
+	}
+}
+
+// acquire n permits without blocking, returns false if they are not available
+func (s *Semaphore) TryAcquire(n int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.size-s.cur >= n && s.waiters.Len() == 0 {
+		s.cur += n
+		return true
 	}
-	s.val--
-	s.cond.L.Unlock()
+	return false
 }
 
+// release one permit
 func (s *Semaphore) Release() {
-	s.cond.L.Lock()
-	s.val++
-	s.cond.Signal()
-	s.cond.L.Unlock()
+	s.ReleaseN(1)
+}
+
+// release n permits, handing them to the waiters at the head of the queue.
+// panics if more permits are released than are held.
+func (s *Semaphore) ReleaseN(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if n > s.cur {
+		panic("semaphore: released more than held")
+	}
+	s.cur -= n
+	s.notifyWaiters()
+}
+
+// hand the free permits to the waiters at the head of the queue, in order
+func (s *Semaphore) notifyWaiters() {
+	for {
+		next := s.waiters.Front()
+		if next == nil {
+			break
+		}
+		w := next.Value.(*waiter)
+		if s.size-s.cur < w.n {
+			break // the head doesn't fit yet, and nobody may overtake it
+		}
+		s.cur += w.n
+		s.waiters.Remove(next)
+		close(w.ready)
+	}
+}
+
+// permits not in use
+func (s *Semaphore) Available() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.size - s.cur
+}
+
+// number of goroutines blocked in Acquire
+func (s *Semaphore) Waiters() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.waiters.Len()
+}
+
+func (s *Semaphore) Size() int {
+	return s.size
 }
@@ -0,0 +1,280 @@
+package semaphore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// a goroutine blocked in AcquireContext, acquired is closed once it holds its permits
+type asyncWaiter struct {
+	n        int
+	cancel   context.CancelFunc
+	acquired chan struct{}
+	err      chan error
+}
+
+// start acquiring n permits in the background and wait until the goroutine is in the queue
+func queueWaiter(t *testing.T, s *Semaphore, n int) *asyncWaiter {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &asyncWaiter{n: n, cancel: cancel, acquired: make(chan struct{}), err: make(chan error, 1)}
+	queued := s.Waiters()
+	go func() {
+		err := s.AcquireContext(ctx, n)
+		if err == nil {
+			close(w.acquired)
+		}
+		w.err <- err
+	}()
+	deadline := time.Now().Add(time.Second)
+	for s.Waiters() == queued {
+		if time.Now().After(deadline) {
+			t.Fatalf("waiter of %d never queued", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return w
+}
+
+// the indexes of the waiters holding their permits, the ones handed permits by a release are
+// marked acquired before ReleaseN returns, only their goroutines may lag behind
+func acquiredWaiters(t *testing.T, waiters []*asyncWaiter) []int {
+	t.Helper()
+	time.Sleep(10 * time.Millisecond)
+	var got []int
+	for i, w := range waiters {
+		select {
+		case <-w.acquired:
+			got = append(got, i)
+		default:
+		}
+	}
+	return got
+}
+
+func equalInts(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFIFOMixedWeights(t *testing.T) {
+	type step struct {
+		release      int
+		wantAcquired []int // every waiter holding its permits after the release
+	}
+	tests := []struct {
+		name    string
+		size    int
+		held    int
+		weights []int
+		steps   []step
+	}{
+		{
+			name: "large head blocks smaller ones behind it", size: 10, held: 10, weights: []int{5, 2, 8, 1, 3},
+			steps: []step{
+				{4, nil},            // 4 free, the head needs 5, 2 and 1 may not overtake it
+				{1, []int{0}},       // 5 free
+				{2, []int{0, 1}},    // 2 free
+				{7, []int{0, 1}},    // 7 free, 8 doesn't fit
+				{1, []int{0, 1, 2}}, // 8 free
+				{4, []int{0, 1, 2, 3, 4}},
+			},
+		},
+		{
+			name: "one release wakes several", size: 6, held: 6, weights: []int{1, 2, 3, 1},
+			steps: []step{
+				{6, []int{0, 1, 2}}, // 1+2+3, the last one has to wait for the next release
+				{1, []int{0, 1, 2, 3}},
+			},
+		},
+		{
+			name: "the whole semaphore", size: 4, held: 1, weights: []int{4, 1},
+			steps: []step{
+				{1, []int{0}},
+				{4, []int{0, 1}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(tt.size)
+			if err := s.AcquireContext(context.Background(), tt.held); err != nil {
+				t.Fatal(err)
+			}
+			var waiters []*asyncWaiter
+			for _, n := range tt.weights {
+				waiters = append(waiters, queueWaiter(t, s, n))
+			}
+			for i, st := range tt.steps {
+				s.ReleaseN(st.release)
+				if got := acquiredWaiters(t, waiters); !equalInts(got, st.wantAcquired) {
+					t.Fatalf("after step %d (release %d) acquired %v, want %v", i, st.release, got, st.wantAcquired)
+				}
+			}
+			for _, w := range waiters {
+				if err := <-w.err; err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCancelledWaiter(t *testing.T) {
+	tests := []struct {
+		name         string
+		size         int
+		held         int
+		weights      []int
+		cancel       int   // index of the waiter cancelled
+		wantAcquired []int // the waiters holding their permits right after the cancellation
+		wantAvail    int
+	}{
+		// 3 free, the head of 5 blocks 2 and 1 until it gives up
+		{"cancelled head unblocks the ones behind", 10, 7, []int{5, 2, 1}, 0, []int{1, 2}, 0},
+		// the waiters behind only get what fits, in order
+		{"cancelled head, the next one still too large", 10, 7, []int{5, 4, 1}, 0, nil, 3},
+		{"cancelled in the middle changes nothing", 10, 8, []int{5, 4, 1}, 1, nil, 2},
+		{"cancelled last", 10, 10, []int{1, 1}, 1, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(tt.size)
+			if err := s.AcquireContext(context.Background(), tt.held); err != nil {
+				t.Fatal(err)
+			}
+			var waiters []*asyncWaiter
+			for _, n := range tt.weights {
+				waiters = append(waiters, queueWaiter(t, s, n))
+			}
+			waiters[tt.cancel].cancel()
+			if err := <-waiters[tt.cancel].err; !errors.Is(err, context.Canceled) {
+				t.Fatalf("cancelled waiter returned %v, want %v", err, context.Canceled)
+			}
+			if got := acquiredWaiters(t, waiters); !equalInts(got, tt.wantAcquired) {
+				t.Fatalf("acquired %v, want %v", got, tt.wantAcquired)
+			}
+			if got := s.Available(); got != tt.wantAvail {
+				t.Errorf("Available() = %d, want %d", got, tt.wantAvail)
+			}
+			if got, want := s.Waiters(), len(tt.weights)-1-len(tt.wantAcquired); got != want {
+				t.Errorf("Waiters() = %d, want %d", got, want)
+			}
+			for _, w := range waiters {
+				w.cancel()
+			}
+		})
+	}
+}
+
+func TestAcquireMoreThanSize(t *testing.T) {
+	s := New(4)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.AcquireContext(ctx, 5); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("AcquireContext(5) of a semaphore of 4 = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if got := s.Available(); got != 4 {
+		t.Errorf("Available() = %d, want 4", got)
+	}
+}
+
+func TestTryAcquire(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		held    int
+		weights []int // waiters queued before TryAcquire
+		n       int
+		want    bool
+	}{
+		{"free", 10, 0, nil, 10, true},
+		{"fits", 10, 8, nil, 2, true},
+		{"doesn't fit", 10, 8, nil, 3, false},
+		{"fits but a waiter is queued", 10, 8, []int{5}, 1, false},
+		{"fits but several waiters are queued", 10, 5, []int{6, 1}, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(tt.size)
+			if err := s.AcquireContext(context.Background(), tt.held); err != nil {
+				t.Fatal(err)
+			}
+			var waiters []*asyncWaiter
+			for _, n := range tt.weights {
+				waiters = append(waiters, queueWaiter(t, s, n))
+			}
+			avail := s.Available()
+			if got := s.TryAcquire(tt.n); got != tt.want {
+				t.Fatalf("TryAcquire(%d) = %v, want %v", tt.n, got, tt.want)
+			}
+			wantAvail := avail
+			if tt.want {
+				wantAvail -= tt.n
+			}
+			if got := s.Available(); got != wantAvail {
+				t.Errorf("Available() = %d, want %d", got, wantAvail)
+			}
+			// once the queue is empty again the permits are there for the taking
+			for _, w := range waiters {
+				w.cancel()
+				<-w.err
+			}
+			if len(waiters) > 0 && !s.TryAcquire(tt.n) {
+				t.Errorf("TryAcquire(%d) after the waiters gave up = false, want true", tt.n)
+			}
+		})
+	}
+}
+
+func TestReleaseN(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		held      int
+		release   int
+		wantPanic bool
+	}{
+		{"all", 4, 4, 4, false},
+		{"some", 4, 3, 2, false},
+		{"one more than held", 4, 3, 4, true},
+		{"beyond size", 4, 4, 5, true},
+		{"none held", 4, 0, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(tt.size)
+			if err := s.AcquireContext(context.Background(), tt.held); err != nil {
+				t.Fatal(err)
+			}
+			panicked := func() (panicked bool) {
+				defer func() { panicked = recover() != nil }()
+				s.ReleaseN(tt.release)
+				return false
+			}()
+			if panicked {
+				// a failed release leaves the permits held untouched
+				if got, want := s.Available(), tt.size-tt.held; got != want {
+					t.Errorf("Available() after the panic = %d, want %d", got, want)
+				}
+			}
+			if panicked != tt.wantPanic {
+				t.Fatalf("ReleaseN(%d) holding %d panicked = %v, want %v", tt.release, tt.held, panicked, tt.wantPanic)
+			}
+			if !panicked {
+				if got, want := s.Available(), tt.size-tt.held+tt.release; got != want {
+					t.Errorf("Available() = %d, want %d", got, want)
+				}
+			}
+		})
+	}
+}
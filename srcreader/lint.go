@@ -0,0 +1,237 @@
+package srcreader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Emanatry/tdsql-migrate-go/csvrow"
+)
+
+// limits of presort/sortmerge.cpp: 4 columns of 33 bytes (with the '\0'), and an int key
+const SORTMERGE_COLUMNS = 4
+const SORTMERGE_MAX_FIELD = 32
+
+// a column of a table, from its CREATE TABLE
+type Column struct {
+	Name       string
+	DataType   string // "bigint"
+	ColumnType string // "bigint(20) unsigned"
+}
+
+// the columns of a table, parsed from the column lines of its .sql file
+func (d *SrcDatabase) Columns(table string) ([]Column, error) {
+	sql, err := d.ReadSQL(table)
+	if err != nil {
+		return nil, err
+	}
+	var cols []Column
+	for _, line := range strings.Split(string(sql), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "`") {
+			continue // CREATE TABLE, keys and options
+		}
+		end := strings.Index(line[1:], "`")
+		if end < 0 {
+			continue
+		}
+		tokens := strings.Fields(line[end+2:])
+		if len(tokens) == 0 {
+			continue
+		}
+		c := Column{Name: line[1 : end+1], ColumnType: strings.ToLower(strings.TrimSuffix(tokens[0], ","))}
+		c.DataType = c.ColumnType
+		if i := strings.Index(c.DataType, "("); i >= 0 {
+			c.DataType = c.DataType[:i]
+		}
+		for _, t := range tokens[1:] {
+			if t = strings.ToLower(strings.TrimSuffix(t, ",")); t == "unsigned" || t == "zerofill" {
+				c.ColumnType += " " + t
+			}
+		}
+		cols = append(cols, c)
+	}
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("no columns found in %s.sql", table)
+	}
+	return cols, nil
+}
+
+// a line of a source csv that wouldn't load (or presort)
+type LintProblem struct {
+	Path    string
+	Line    int    // 0 for a problem of the whole file
+	Field   int    // 1-based, 0 for a problem of the whole line
+	Column  string // name of Field
+	Message string
+}
+
+func (p LintProblem) String() string {
+	switch {
+	case p.Line == 0:
+		return fmt.Sprintf("%s: %s", p.Path, p.Message)
+	case p.Field == 0:
+		return fmt.Sprintf("%s:%d: %s", p.Path, p.Line, p.Message)
+	}
+	return fmt.Sprintf("%s:%d: column %d `%s`: %s", p.Path, p.Line, p.Field, p.Column, p.Message)
+}
+
+// the outcome of linting the csv of a table in one source
+type LintSummary struct {
+	Source   string
+	Database string
+	Table    string
+	Path     string
+	Lines    int64
+	Problems int
+	Err      error // the file couldn't be read
+}
+
+// check every line of the csv of a table against the table's schema, the way the loader converts it
+// with datetimes in loc, and with presort also against the limits of sortmerge
+func (d *SrcDatabase) LintTable(ctx context.Context, table string, presort bool, loc *time.Location, onProblem func(LintProblem)) LintSummary {
+	s := LintSummary{Source: d.SrcName, Database: d.Name, Table: table, Path: d.TableDataFilePath(table)}
+	problem := func(p LintProblem) {
+		p.Path = s.Path
+		s.Problems++
+		onProblem(p)
+	}
+	cols, err := d.Columns(table)
+	if err != nil {
+		s.Err = err
+		return s
+	}
+	kinds := make([]csvrow.Kind, len(cols))
+	for i, c := range cols {
+		kinds[i] = csvrow.KindOf(c.DataType, c.ColumnType)
+	}
+	if presort && len(cols) != SORTMERGE_COLUMNS {
+		problem(LintProblem{Message: fmt.Sprintf("sortmerge only handles tables of %d columns, %s has %d", SORTMERGE_COLUMNS, table, len(cols))})
+	}
+
+	f, err := os.Open(s.Path)
+	if err != nil {
+		s.Err = err
+		return s
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 1024*1024)
+	for {
+		if s.Lines%4096 == 0 && ctx.Err() != nil {
+			s.Err = ctx.Err()
+			return s
+		}
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// longer than the buffer, only its length matters
+			long := append([]byte(nil), line...)
+			for err == bufio.ErrBufferFull {
+				line, err = r.ReadSlice('\n')
+				long = append(long, line...)
+			}
+			line = long
+		}
+		if err != nil && err != io.EOF {
+			s.Err = err
+			return s
+		}
+		if len(line) == 0 {
+			break
+		}
+		s.Lines++
+		lintLine(cols, kinds, line, presort, loc, func(p LintProblem) {
+			p.Line = int(s.Lines)
+			problem(p)
+		})
+		if err == io.EOF {
+			if presort {
+				problem(LintProblem{Line: int(s.Lines), Message: "no newline at the end of the file, sortmerge drops the last line"})
+			}
+			break
+		}
+	}
+	return s
+}
+
+// the problems of one line, split the same way as csvrow.Batch.AppendLine
+func lintLine(cols []Column, kinds []csvrow.Kind, line []byte, presort bool, loc *time.Location, problem func(LintProblem)) {
+	line = bytes.TrimRight(line, "\n\r \t")
+	line = bytes.TrimLeft(line, " \t")
+	fields := bytes.Split(line, []byte{','})
+	if len(fields) != len(cols) {
+		problem(LintProblem{Message: (&csvrow.FieldCountError{Expected: len(cols), Got: len(fields)}).Error()})
+	}
+	for i, f := range fields {
+		if i >= len(cols) {
+			break
+		}
+		field := LintProblem{Field: i + 1, Column: cols[i].Name}
+		if err := csvrow.CheckField(kinds[i], f, loc); err != nil {
+			field.Message = fmt.Sprintf("%q isn't a valid %s: %s", f, cols[i].ColumnType, err.Error())
+			problem(field)
+			continue
+		}
+		if !presort {
+			continue
+		}
+		if len(f) > SORTMERGE_MAX_FIELD {
+			field.Message = fmt.Sprintf("%d bytes, sortmerge holds at most %d", len(f), SORTMERGE_MAX_FIELD)
+			problem(field)
+		}
+		if i == 0 {
+			if _, err := strconv.ParseInt(string(f), 10, 32); err != nil {
+				field.Message = fmt.Sprintf("%q doesn't fit the 32-bit key of sortmerge", f)
+				problem(field)
+			}
+		}
+	}
+}
+
+// lint the csv of every table of both sources, workers files at a time, with the datetimes in loc
+// (the location of the loading sessions). onProblem is called for every problem, one call at a time.
+// the summaries are in the order of the tables, a for each source.
+// the error is for sources whose databases don't match.
+func LintSources(ctx context.Context, srca *Source, srcb *Source, presort bool, loc *time.Location, workers int, onProblem func(LintProblem)) ([]LintSummary, error) {
+	if len(srca.Databases) != len(srcb.Databases) {
+		return nil, fmt.Errorf("%s has %d databases, %s has %d", srca.SrcName, len(srca.Databases), srcb.SrcName, len(srcb.Databases))
+	}
+	var dbs []*SrcDatabase
+	var tables []string
+	for i, dba := range srca.Databases {
+		for _, table := range dba.Tables {
+			dbs = append(dbs, dba, srcb.Databases[i])
+			tables = append(tables, table, table)
+		}
+	}
+	summaries := make([]LintSummary, len(dbs))
+	var lock sync.Mutex
+	report := func(p LintProblem) {
+		lock.Lock()
+		defer lock.Unlock()
+		onProblem(p)
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				summaries[i] = dbs[i].LintTable(ctx, tables[i], presort, loc, report)
+			}
+		}()
+	}
+	for i := range dbs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return summaries, nil
+}
@@ -0,0 +1,168 @@
+package srcreader
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const lintTestSQL = "CREATE TABLE `1` (\n" +
+	"  `id` bigint(20) unsigned NOT NULL,\n" +
+	"  `a` double NOT NULL,\n" +
+	"  `b` char(32) NOT NULL,\n" +
+	"  `updated_at` datetime NOT NULL,\n" +
+	"  PRIMARY KEY (`id`,`a`)\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8;\n"
+
+// a source with the tables of every database, each table a .sql and a .csv
+func writeLintSource(t *testing.T, name string, databases map[string]map[string]string) *Source {
+	t.Helper()
+	root := t.TempDir()
+	for db, tables := range databases {
+		if err := os.Mkdir(filepath.Join(root, db), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for table, csv := range tables {
+			for file, content := range map[string]string{table + ".sql": lintTestSQL, table + ".csv": csv} {
+				if err := ioutil.WriteFile(filepath.Join(root, db, file), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	src, err := Open(root, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return src
+}
+
+func TestColumns(t *testing.T) {
+	src := writeLintSource(t, "src_a", map[string]map[string]string{"db1": {"1": ""}})
+	cols, err := src.Databases[0].Columns("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Column{
+		{Name: "id", DataType: "bigint", ColumnType: "bigint(20) unsigned"},
+		{Name: "a", DataType: "double", ColumnType: "double"},
+		{Name: "b", DataType: "char", ColumnType: "char(32)"},
+		{Name: "updated_at", DataType: "datetime", ColumnType: "datetime"},
+	}
+	if !reflect.DeepEqual(cols, want) {
+		t.Errorf("got %+v, want %+v", cols, want)
+	}
+}
+
+func TestLintTable(t *testing.T) {
+	shanghai := time.FixedZone("+08:00", 8*3600)
+	tests := []struct {
+		name    string
+		csv     string
+		presort bool
+		loc     *time.Location
+		want    []string // LintProblem.String() without the path
+	}{
+		{"valid", "1,0.5,abc,2021-12-12 00:00:00\n2,1e3,,2021-12-12\r\n", true, time.UTC, nil},
+		{"field count", "1,0.5,abc\n1,0.5,abc,2021-12-12,x\n", false, time.UTC, []string{
+			":1: expected 4 fields, got 3",
+			":2: expected 4 fields, got 5",
+		}},
+		{"types", "-1,x,abc,2021-13-01\n", false, time.UTC, []string{
+			`:1: column 1 ` + "`id`" + `: "-1" isn't a valid bigint(20) unsigned: invalid syntax`,
+			`:1: column 2 ` + "`a`" + `: "x" isn't a valid double: invalid syntax`,
+			`:1: column 4 ` + "`updated_at`" + `: "2021-13-01" isn't a valid datetime: invalid syntax`,
+		}},
+		// 2021-03-28 02:30 is skipped in Europe/Berlin, not at +08:00
+		{"datetime in the session zone", "1,0.5,abc,2021-03-28 02:30:00\n", false, shanghai, nil},
+		{"sortmerge field width", "1,0.5," + strings.Repeat("x", 33) + ",2021-12-12\n", true, time.UTC, []string{
+			":1: column 3 `b`: 33 bytes, sortmerge holds at most 32",
+		}},
+		{"sortmerge key width", "4294967296,0.5,abc,2021-12-12\n", true, time.UTC, []string{
+			`:1: column 1 ` + "`id`" + `: "4294967296" doesn't fit the 32-bit key of sortmerge`,
+		}},
+		{"sortmerge trailing newline", "1,0.5,abc,2021-12-12\n2,0.5,abc,2021-12-12", true, time.UTC, []string{
+			":2: no newline at the end of the file, sortmerge drops the last line",
+		}},
+		{"sortmerge limits without presort", "4294967296,0.5," + strings.Repeat("x", 33) + ",2021-12-12", false, time.UTC, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := writeLintSource(t, "src_a", map[string]map[string]string{"db1": {"1": tt.csv}})
+			d := src.Databases[0]
+			var got []string
+			s := d.LintTable(context.Background(), "1", tt.presort, tt.loc, func(p LintProblem) {
+				got = append(got, strings.TrimPrefix(p.String(), p.Path))
+			})
+			if s.Err != nil {
+				t.Fatal(s.Err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if s.Problems != len(tt.want) || s.Path != d.TableDataFilePath("1") {
+				t.Errorf("summary %+v", s)
+			}
+		})
+	}
+}
+
+func TestLintTableSortmergeColumns(t *testing.T) {
+	src := writeLintSource(t, "src_a", map[string]map[string]string{"db1": {"1": "1,abc\n"}})
+	d := src.Databases[0]
+	sql := "CREATE TABLE `1` (\n  `id` int NOT NULL,\n  `b` varchar(10),\n  PRIMARY KEY (`id`)\n);\n"
+	if err := ioutil.WriteFile(filepath.Join(d.srcdbpath, "1.sql"), []byte(sql), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	d.LintTable(context.Background(), "1", true, time.UTC, func(p LintProblem) { got = append(got, p.String()) })
+	want := []string{d.TableDataFilePath("1") + ": sortmerge only handles tables of 4 columns, 1 has 2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLintDatetimeLocation(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	src := writeLintSource(t, "src_a", map[string]map[string]string{"db1": {"1": "1,0.5,abc,2021-03-28 02:30:00\n"}})
+	var got []string
+	src.Databases[0].LintTable(context.Background(), "1", false, berlin, func(p LintProblem) { got = append(got, p.Message) })
+	if len(got) != 1 || !strings.Contains(got[0], "doesn't exist in the time zone") {
+		t.Errorf("got %q, want the datetime skipped by the clocks in Europe/Berlin", got)
+	}
+}
+
+func TestLintSources(t *testing.T) {
+	srca := writeLintSource(t, "src_a", map[string]map[string]string{"db1": {"1": "1,0.5,abc,2021-12-12\n", "2": "x,0.5,abc,2021-12-12\n"}})
+	srcb := writeLintSource(t, "src_b", map[string]map[string]string{"db1": {"1": "1,0.5,abc\n", "2": "1,0.5,abc,2021-12-12\n"}})
+	var problems int
+	summaries, err := LintSources(context.Background(), srca, srcb, false, time.UTC, 2, func(LintProblem) { problems++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range summaries {
+		if s.Err != nil {
+			t.Fatal(s.Err)
+		}
+		got = append(got, s.Source+" "+s.Database+"."+s.Table+" "+strings.Repeat("!", s.Problems))
+	}
+	want := []string{"src_a db1.1 ", "src_b db1.1 !", "src_a db1.2 !", "src_b db1.2 "}
+	if !reflect.DeepEqual(got, want) || problems != 2 {
+		t.Errorf("got %q with %d problems, want %q", got, problems, want)
+	}
+
+	mismatched := writeLintSource(t, "src_b", map[string]map[string]string{"db1": {"1": ""}, "db2": {"1": ""}})
+	if _, err := LintSources(context.Background(), srca, mismatched, false, time.UTC, 2, func(LintProblem) {}); err == nil ||
+		err.Error() != "src_a has 1 databases, src_b has 2" {
+		t.Errorf("got %v, want the databases mismatch", err)
+	}
+}
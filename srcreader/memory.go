@@ -0,0 +1,132 @@
+package srcreader
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/Emanatry/tdsql-migrate-go/logging"
+	"github.com/Emanatry/tdsql-migrate-go/semaphore"
+	"github.com/Emanatry/tdsql-migrate-go/stats"
+)
+
+// memory budget of the presort jobs in MB, 0 to use PRESORT_MEMORY_FRACTION of the available memory
+var PresortMemoryBudgetMB = 0
+
+// max sortmerge children at the same time regardless of the memory, they are single threaded and partly io bound
+var MaxPresortJobs = 2 * runtime.NumCPU()
+
+// share of the available memory (MemAvailable or the cgroup limit) used by default
+const PRESORT_MEMORY_FRACTION = 0.6
+
+// a sortmerge child holds about this many times its input (both csv files) in memory
+const PRESORT_MEMORY_FACTOR = 2
+
+// used when the available memory can't be detected
+const PRESORT_DEFAULT_BUDGET_MB = 2048
+
+const MB = 1024 * 1024
+
+// admission control of the presort jobs: a job is admitted once its estimated memory fits in the
+// budget next to the jobs already running and the RSS of this process. a job larger than the whole
+// budget is admitted alone. waiting jobs are admitted in FIFO order.
+type presortAdmission struct {
+	budgetMB int
+	mem      *semaphore.Semaphore // MB
+	jobs     *semaphore.Semaphore
+
+	lock     sync.Mutex
+	running  int
+	usedMB   int
+	released chan struct{} // closed and replaced every time a running job finishes
+}
+
+var admission *presortAdmission
+var admissionOnce sync.Once
+
+func getPresortAdmission() *presortAdmission {
+	admissionOnce.Do(func() {
+		budget := PresortMemoryBudgetMB
+		if budget <= 0 {
+			budget = PRESORT_DEFAULT_BUDGET_MB
+			if avail := stats.AvailableMemory(); avail > 0 {
+				budget = int(float64(avail) * PRESORT_MEMORY_FRACTION / MB)
+			}
+		}
+		if budget < 1 {
+			budget = 1
+		}
+		logging.Default().Infof("presort memory budget: %d MB, up to %d jobs", budget, MaxPresortJobs)
+		admission = &presortAdmission{
+			budgetMB: budget,
+			mem:      semaphore.New(budget),
+			jobs:     semaphore.New(MaxPresortJobs),
+			released: make(chan struct{}),
+		}
+	})
+	return admission
+}
+
+// estimated memory of presorting a table in MB, capped at the budget so that it can still run alone
+func (a *presortAdmission) weight(dba *SrcDatabase, dbb *SrcDatabase, table string) int {
+	w := int(PRESORT_MEMORY_FACTOR * (dba.TableDataSize(table) + dbb.TableDataSize(table)) / MB)
+	if w < 1 {
+		w = 1
+	}
+	if w > a.budgetMB {
+		w = a.budgetMB
+	}
+	return w
+}
+
+// blocks until the job is admitted, the returned func must be called when the job is done
+func (a *presortAdmission) admit(ctx context.Context, weight int) (release func(), err error) {
+	if err = a.jobs.AcquireContext(ctx, 1); err != nil {
+		return nil, err
+	}
+	if err = a.mem.AcquireContext(ctx, weight); err != nil {
+		a.jobs.Release()
+		return nil, err
+	}
+	for {
+		// the budget only counts the children, also leave room for what this process is holding.
+		// the weight is kept while waiting, so that the job keeps its place ahead of the smaller ones.
+		a.lock.Lock()
+		rssMB := int(stats.ProcessRSS() / MB)
+		if a.running == 0 || rssMB+a.usedMB+weight <= a.budgetMB {
+			a.running++
+			a.usedMB += weight
+			a.lock.Unlock()
+			break
+		}
+		released := a.released
+		a.lock.Unlock()
+		// wait for a running job to finish, once none is left the job is admitted alone
+		select {
+		case <-ctx.Done():
+			a.mem.ReleaseN(weight)
+			a.jobs.Release()
+			return nil, ctx.Err()
+		case <-released:
+		}
+	}
+	a.reportGauge()
+	return func() {
+		a.lock.Lock()
+		a.running--
+		a.usedMB -= weight
+		close(a.released)
+		a.released = make(chan struct{})
+		a.lock.Unlock()
+		a.mem.ReleaseN(weight)
+		a.jobs.Release()
+		a.reportGauge()
+	}, nil
+}
+
+func (a *presortAdmission) reportGauge() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	stats.SetGauge("presort", fmt.Sprintf("%d running %d/%dMB (%d waiting)", a.running, a.usedMB, a.budgetMB, a.mem.Waiters()+a.jobs.Waiters()))
+}
@@ -1,21 +1,22 @@
 package srcreader
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/Emanatry/tdsql-migrate-go/semaphore"
+	"github.com/Emanatry/tdsql-migrate-go/logging"
 )
 
-const PRESORT_PATH = "./presort/data/"
-const SORTMERGER_PROGRAM = "./presort/sortmerge"
-
-// limit the total amout of concurrent presort job to avoid OOM.
-const CONCURRENT_PRESORT_JOB = 5
+// where the presorted and merged csv files are written, and the program that writes them
+var PresortPath = "./presort/data/"
+var SortMergerProgram = "./presort/sortmerge"
 
 func (d *SrcDatabase) determinePKColumnType(table string) (string, error) {
 	sql, err := d.ReadSQL(table)
@@ -36,15 +37,36 @@ func (d *SrcDatabase) determinePKColumnType(table string) (string, error) {
 	return "id_a_b", nil
 }
 
+// the columns (by index) the merged csv of a table is sorted and deduplicated on, the first one
+// is the numeric key sortmerge sorts by
+func (d *SrcDatabase) KeyColumns(table string) ([]int, error) {
+	pk, err := d.determinePKColumnType(table)
+	if err != nil {
+		return nil, err
+	}
+	switch pk {
+	case "id":
+		return []int{0}, nil
+	case "id_a":
+		return []int{0, 1}, nil
+	case "id_b_a":
+		return []int{0, 2, 1}, nil
+	}
+	return []int{0, 1, 2}, nil
+}
+
 func (db *SrcDatabase) getPresortMarkFile(table string) string {
-	return PRESORT_PATH + db.SrcName + "/" + db.Name + "/" + table + ".presorted"
+	return PresortPath + db.SrcName + "/" + db.Name + "/" + table + ".presorted"
 }
 
-func (db *SrcDatabase) getTableDataFilePath(table string) string {
+// the csv data file of a table
+func (db *SrcDatabase) TableDataFilePath(table string) string {
 	return db.srcdbpath + "/" + table + ".csv"
 }
 
 func (d *SrcDatabase) IsTablePresorted(table string) bool {
+	presortStateLock.Lock()
+	defer presortStateLock.Unlock()
 	for i, tb := range d.Tables {
 		if table == tb {
 			return d.tablePresorted[i]
@@ -53,6 +75,55 @@ func (d *SrcDatabase) IsTablePresorted(table string) bool {
 	return false
 }
 
+// size in bytes of the csv data file of a table, 0 if it can't be read
+func (d *SrcDatabase) TableDataSize(table string) int64 {
+	info, err := os.Stat(d.TableDataFilePath(table))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func getMergeOutputPaths(dba *SrcDatabase, table string) (dbroot string, mergeOutputFile string, markfile string) {
+	dbroot = PresortPath + "merged" + "/" + dba.Name
+	return dbroot, dbroot + "/" + table + ".csv", dbroot + "/" + table + ".mark"
+}
+
+// true if the merged csv of a table is ready, PresortAndMergeTable returns right away for such tables
+func IsTableMerged(dba *SrcDatabase, dbb *SrcDatabase, table string) bool {
+	tableIndex := dba.getTableIndex(table)
+	presortStateLock.Lock()
+	merged := dba.tablePresorted[tableIndex] && dbb.tablePresorted[tableIndex]
+	presortStateLock.Unlock()
+	if merged {
+		return true
+	}
+	_, _, markfile := getMergeOutputPaths(dba, table)
+	return doFileExists(markfile)
+}
+
+// the merged csv of a table, and whether it's ready
+func MergedTablePath(dba *SrcDatabase, dbb *SrcDatabase, table string) (string, bool) {
+	_, mergeOutputFile, _ := getMergeOutputPaths(dba, table)
+	return mergeOutputFile, IsTableMerged(dba, dbb, table)
+}
+
+// remove the merged csv of a table, it's presorted again the next time it's needed
+func RemoveMergedTable(dba *SrcDatabase, dbb *SrcDatabase, table string) error {
+	dbroot, mergeOutputFile, markfile := getMergeOutputPaths(dba, table)
+	for _, path := range []string{markfile, mergeOutputFile, dbroot + "/" + table + ".sql", dba.getPresortMarkFile(table), dbb.getPresortMarkFile(table)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	tableIndex := dba.getTableIndex(table)
+	presortStateLock.Lock()
+	dba.tablePresorted[tableIndex] = false
+	dbb.tablePresorted[tableIndex] = false
+	presortStateLock.Unlock()
+	return nil
+}
+
 func (db *SrcDatabase) getTableIndex(table string) int {
 	for i, v := range db.Tables {
 		if v == table {
@@ -62,18 +133,32 @@ func (db *SrcDatabase) getTableIndex(table string) int {
 	return -1
 }
 
-var rateLimitSem = semaphore.New(CONCURRENT_PRESORT_JOB)
+var presortStateLock sync.Mutex // guards SrcDatabase.tablePresorted
 var sortMergeMutexMap = make(map[string]*sync.Mutex)
 var sortMergeMutexMapLock sync.Mutex
 
-func PresortAndMergeTable(dba *SrcDatabase, dbb *SrcDatabase, table string) (csvpath string, err error) {
+// the sortmerge child is killed if ctx is cancelled, in which case no mark file is written and
+// the table will be presorted again on the next run.
+// the job waits for its share of the presort memory budget first, see presortAdmission.
+func PresortAndMergeTable(ctx context.Context, dba *SrcDatabase, dbb *SrcDatabase, table string) (csvpath string, err error) {
+	return presortAndMergeTable(ctx, dba, dbb, table, func() {})
+}
+
+// onAdmitted is called once the job no longer waits for other presort jobs (admitted, or returning)
+func presortAndMergeTable(ctx context.Context, dba *SrcDatabase, dbb *SrcDatabase, table string, onAdmitted func()) (csvpath string, err error) {
+	var admittedOnce sync.Once
+	admitted := func() { admittedOnce.Do(onAdmitted) }
+	defer admitted()
+
 	tableIndex := dba.getTableIndex(table)
 
-	dbroot := PRESORT_PATH + "merged" + "/" + dba.Name
-	mergeOutputFile := dbroot + "/" + table + ".csv"
+	dbroot, mergeOutputFile, markfile := getMergeOutputPaths(dba, table)
 
-	rateLimitSem.Acquire()
-	defer rateLimitSem.Release()
+	// this is messy... presort and merging used to be two individual steps
+	// we decided to combine them together (for reduced io time) at the last minute.
+	if IsTableMerged(dba, dbb, table) {
+		return mergeOutputFile, nil
+	}
 
 	var mergeLock *sync.Mutex
 	sortMergeMutexMapLock.Lock()
@@ -85,29 +170,41 @@ func PresortAndMergeTable(dba *SrcDatabase, dbb *SrcDatabase, table string) (csv
 	}
 	sortMergeMutexMapLock.Unlock()
 
-	// this is messy... presort and merging used to be two individual steps
-	// we decided to combine them together (for reduced io time) at the last minute.
-	if dba.tablePresorted[tableIndex] && dbb.tablePresorted[tableIndex] {
-		return mergeOutputFile, nil
-	}
-
 	mergeLock.Lock()
 	defer mergeLock.Unlock()
 
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+
 	err = os.MkdirAll(dbroot, 0755)
 	if err != nil {
 		return "", err
 	}
-	markfile := dbroot + "/" + table + ".mark"
 	if doFileExists(markfile) {
 		return mergeOutputFile, err
 	}
 
+	// checked after taking mergeLock, so that a table being presorted by someone else doesn't take memory twice
+	adm := getPresortAdmission()
+	weight := adm.weight(dba, dbb, table)
+	waitStart := time.Now()
+	release, err := adm.admit(ctx, weight)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	admitted()
+	log := presortLog(dba, table)
+	if waited := time.Since(waitStart); waited > time.Second {
+		log.Infof("waited %.1f secs for %d MB of presort memory", waited.Seconds(), weight)
+	}
+
 	coltype, err := dba.determinePKColumnType(table)
 	if err != nil {
 		return "", err
 	}
-	fmt.Printf("@ presorting & merging %s.%s (%s)\n", dba.Name, table, coltype)
+	log.Infof("presorting & merging (%s)", coltype)
 	sql, err := dba.ReadSQL(table)
 	if err != nil {
 		return "", err
@@ -116,7 +213,7 @@ func PresortAndMergeTable(dba *SrcDatabase, dbb *SrcDatabase, table string) (csv
 	if err != nil {
 		return "", err
 	}
-	cmd := exec.Command(SORTMERGER_PROGRAM, dba.getTableDataFilePath(table), dbb.getTableDataFilePath(table), mergeOutputFile, coltype)
+	cmd := exec.CommandContext(ctx, SortMergerProgram, dba.TableDataFilePath(table), dbb.TableDataFilePath(table), mergeOutputFile, coltype)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return "", err
@@ -129,8 +226,17 @@ func PresortAndMergeTable(dba *SrcDatabase, dbb *SrcDatabase, table string) (csv
 	if err != nil {
 		return "", err
 	}
-	println(string(out))
-	cmd.Wait()
+	if len(out) > 0 {
+		log.Debugf("sortmerge output:\n%s", out)
+	}
+	if err = cmd.Wait(); err != nil {
+		os.Remove(mergeOutputFile) // partial output, will be redone
+		if ctx.Err() != nil {
+			log.Infof("presort terminated")
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("sortmerge failed for %s.%s: %s", dba.Name, table, err.Error())
+	}
 
 	// create mark file for merged tables
 	f, err := os.Create(markfile)
@@ -139,26 +245,84 @@ func PresortAndMergeTable(dba *SrcDatabase, dbb *SrcDatabase, table string) (csv
 	}
 	f.Close()
 
+	presortStateLock.Lock()
 	dba.tablePresorted[tableIndex] = true
 	dbb.tablePresorted[tableIndex] = true
+	presortStateLock.Unlock()
 
 	return mergeOutputFile, err
 }
 
-func StartBackgoundPresortMerge(srca *Source, srcb *Source) {
-	go func() {
-		sortAndMergeTable := func(table string) {
-			for i, dba := range srca.Databases {
-				dbb := srcb.Databases[i]
-				_, err := PresortAndMergeTable(dba, dbb, table)
-				if err != nil {
-					panic(err)
-				}
+// the logger of the presort of a table, merging both sources
+func presortLog(dba *SrcDatabase, table string) *logging.Logger {
+	return logging.Default().With("db", dba.Name, "table", table, "phase", "presort")
+}
+
+// presort & merge every table in the background, largest tables first so that the scheduler,
+// which also starts with the largest tables, finds them ready.
+func StartBackgoundPresortMerge(ctx context.Context, srca *Source, srcb *Source) {
+	go presortMergeSource(ctx, srca, srcb, func(dba *SrcDatabase, table string, err error) {
+		if ctx.Err() == nil {
+			// not fatal here, the migration of this table will try again and report the error
+			presortLog(dba, table).Warnf("background presort failed: %s", err.Error())
+		}
+	})
+}
+
+// presort & merge every table of the sources, returns once all of them are done.
+// the tables that failed are listed in the error, the others are merged all the same.
+func PresortAndMergeSource(ctx context.Context, srca *Source, srcb *Source) error {
+	var lock sync.Mutex
+	var failed []string
+	presortMergeSource(ctx, srca, srcb, func(dba *SrcDatabase, table string, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		failed = append(failed, fmt.Sprintf("%s.%s: %s", dba.Name, table, err.Error()))
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("%d table(s) failed presorting:\n - %s", len(failed), strings.Join(failed, "\n - "))
+	}
+	return nil
+}
+
+func presortMergeSource(ctx context.Context, srca *Source, srcb *Source, onError func(dba *SrcDatabase, table string, err error)) {
+	type job struct {
+		dba, dbb *SrcDatabase
+		table    string
+		size     int64
+	}
+	var jobs []job
+	for i, dba := range srca.Databases {
+		dbb := srcb.Databases[i]
+		for _, table := range dba.Tables {
+			jobs = append(jobs, job{dba, dbb, table, dba.TableDataSize(table) + dbb.TableDataSize(table)})
+		}
+	}
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].size > jobs[j].size
+	})
+
+	// jobs run concurrently as far as the memory budget allows, each one is started once the
+	// previous one is admitted, so that they queue up in order
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		admitted := make(chan struct{})
+		wg.Add(1)
+		go func(j job) {
+			defer wg.Done()
+			_, err := presortAndMergeTable(ctx, j.dba, j.dbb, j.table, func() { close(admitted) })
+			if err != nil {
+				onError(j.dba, j.table, err)
 			}
+		}(j)
+		<-admitted
+		if ctx.Err() != nil {
+			break
 		}
-		sortAndMergeTable("1")
-		sortAndMergeTable("2")
-		sortAndMergeTable("3")
-		sortAndMergeTable("4")
-	}()
+	}
+	wg.Wait()
 }
@@ -0,0 +1,116 @@
+package srcreader
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const presortTestSQL = "CREATE TABLE `1` (\n" +
+	"  `id` int NOT NULL,\n" +
+	"  `a` double NOT NULL,\n" +
+	"  PRIMARY KEY (`id`,`a`)\n" +
+	");\n"
+
+// run in a new current directory with the sources src_a and src_b of the table db1.1 and a
+// sortmerge program running script, returns both sources
+func presortTestDir(t *testing.T, script string) (*Source, *Source) {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	files := map[string]string{
+		"presort/sortmerge":  "#!/bin/sh\n" + script,
+		"src_a/db1/1.sql":    presortTestSQL,
+		"src_a/db1/1.csv":    "2,0.5\n1,0.5\n",
+		"src_b/db1/1.sql":    presortTestSQL,
+		"src_b/db1/1.csv":    "3,0.5\n",
+		"presort/data/.keep": "",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srca, err := Open(filepath.Join(dir, "src_a"), "src_a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcb, err := Open(filepath.Join(dir, "src_b"), "src_b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srca, srcb
+}
+
+func TestPresortAndMergeTable(t *testing.T) {
+	srca, srcb := presortTestDir(t, `cat "$1" "$2" > "$3"`+"\necho \"$4\"\n")
+	dba, dbb := srca.Databases[0], srcb.Databases[0]
+	path, err := PresortAndMergeTable(context.Background(), dba, dbb, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(merged) != "2,0.5\n1,0.5\n3,0.5\n" {
+		t.Errorf("merged %q", merged)
+	}
+
+	// merged once, sortmerge isn't run again
+	if err := ioutil.WriteFile("presort/sortmerge", []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	again, err := PresortAndMergeTable(context.Background(), dba, dbb, "1")
+	if err != nil || again != path {
+		t.Errorf("second merge: %q, %v, want %q", again, err, path)
+	}
+}
+
+func TestPresortAndMergeTableFailed(t *testing.T) {
+	srca, srcb := presortTestDir(t, "echo partial > \"$3\"\nexit 3\n")
+	path, err := PresortAndMergeTable(context.Background(), srca.Databases[0], srcb.Databases[0], "1")
+	if err == nil {
+		t.Fatalf("no error, merged into %s", path)
+	}
+	if _, err := os.Stat("presort/data/merged/db1/1.csv"); !os.IsNotExist(err) {
+		t.Errorf("the partial output is kept: %v", err)
+	}
+}
+
+func TestPresortAndMergeTableInterrupted(t *testing.T) {
+	srca, srcb := presortTestDir(t, "exec sleep 30\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := PresortAndMergeTable(ctx, srca.Databases[0], srcb.Databases[0], "1")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	// sortmerge is killed rather than waited for
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("returned after %v", elapsed)
+	}
+	// presorted again on the next run
+	matches, _ := filepath.Glob("presort/data/merged/db1/1.*")
+	for _, m := range matches {
+		if filepath.Ext(m) != ".sql" {
+			t.Errorf("%s is left after the interruption", m)
+		}
+	}
+}
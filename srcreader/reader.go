@@ -3,6 +3,7 @@ package srcreader
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"sync"
@@ -93,3 +94,34 @@ func (d *SrcDatabase) ReadSQL(tablename string) (sqlContent []byte, err error) {
 func (d *SrcDatabase) OpenCSV(tablename string, seek int64) (*bufio.Reader, error) {
 	panic("SrcDatabase.OpenCSV() should not be used in this implementation")
 }
+
+// a copy of the source with only the given tables, "db.table" or "db" for a whole database.
+// the same list applied to both sources keeps their databases aligned.
+func (s *Source) Filter(tables []string) (*Source, error) {
+	wanted := map[string]bool{}
+	for _, t := range tables {
+		wanted[t] = true
+	}
+	found := map[string]bool{}
+	filtered := &Source{srcpath: s.srcpath, SrcName: s.SrcName}
+	for _, d := range s.Databases {
+		fd := &SrcDatabase{srcdbpath: d.srcdbpath, SrcName: d.SrcName, Name: d.Name}
+		for i, table := range d.Tables {
+			if !wanted[d.Name] && !wanted[d.Name+"."+table] {
+				continue
+			}
+			found[d.Name] = true
+			found[d.Name+"."+table] = true
+			fd.Tables = append(fd.Tables, table)
+			fd.tablePresorted = append(fd.tablePresorted, d.tablePresorted[i])
+		}
+		fd.presortLock = make([]sync.Mutex, len(fd.Tables))
+		filtered.Databases = append(filtered.Databases, fd)
+	}
+	for _, t := range tables {
+		if !found[t] {
+			return nil, fmt.Errorf("no table %s in %s", t, s.SrcName)
+		}
+	}
+	return filtered, nil
+}
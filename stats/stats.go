@@ -5,16 +5,22 @@ import (
 	"fmt"
 	"io/ioutil"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
-)
 
-var DevSuppressLog bool
+	"github.com/Emanatry/tdsql-migrate-go/logging"
+)
 
 var bytesMigratedSum int
+var batchLatencySum time.Duration
+var batchCount int
 var numCommitSum int
+var numRetrySum int
+var retriesByReason = make(map[string]int)
+var gauges = make(map[string]string)
 var lastTimeCalculated time.Time = time.Now()
 
 var statlock sync.Mutex
@@ -28,12 +34,82 @@ func ReportBytesMigrated(bytesMigrated int) {
 	statlock.Unlock()
 }
 
+// report the time it took to execute one batch
+func ReportBatchLatency(latency time.Duration) {
+	statlock.Lock()
+	batchLatencySum += latency
+	batchCount++
+	statlock.Unlock()
+}
+
+// set a named value to be shown at the end of the stats line, e.g. the current number of workers
+func SetGauge(name string, value string) {
+	statlock.Lock()
+	gauges[name] = value
+	statlock.Unlock()
+}
+
+func gaugeSummary() string {
+	statlock.Lock()
+	defer statlock.Unlock()
+	names := make([]string, 0, len(gauges))
+	for name := range gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var str strings.Builder
+	for _, name := range names {
+		str.WriteString(fmt.Sprintf(", %s: %s", name, gauges[name]))
+	}
+	return str.String()
+}
+
+// average latency of the batches since the last call, 0 if there were none
+func sampleBatchLatency() time.Duration {
+	statlock.Lock()
+	defer statlock.Unlock()
+	var avg time.Duration
+	if batchCount > 0 {
+		avg = batchLatencySum / time.Duration(batchCount)
+	}
+	batchLatencySum = 0
+	batchCount = 0
+	return avg
+}
+
 func ReportCommit() {
 	statlock.Lock()
 	numCommitSum++
 	statlock.Unlock()
 }
 
+// report a retried operation, reason is the error class (deadlock, lock_wait_timeout, connection_lost...)
+func ReportRetry(reason string) {
+	statlock.Lock()
+	numRetrySum++
+	retriesByReason[reason]++
+	statlock.Unlock()
+}
+
+// total retries so far by reason, formatted as "reason=count ..."
+func RetrySummary() string {
+	statlock.Lock()
+	defer statlock.Unlock()
+	reasons := make([]string, 0, len(retriesByReason))
+	for reason := range retriesByReason {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	var parts []string
+	for _, reason := range reasons {
+		parts = append(parts, fmt.Sprintf("%s=%d", reason, retriesByReason[reason]))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
+
 func CalculateAggregateSpeedSinceLast() float32 {
 	now := time.Now()
 	aggSpeed := float32(bytesMigratedSum) / float32(now.Sub(lastTimeCalculated).Seconds()) / 1024
@@ -58,7 +134,7 @@ func GetCPUSample() (idle, total uint64) {
 			for i := 1; i < numFields; i++ {
 				val, err := strconv.ParseUint(fields[i], 10, 64)
 				if err != nil {
-					fmt.Println("Error: ", i, fields[i], err)
+					logging.Default().Warnf("failed parsing field %d of the cpu line of /proc/stat %q: %s", i, fields[i], err.Error())
 				}
 				total += val // tally up all the numbers to get total ticks
 				if i == 4 {  // idle is the 5th field in the cpu line
@@ -78,7 +154,7 @@ func getMemStats() (total int, free int, available int) {
 	free = -1
 	available = -1
 	if err != nil {
-		fmt.Println("failed reading /proc/meminfo: " + err.Error())
+		logging.Default().Warnf("failed reading /proc/meminfo: %s", err.Error())
 		return
 	}
 
@@ -86,10 +162,66 @@ func getMemStats() (total int, free int, available int) {
 	return
 }
 
+// resident set size of this process in bytes, -1 if unknown. sortmerge children are not included.
+func ProcessRSS() int64 {
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return -1
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "VmRSS:") {
+			var kb int64
+			fmt.Sscanf(strings.TrimPrefix(line, "VmRSS:"), "%d", &kb)
+			return kb * 1024
+		}
+	}
+	return -1
+}
+
+// memory that can still be allocated in bytes: MemAvailable, or what's left under the cgroup
+// memory limit (v2 or v1) if that's lower. -1 if unknown.
+func AvailableMemory() int64 {
+	_, _, available := getMemStats()
+	avail := int64(available) * 1024
+	if available < 0 {
+		avail = -1
+	}
+	cgroupFiles := [][2]string{
+		{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory.current"},                                 // v2
+		{"/sys/fs/cgroup/memory/memory.limit_in_bytes", "/sys/fs/cgroup/memory/memory.usage_in_bytes"}, // v1
+	}
+	for _, files := range cgroupFiles {
+		limit, err := readInt64File(files[0])
+		if err != nil {
+			continue // "max", or not this cgroup version
+		}
+		usage, err := readInt64File(files[1])
+		if err != nil {
+			continue
+		}
+		// v1 reports a huge number when there's no limit
+		if left := limit - usage; limit < 1<<60 && (avail < 0 || left < avail) {
+			avail = left
+		}
+		break
+	}
+	return avail
+}
+
+func readInt64File(path string) (int64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
 func StartStatsReportingGoroutine(db *sql.DB) *bool {
 	var doExit bool = false
 	go func() {
 		var lastIdle, lastTotal uint64
+		var lastNumGC uint32
+		var lastPauseTotal uint64
 		for !doExit {
 			idle, total := GetCPUSample() // only works on linux
 			stat := db.Stats()
@@ -97,17 +229,27 @@ func StartStatsReportingGoroutine(db *sql.DB) *bool {
 			runtime.ReadMemStats(&m)
 
 			_, free, available := getMemStats()
-			fmt.Printf("@stats: %v, idle: %d, inUse: %d, open: %d, waitDuration(s): %d, aggSpeed(KB/s): %.2f, cpu(%%): %.2f, heap(MB): %d, memFree(MB): %d, memAvail(MB): %d, nCommit: %d\n",
-				time.Now().Format(time.RFC3339), stat.Idle, stat.InUse, stat.OpenConnections, int(stat.WaitDuration.Seconds()), CalculateAggregateSpeedSinceLast(),
+			logging.Default().Infof("stats: idle: %d, inUse: %d, open: %d, waitDuration(s): %d, aggSpeed(KB/s): %.2f, cpu(%%): %.2f, heap(MB): %d, nGC: %d, gcPause(ms): %.1f, rss(MB): %d, memFree(MB): %d, memAvail(MB): %d, nCommit: %d, batchLatency(ms): %d, nRetry: %d, retries: %s%s",
+				stat.Idle, stat.InUse, stat.OpenConnections, int(stat.WaitDuration.Seconds()), CalculateAggregateSpeedSinceLast(),
 				(1-float64(idle-lastIdle)/float64(total-lastTotal))*100,
 				m.HeapAlloc/1024/1024,
+				m.NumGC-lastNumGC,
+				float64(m.PauseTotalNs-lastPauseTotal)/1e6,
+				ProcessRSS()/1024/1024,
 				free/1204,
 				available/1024,
 				numCommitSum,
+				sampleBatchLatency().Milliseconds(),
+				numRetrySum,
+				RetrySummary(),
+				gaugeSummary(),
 			)
 
 			numCommitSum = 0
+			numRetrySum = 0
 			lastIdle = idle
+			lastNumGC = m.NumGC
+			lastPauseTotal = m.PauseTotalNs
 			lastTotal = total
 			time.Sleep(5 * time.Second)
 		}